@@ -7,10 +7,14 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/goccy/go-yaml"
+	"github.com/justin-molloy/tfagent/job"
 )
 
 type ConfigData struct {
@@ -18,7 +22,43 @@ type ConfigData struct {
 	LogLevel     string        `yaml:"loglevel"`
 	LogToConsole bool          `yaml:"logtoconsole"`
 	Heartbeat    bool          `yaml:"service_heartbeat"`
+	DataDir      string        `yaml:"data_dir"` // agent managed state, eg. trust-on-first-use known_hosts
 	Transfers    []ConfigEntry `yaml:"transfers"`
+
+	// What happens to a file claimed by several transfers when only some of
+	// them send it: fail, success or keep. See PartialFailurePolicy.
+	PartialFailure string `yaml:"partial_failure"`
+
+	// How long files already being sent get to finish when the agent is
+	// stopped. See GracePeriod.
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period"`
+}
+
+// PartialFailurePolicy returns the partial_failure setting, normalised to lower
+// case. It defaults to "fail": the file is handled as a failed transfer, so
+// the transfers that did send it will send it again if it's put back.
+
+func (c *ConfigData) PartialFailurePolicy() string {
+	if p := strings.ToLower(strings.TrimSpace(c.PartialFailure)); p != "" {
+		return p
+	}
+	return "fail"
+}
+
+// DefaultShutdownGracePeriod is how long in-flight transfers get to finish when
+// the agent stops, if shutdown_grace_period isn't set. It's within the time
+// Windows gives a service to stop and systemd's default TimeoutStopSec.
+const DefaultShutdownGracePeriod = 20 * time.Second
+
+// GracePeriod returns how long files already being sent get to finish when the
+// agent is stopped, before it exits anyway. Whatever doesn't finish in time is
+// picked up again from the journal at the next start.
+
+func (c *ConfigData) GracePeriod() time.Duration {
+	if c.ShutdownGracePeriod > 0 {
+		return c.ShutdownGracePeriod
+	}
+	return DefaultShutdownGracePeriod
 }
 
 type ConfigEntry struct {
@@ -37,6 +77,159 @@ type ConfigEntry struct {
 	ActionOnSuccess string `yaml:"action_on_success"` //none, archive, delete
 	ActionOnFail    string `yaml:"action_on_fail"`    //none, archive, delete
 	FailDest        string `yaml:"fail_dest"`
+	FileMode        string `yaml:"file_mode"`      // octal mode for the remote file (scp), eg. 0640
+	PreserveMtime   bool   `yaml:"preserve_mtime"` // send the local modification time (scp)
+
+	// Passphrase for an encrypted private key - given directly, or read from an
+	// environment variable or a file. Only one of these should be set.
+	PrivateKeyPassphrase     string `yaml:"privatekey_passphrase"`
+	PrivateKeyPassphraseEnv  string `yaml:"privatekey_passphrase_env"`
+	PrivateKeyPassphraseFile string `yaml:"privatekey_passphrase_file"`
+	Certificate              string `yaml:"certificate"` // OpenSSH user certificate for privatekey
+
+	// Host key verification for sftp/scp. See HostKeyMode for how the mode is chosen.
+	HostKeyCheck       string `yaml:"host_key_check"`       // known_hosts, fingerprint, tofu
+	KnownHosts         string `yaml:"known_hosts"`          // OpenSSH known_hosts file
+	HostKeyFingerprint string `yaml:"host_key_fingerprint"` // pinned key, eg. SHA256:abc...
+
+	// Include and exclude rules, on top of filter. See FileMatcher. The
+	// compiled rules are filled in by LoadConfig.
+	Include         []string `yaml:"include"`
+	Exclude         []string `yaml:"exclude"`
+	DefaultExcludes *bool    `yaml:"default_excludes"` // skip DefaultExcludes (default true)
+	matcher         *FileMatcher
+	excluded        []string // every transfer's archive and fail directories, see ExcludedDirs
+
+	// Watch subdirectories of source_directory too (apart from the archive and
+	// fail directories). Files keep their path under remotepath.
+	Recursive bool `yaml:"recursive"`
+
+	// How source_directory is watched: fsnotify (default), poll (list it every
+	// poll_interval) or hybrid (fsnotify plus a poll to catch anything missed).
+	WatchMode    string        `yaml:"watch_mode"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+
+	// How long a file must go without changing before it's queued, and how
+	// many checks in a row (settle_delay apart) must find the same size and
+	// modification time. See Settle.
+	SettleDelay time.Duration `yaml:"settle_delay"`
+	StablePolls int           `yaml:"stable_polls"`
+
+	// Send files already in source_directory when the agent starts, optionally
+	// only those modified within scan_max_age.
+	ScanOnStart bool          `yaml:"scan_on_start"`
+	ScanMaxAge  time.Duration `yaml:"scan_max_age"`
+
+	// sftp upload mode: direct writes straight to the final name, temp writes to
+	// a temporary name (in staging_dir if set) and renames it when complete.
+	UploadMode string `yaml:"upload_mode"`
+	StagingDir string `yaml:"staging_dir"`
+	Resume     bool   `yaml:"resume"` // carry on from a partial upload rather than start again
+
+	// What to do when the destination file already exists (sftp, local):
+	// overwrite, skip, fail or rename. See ConflictPolicy.
+	OnConflict string `yaml:"on_conflict"`
+
+	// Check the file at the destination after upload (sftp, local): none, size
+	// or checksum (SHA-256; sftp runs sha256sum on the server).
+	Verify string `yaml:"verify"`
+
+	// Retries for failed sftp/scp uploads. See RetryConfig.
+	Retry RetryConfig `yaml:"retry"`
+
+	// Files that still fail once the retries are used up. See DeferredRetryConfig.
+	DeferredRetry DeferredRetryConfig `yaml:"deferred_retry"`
+
+	// Pooled sftp/scp connections to the server
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`       // close after this long unused (default 60s)
+	KeepaliveInterval time.Duration `yaml:"keepalive_interval"` // default 30s
+}
+
+// RetryConfig is the retry policy for a transfer. The delay before each retry
+// starts at initial_delay and is multiplied by multiplier after every failed
+// attempt, up to max_delay. jitter (0 to 1) spreads each delay by up to that
+// fraction either way, so transfers that fail together don't all retry together.
+// Zero values mean the defaults, except for jitter, where only leaving it out
+// does - see WithDefaults.
+
+type RetryConfig struct {
+	Attempts     int           `yaml:"attempts"` // total attempts, including the first
+	InitialDelay time.Duration `yaml:"initial_delay"`
+	MaxDelay     time.Duration `yaml:"max_delay"`
+	Multiplier   float64       `yaml:"multiplier"`
+	Jitter       *float64      `yaml:"jitter"` // nil means the default; 0 turns jitter off
+}
+
+const (
+	DefaultRetryAttempts     = 3
+	DefaultRetryInitialDelay = 2 * time.Second
+	DefaultRetryMaxDelay     = time.Minute
+	DefaultRetryMultiplier   = 2.0
+	DefaultRetryJitter       = 0.1
+)
+
+// WithDefaults fills in anything not set in the retry policy.
+
+func (r RetryConfig) WithDefaults() RetryConfig {
+	if r.Attempts <= 0 {
+		r.Attempts = DefaultRetryAttempts
+	}
+	if r.InitialDelay <= 0 {
+		r.InitialDelay = DefaultRetryInitialDelay
+	}
+	if r.MaxDelay <= 0 {
+		r.MaxDelay = max(DefaultRetryMaxDelay, r.InitialDelay)
+	}
+	if r.Multiplier == 0 {
+		r.Multiplier = DefaultRetryMultiplier
+	}
+	if r.Jitter == nil {
+		jitter := DefaultRetryJitter
+		r.Jitter = &jitter
+	}
+	return r
+}
+
+// DeferredRetryConfig controls what happens to a file that still fails after
+// its retries. When enabled it waits and is tried again on a schedule (kept in
+// data_dir, so it survives a restart), rather than going straight to
+// action_on_fail. The last step of the schedule repeats until max_attempts or
+// max_age is reached, and only then does the file fail.
+
+type DeferredRetryConfig struct {
+	Enabled     bool            `yaml:"enabled"`
+	Schedule    []time.Duration `yaml:"schedule"`     // wait before each deferred attempt
+	MaxAttempts int             `yaml:"max_attempts"` // deferred attempts before giving up
+	MaxAge      time.Duration   `yaml:"max_age"`      // give up this long after the first failure
+}
+
+var DefaultDeferredRetrySchedule = []time.Duration{
+	time.Minute, 5 * time.Minute, 30 * time.Minute, 2 * time.Hour,
+}
+
+const DefaultDeferredRetryMaxAge = 24 * time.Hour
+
+// WithDefaults fills in anything not set in the deferred retry settings. The
+// default max_attempts is one attempt per step of the schedule.
+
+func (d DeferredRetryConfig) WithDefaults() DeferredRetryConfig {
+	if len(d.Schedule) == 0 {
+		d.Schedule = DefaultDeferredRetrySchedule
+	}
+	if d.MaxAttempts <= 0 {
+		d.MaxAttempts = len(d.Schedule)
+	}
+	if d.MaxAge <= 0 {
+		d.MaxAge = DefaultDeferredRetryMaxAge
+	}
+	return d
+}
+
+// Delay returns how long to wait before deferred attempt n (1 based).
+
+func (d DeferredRetryConfig) Delay(n int) time.Duration {
+	d = d.WithDefaults()
+	return d.Schedule[min(max(n, 1), len(d.Schedule))-1]
 }
 
 type FlagOptions struct {
@@ -63,6 +256,21 @@ func ParseFlags() FlagOptions {
 	return flags
 }
 
+// defaultDataDir is where the agent keeps its state when data_dir isn't set:
+// under ProgramData on Windows and /var/lib/tfagent elsewhere, where a service
+// can write, unlike the config directory (eg. /etc/tfagent). It's a variable so
+// tests can change it.
+
+var defaultDataDir = func(configFile string) string {
+	if runtime.GOOS != "windows" {
+		return "/var/lib/tfagent"
+	}
+	if programData := os.Getenv("ProgramData"); programData != "" {
+		return filepath.Join(programData, "TFAgent", "data")
+	}
+	return filepath.Join(filepath.Dir(configFile), "data")
+}
+
 func LoadConfig(configFile string) (*ConfigData, error) {
 	// Read YAML config into ConfigData
 	yamlConfig, err := os.ReadFile(configFile)
@@ -84,6 +292,64 @@ func LoadConfig(configFile string) (*ConfigData, error) {
 		}
 	}
 
+	// Compile each transfer's file matching rules once. Invalid rules are left
+	// for ValidateConfig to report.
+	for i := range cfg.Transfers {
+		if m, err := CompileMatcher(cfg.Transfers[i]); err == nil {
+			cfg.Transfers[i].matcher = m
+		}
+	}
+
+	// Files in any transfer's archive or fail directory have been finished
+	// with, so recursive transfers leave them alone.
+	var excluded []string
+	for _, t := range cfg.Transfers {
+		for _, dir := range []string{absDir(t.ArchiveDirectory()), absDir(t.FailDirectory())} {
+			if !slices.Contains(excluded, dir) {
+				excluded = append(excluded, dir)
+			}
+		}
+	}
+	for i := range cfg.Transfers {
+		cfg.Transfers[i].excluded = excluded
+	}
+
+	// A file claimed by several transfers is archived or deleted once, using
+	// the first claiming transfer's actions, so the others' are ignored.
+	for i := range cfg.Transfers {
+		for j := i + 1; j < len(cfg.Transfers); j++ {
+			first, other := cfg.Transfers[i], cfg.Transfers[j]
+			if sharesFiles(first, other) && !sameActions(first, other) {
+				slog.Warn("Transfers can pick up the same files but have different actions; files both pick up are finished with the first transfer's actions",
+					"first", first.Name, "other", other.Name)
+			}
+		}
+	}
+
+	// Agent state lives in the platform's state directory unless configured
+	// otherwise.
+	if strings.TrimSpace(cfg.DataDir) == "" {
+		cfg.DataDir = defaultDataDir(configFile)
+	}
+
+	// Host keys trusted on first use are recorded in the data directory unless
+	// a known_hosts file is given.
+	for i := range cfg.Transfers {
+		t := &cfg.Transfers[i]
+		switch t.Type() {
+		case "sftp", "scp":
+		default:
+			continue
+		}
+		if t.HostKeyMode() != "tofu" {
+			continue
+		}
+		slog.Warn("Transfer trusts the server's host key on first use; set host_key_fingerprint or known_hosts to verify it", "name", t.Name, "server", t.Server)
+		if strings.TrimSpace(t.KnownHosts) == "" {
+			t.KnownHosts = filepath.Join(cfg.DataDir, "known_hosts")
+		}
+	}
+
 	return &cfg, nil // ✅ return pointer and nil error
 }
 
@@ -110,6 +376,38 @@ func SetupLogger(cfg *ConfigData, flags FlagOptions) (*os.File, error) {
 		}
 	}
 
+	setLogOutput(cfg, output)
+
+	// Return nil for file if we're using stdout
+	if cfg.LogToConsole {
+		slog.Info("Program started. Log messages output to stdout.")
+		return nil, nil
+	}
+
+	slog.Info("Program started. Future log messages will be written here.", "path", cfg.LogFile)
+	return output, nil
+}
+
+// ReopenLogFile opens the log file again and sends log messages to it, eg. once
+// logrotate has moved the old one aside. It returns the new file; the caller
+// closes the old one. Nothing happens when logging to the console.
+
+func ReopenLogFile(cfg *ConfigData) (*os.File, error) {
+	if cfg.LogToConsole {
+		return nil, nil
+	}
+	output, err := os.OpenFile(cfg.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	setLogOutput(cfg, output)
+	slog.Info("Log file reopened", "path", cfg.LogFile)
+	return output, nil
+}
+
+// setLogOutput makes output, at the configured level, the default logger.
+
+func setLogOutput(cfg *ConfigData, output *os.File) {
 	// Convert log level string to slog.Level
 	var slogLevel slog.Level
 	switch strings.ToLower(cfg.LogLevel) {
@@ -129,17 +427,9 @@ func SetupLogger(cfg *ConfigData, flags FlagOptions) (*os.File, error) {
 		Level:     slogLevel,
 		AddSource: true,
 	})
-	logger := slog.New(handler)
+	// Lines about a file in progress are tagged with its job ID.
+	logger := slog.New(job.NewHandler(handler))
 	slog.SetDefault(logger)
-
-	// Return nil for file if we're using stdout
-	if cfg.LogToConsole {
-		slog.Info("Program started. Log messages output to stdout.")
-		return nil, nil
-	}
-
-	slog.Info("Program started. Future log messages will be written here.", "path", cfg.LogFile)
-	return output, nil
 }
 
 func PrintConfig(cfg ConfigData) {
@@ -171,6 +461,264 @@ func GetConfigFile(appName string) (string, error) {
 		return programCfg, nil
 	}
 
+	// Elsewhere it's in /etc, eg. /etc/tfagent/config.yaml
+
+	if runtime.GOOS != "windows" {
+		return filepath.Join("/etc", strings.ToLower(appName), "config.yaml"), nil
+	}
+
 	msg := fmt.Sprintf("Config not found: %s, %s", localCfg, programCfg)
 	return "", errors.New(msg)
 }
+
+// ParseFileMode parses an octal permission string such as "0640".
+
+func ParseFileMode(s string) (os.FileMode, error) {
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 8, 32)
+	if err != nil || n > 0o777 {
+		return 0, fmt.Errorf("invalid file mode %q (expected octal permissions, eg. 0644)", s)
+	}
+	return os.FileMode(n), nil
+}
+
+// HostKeyMode returns how the server's host key is verified for this transfer.
+// An explicit host_key_check wins; otherwise a pinned fingerprint, then a
+// known_hosts file is used. Trusting the first key seen (tofu) has to be asked
+// for, so with none of them configured it is "", which ValidateConfig rejects.
+
+func (e ConfigEntry) HostKeyMode() string {
+	if mode := strings.ToLower(strings.TrimSpace(e.HostKeyCheck)); mode != "" {
+		return mode
+	}
+	if strings.TrimSpace(e.HostKeyFingerprint) != "" {
+		return "fingerprint"
+	}
+	if strings.TrimSpace(e.KnownHosts) != "" {
+		return "known_hosts"
+	}
+	return ""
+}
+
+const (
+	DefaultPollInterval       = 10 * time.Second
+	DefaultHybridPollInterval = time.Minute
+)
+
+// UsesFsnotify reports whether the transfer's source directory is watched with
+// filesystem notifications.
+
+func (e ConfigEntry) UsesFsnotify() bool {
+	switch strings.ToLower(strings.TrimSpace(e.WatchMode)) {
+	case "", "fsnotify", "hybrid":
+		return true
+	}
+	return false
+}
+
+// UsesPolling reports whether the transfer's source directory is polled.
+
+func (e ConfigEntry) UsesPolling() bool {
+	switch strings.ToLower(strings.TrimSpace(e.WatchMode)) {
+	case "poll", "hybrid":
+		return true
+	}
+	return false
+}
+
+// PollingInterval returns how often to poll the source directory. In hybrid
+// mode the poll is only a safety net, so the default is longer.
+
+func (e ConfigEntry) PollingInterval() time.Duration {
+	if e.PollInterval > 0 {
+		return e.PollInterval
+	}
+	if strings.ToLower(strings.TrimSpace(e.WatchMode)) == "hybrid" {
+		return DefaultHybridPollInterval
+	}
+	return DefaultPollInterval
+}
+
+// DefaultSettleDelay is how long a file must go without an event before it's
+// queued, if settle_delay isn't set.
+const DefaultSettleDelay = time.Second
+
+// Settle returns how long a file must go without changing before it's queued,
+// and how many times in a row after that its size and modification time must
+// be found unchanged, settle_delay apart. Checking size and modification time
+// catches slow writers, eg. over a WAN share, that don't hold the file open in
+// a way that can be detected. stable_polls defaults to 0 (no checks).
+
+func (e ConfigEntry) Settle() (delay time.Duration, polls int) {
+	delay = e.SettleDelay
+	if delay <= 0 {
+		delay = DefaultSettleDelay
+	}
+	return delay, max(e.StablePolls, 0)
+}
+
+// ArchiveDirectory returns where files go with action_on_success archive -
+// archive_dest, or "archive" in the source directory if that isn't set. A
+// relative archive_dest is taken as relative to the source directory.
+
+func (e ConfigEntry) ArchiveDirectory() string {
+	return e.sourceRelative(e.ArchiveDest, "archive")
+}
+
+// FailDirectory returns where files go with action_on_fail archive - fail_dest,
+// or "fail" in the source directory if that isn't set. A relative fail_dest is
+// taken as relative to the source directory.
+
+func (e ConfigEntry) FailDirectory() string {
+	return e.sourceRelative(e.FailDest, "fail")
+}
+
+func (e ConfigEntry) sourceRelative(dir, def string) string {
+	dir = strings.TrimSpace(dir)
+	if dir == "" {
+		dir = def
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(e.SourceDirectory, dir)
+	}
+	return dir
+}
+
+// ExcludedDirs returns the directories a recursive transfer mustn't pick files
+// up from, as absolute paths: the archive and fail directories of every
+// transfer, so files one transfer has finished with aren't sent again by
+// another whose source directory they're under. LoadConfig works them out; a
+// config put together some other way only has the transfer's own.
+
+func (e ConfigEntry) ExcludedDirs() []string {
+	if e.excluded != nil {
+		return e.excluded
+	}
+	return []string{absDir(e.ArchiveDirectory()), absDir(e.FailDirectory())}
+}
+
+func absDir(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		return abs
+	}
+	return filepath.Clean(dir)
+}
+
+// sharesFiles reports whether a file can be in both transfers' source
+// directories: they're the same, or one is under the other and the transfer
+// with the outer one is recursive. The transfers' rules may still keep them
+// apart.
+
+func sharesFiles(a, b ConfigEntry) bool {
+	ad, bd := absDir(a.SourceDirectory), absDir(b.SourceDirectory)
+	if ad == bd {
+		return true
+	}
+	return a.Recursive && isUnder(bd, ad) || b.Recursive && isUnder(ad, bd)
+}
+
+func isUnder(dir, parent string) bool {
+	rel, err := filepath.Rel(parent, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// sameActions reports whether the transfers do the same thing with a file once
+// it's been sent or has failed.
+
+func sameActions(a, b ConfigEntry) bool {
+	action := func(s string) string { return strings.ToLower(strings.TrimSpace(s)) }
+	if action(a.ActionOnSuccess) != action(b.ActionOnSuccess) || action(a.ActionOnFail) != action(b.ActionOnFail) {
+		return false
+	}
+	if action(a.ActionOnSuccess) == "archive" && absDir(a.ArchiveDirectory()) != absDir(b.ArchiveDirectory()) {
+		return false
+	}
+	return action(a.ActionOnFail) != "archive" || absDir(a.FailDirectory()) == absDir(b.FailDirectory())
+}
+
+// RelativePath returns file's path relative to the source directory, "/"
+// separated.
+
+func (e ConfigEntry) RelativePath(file string) string {
+	rel, err := filepath.Rel(e.SourceDirectory, file)
+	if err != nil {
+		return filepath.Base(file)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// RelativeDir returns the directory a file is in relative to the source
+// directory, with forward slashes, for recreating it under remotepath. It is ""
+// for files directly in the source directory, and always "" unless the
+// transfer is recursive.
+
+func (e ConfigEntry) RelativeDir(file string) string {
+	if !e.Recursive {
+		return ""
+	}
+	rel, err := filepath.Rel(e.SourceDirectory, filepath.Dir(file))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// TempUpload reports whether files are uploaded under a temporary name and then
+// renamed into place.
+
+func (e ConfigEntry) TempUpload() bool {
+	return strings.ToLower(strings.TrimSpace(e.UploadMode)) == "temp"
+}
+
+// ConflictPolicy returns the transfer's on_conflict setting, normalised to lower
+// case. It defaults to "overwrite", which is what uploads have always done.
+
+func (e ConfigEntry) ConflictPolicy() string {
+	if p := strings.ToLower(strings.TrimSpace(e.OnConflict)); p != "" {
+		return p
+	}
+	return "overwrite"
+}
+
+// Type returns the transfer's transfertype, normalised to lower case.
+
+func (e ConfigEntry) Type() string {
+	return strings.ToLower(strings.TrimSpace(e.TransferType))
+}
+
+// VerifyMode returns the transfer's verify setting, normalised to lower case.
+// It defaults to "none".
+
+func (e ConfigEntry) VerifyMode() string {
+	if v := strings.ToLower(strings.TrimSpace(e.Verify)); v != "" {
+		return v
+	}
+	return "none"
+}
+
+// KeyPassphrase returns the passphrase for the transfer's private key, from
+// whichever of privatekey_passphrase, privatekey_passphrase_env or
+// privatekey_passphrase_file is set. It returns "" if none are.
+
+func (e ConfigEntry) KeyPassphrase() (string, error) {
+	switch {
+	case e.PrivateKeyPassphrase != "":
+		return e.PrivateKeyPassphrase, nil
+
+	case strings.TrimSpace(e.PrivateKeyPassphraseEnv) != "":
+		value, ok := os.LookupEnv(strings.TrimSpace(e.PrivateKeyPassphraseEnv))
+		if !ok || value == "" {
+			return "", fmt.Errorf("passphrase environment variable %q is not set", e.PrivateKeyPassphraseEnv)
+		}
+		return value, nil
+
+	case strings.TrimSpace(e.PrivateKeyPassphraseFile) != "":
+		data, err := os.ReadFile(e.PrivateKeyPassphraseFile)
+		if err != nil {
+			return "", fmt.Errorf("unable to read passphrase file: %w", err)
+		}
+		// Editors like to leave a trailing newline.
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	return "", nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 
@@ -113,3 +114,233 @@ transfers:
 		t.Errorf("Unexpected Streaming default value: %v", *cfg.Transfers[0].Streaming)
 	}
 }
+
+func TestLoadConfig_DefaultDataDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	tmpFile := filepath.Join(tmpDir, "config.yaml")
+	if err := os.WriteFile(tmpFile, []byte("transfers: []\n"), 0644); err != nil {
+		t.Fatalf("failed to write temp config file: %v", err)
+	}
+
+	cfg, err := LoadConfig(tmpFile)
+	if err != nil {
+		t.Fatalf("LoadConfig returned an error: %v", err)
+	}
+	want := "/var/lib/tfagent"
+	if runtime.GOOS == "windows" {
+		want = filepath.Join(os.Getenv("ProgramData"), "TFAgent", "data")
+	}
+	if cfg.DataDir != want {
+		t.Errorf("Expected DataDir to default to %s, got %s", want, cfg.DataDir)
+	}
+}
+
+func TestLoadConfig_TOFUKnownHostsInDataDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	tmpFile := filepath.Join(tmpDir, "config.yaml")
+	yaml := `
+data_dir: ` + filepath.Join(tmpDir, "data") + `
+transfers:
+  - name: tofu
+    transfertype: sftp
+    host_key_check: tofu
+  - name: unset
+    transfertype: sftp
+  - name: pinned
+    transfertype: sftp
+    host_key_fingerprint: SHA256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU
+`
+	if err := os.WriteFile(tmpFile, []byte(yaml), 0644); err != nil {
+		t.Fatalf("failed to write temp config file: %v", err)
+	}
+
+	cfg, err := LoadConfig(tmpFile)
+	if err != nil {
+		t.Fatalf("LoadConfig returned an error: %v", err)
+	}
+	tofu := cfg.Transfers[0]
+	if want := filepath.Join(tmpDir, "data", "known_hosts"); tofu.KnownHosts != want {
+		t.Errorf("Expected known_hosts to default to %s, got %s", want, tofu.KnownHosts)
+	}
+	if mode := tofu.HostKeyMode(); mode != "tofu" {
+		t.Errorf("Expected host key mode tofu, got %s", mode)
+	}
+	if unset := cfg.Transfers[1]; unset.KnownHosts != "" || unset.HostKeyMode() != "" {
+		t.Errorf("Expected no host key check for the unset transfer, got known_hosts %q mode %q", unset.KnownHosts, unset.HostKeyMode())
+	}
+	if pinned := cfg.Transfers[2]; pinned.KnownHosts != "" || pinned.HostKeyMode() != "fingerprint" {
+		t.Errorf("Expected the pinned transfer left alone, got known_hosts %q mode %s", pinned.KnownHosts, pinned.HostKeyMode())
+	}
+}
+
+func TestLoadConfig_ExcludedDirs(t *testing.T) {
+	tmpDir := t.TempDir()
+	tmpFile := filepath.Join(tmpDir, "config.yaml")
+	outgoing := filepath.Join(tmpDir, "outgoing")
+	reports := filepath.Join(outgoing, "reports")
+	yaml := `
+data_dir: ` + filepath.Join(tmpDir, "data") + `
+transfers:
+  - name: all
+    source_directory: ` + outgoing + `
+    recursive: true
+  - name: reports
+    source_directory: ` + reports + `
+    archive_dest: sent
+    fail_dest: ` + filepath.Join(tmpDir, "failed") + `
+`
+	if err := os.WriteFile(tmpFile, []byte(yaml), 0644); err != nil {
+		t.Fatalf("failed to write temp config file: %v", err)
+	}
+
+	cfg, err := LoadConfig(tmpFile)
+	if err != nil {
+		t.Fatalf("LoadConfig returned an error: %v", err)
+	}
+	if got, want := cfg.Transfers[1].ArchiveDirectory(), filepath.Join(reports, "sent"); got != want {
+		t.Errorf("Expected a relative archive_dest under the source directory %s, got %s", want, got)
+	}
+
+	// The recursive transfer must skip the other transfer's archive directory,
+	// which is inside its tree.
+	want := []string{
+		filepath.Join(outgoing, "archive"),
+		filepath.Join(outgoing, "fail"),
+		filepath.Join(reports, "sent"),
+		filepath.Join(tmpDir, "failed"),
+	}
+	for _, tr := range cfg.Transfers {
+		if got := tr.ExcludedDirs(); strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("%s: expected excluded dirs %v, got %v", tr.Name, want, got)
+		}
+	}
+}
+
+func TestLoadConfig_WarnConflictingActions(t *testing.T) {
+	var logBuf bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logBuf, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	tmpDir := t.TempDir()
+	tmpFile := filepath.Join(tmpDir, "config.yaml")
+	src := filepath.Join(tmpDir, "outgoing")
+	yaml := `
+data_dir: ` + filepath.Join(tmpDir, "data") + `
+transfers:
+  - name: partner
+    source_directory: ` + src + `
+    recursive: true
+    action_on_success: archive
+  - name: backup
+    source_directory: ` + src + `
+    action_on_success: Archive
+  - name: reports
+    source_directory: ` + filepath.Join(src, "reports") + `
+    action_on_success: delete
+  - name: elsewhere
+    source_directory: ` + filepath.Join(tmpDir, "other") + `
+    action_on_success: delete
+`
+	if err := os.WriteFile(tmpFile, []byte(yaml), 0644); err != nil {
+		t.Fatalf("failed to write temp config file: %v", err)
+	}
+	if _, err := LoadConfig(tmpFile); err != nil {
+		t.Fatalf("LoadConfig returned an error: %v", err)
+	}
+
+	var warned []string
+	for _, line := range strings.Split(logBuf.String(), "\n") {
+		if strings.Contains(line, "different actions") {
+			warned = append(warned, line)
+		}
+	}
+	// backup archives like partner does and isn't recursive, so only partner
+	// can pick up the files reports deletes.
+	if len(warned) != 1 || !strings.Contains(warned[0], "first=partner other=reports") {
+		t.Fatalf("expected a warning for partner and reports only, got:\n%s", strings.Join(warned, "\n"))
+	}
+}
+
+func TestKeyPassphrase_Sources(t *testing.T) {
+	tmpDir := t.TempDir()
+	passFile := filepath.Join(tmpDir, "passphrase")
+	if err := os.WriteFile(passFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("failed to write passphrase file: %v", err)
+	}
+	t.Setenv("TFAGENT_TEST_PASSPHRASE", "from-env")
+
+	tests := []struct {
+		name    string
+		entry   ConfigEntry
+		want    string
+		wantErr bool
+	}{
+		{name: "none", entry: ConfigEntry{}, want: ""},
+		{name: "inline", entry: ConfigEntry{PrivateKeyPassphrase: "inline"}, want: "inline"},
+		{name: "env", entry: ConfigEntry{PrivateKeyPassphraseEnv: "TFAGENT_TEST_PASSPHRASE"}, want: "from-env"},
+		{name: "env unset", entry: ConfigEntry{PrivateKeyPassphraseEnv: "TFAGENT_TEST_UNSET"}, wantErr: true},
+		{name: "file", entry: ConfigEntry{PrivateKeyPassphraseFile: passFile}, want: "from-file"},
+		{name: "file missing", entry: ConfigEntry{PrivateKeyPassphraseFile: passFile + ".nope"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.entry.KeyPassphrase()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wantErr=%v, got %v", tt.wantErr, err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected passphrase %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGetConfigFile_Etc(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("ProgramData is used on Windows")
+	}
+	t.Setenv("ProgramData", "")
+
+	got, err := GetConfigFile("TFAgent")
+	if err != nil {
+		t.Fatalf("GetConfigFile: %v", err)
+	}
+	if want := filepath.Join("/etc", "tfagent", "config.yaml"); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestReopenLogFile(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	logPath := filepath.Join(t.TempDir(), "app.log")
+	cfg := &ConfigData{LogFile: logPath, LogLevel: "info"}
+	first, err := SetupLogger(cfg, FlagOptions{LogLevel: "info"})
+	if err != nil {
+		t.Fatalf("SetupLogger: %v", err)
+	}
+	defer first.Close()
+
+	// logrotate moves the file aside, then the agent is told to reopen it.
+	if err := os.Rename(logPath, logPath+".1"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	second, err := ReopenLogFile(cfg)
+	if err != nil {
+		t.Fatalf("ReopenLogFile: %v", err)
+	}
+	defer second.Close()
+	slog.Info("after rotation")
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("expected a new log file: %v", err)
+	}
+	if !strings.Contains(string(data), "after rotation") {
+		t.Fatalf("expected new messages in the new log file, got:\n%s", data)
+	}
+
+	if f, err := ReopenLogFile(&ConfigData{LogToConsole: true}); f != nil || err != nil {
+		t.Fatalf("expected nothing to reopen when logging to the console, got %v, %v", f, err)
+	}
+}
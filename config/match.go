@@ -0,0 +1,204 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// DefaultExcludes are the temporary and partial files left by applications
+// (and by this agent's own uploads) while a file is still being written. They
+// are never sent unless default_excludes is turned off.
+var DefaultExcludes = []string{"*.tmp", "~$*", "*.part"}
+
+// FileMatcher decides which files in a source directory a transfer sends. It
+// is built from filter, include, exclude and default_excludes once when the
+// config is loaded, rather than on every filesystem event.
+
+type FileMatcher struct {
+	filter  *regexp.Regexp // matched against the file name, as it always has been
+	include []matchRule
+	exclude []matchRule
+}
+
+// matchRule is one include or exclude rule. Globs without a "/" are matched
+// against the file name, everything else against the path relative to the
+// source directory.
+
+type matchRule struct {
+	re       *regexp.Regexp
+	fullPath bool
+}
+
+func (r matchRule) match(rel, name string) bool {
+	if r.fullPath {
+		return r.re.MatchString(rel)
+	}
+	return r.re.MatchString(name)
+}
+
+// CompileMatcher builds the FileMatcher for a transfer.
+
+func CompileMatcher(e ConfigEntry) (*FileMatcher, error) {
+	m := &FileMatcher{}
+
+	if strings.TrimSpace(e.Filter) != "" {
+		re, err := regexp.Compile(e.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("filter %q is not a valid regex: %w", e.Filter, err)
+		}
+		m.filter = re
+	}
+
+	for _, p := range e.Include {
+		r, err := compileRule(p)
+		if err != nil {
+			return nil, fmt.Errorf("include %q: %w", p, err)
+		}
+		m.include = append(m.include, r)
+	}
+
+	excludes := e.Exclude
+	if e.UsesDefaultExcludes() {
+		excludes = append(append([]string{}, DefaultExcludes...), excludes...)
+	}
+	for _, p := range excludes {
+		r, err := compileRule(p)
+		if err != nil {
+			return nil, fmt.Errorf("exclude %q: %w", p, err)
+		}
+		m.exclude = append(m.exclude, r)
+	}
+
+	return m, nil
+}
+
+// Match reports whether a file should be sent. rel is its path relative to the
+// source directory. Excludes win over everything; after that the file must
+// match filter (if set) and at least one include rule (if there are any).
+
+func (m *FileMatcher) Match(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	name := path.Base(rel)
+
+	for _, r := range m.exclude {
+		if r.match(rel, name) {
+			return false
+		}
+	}
+
+	if m.filter != nil && !m.filter.MatchString(name) {
+		return false
+	}
+
+	if len(m.include) == 0 {
+		return true
+	}
+	for _, r := range m.include {
+		if r.match(rel, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matcher returns the transfer's compiled FileMatcher. Configs read by
+// LoadConfig have it ready; anything else is compiled on the spot.
+
+func (e ConfigEntry) Matcher() (*FileMatcher, error) {
+	if e.matcher != nil {
+		return e.matcher, nil
+	}
+	return CompileMatcher(e)
+}
+
+// UsesDefaultExcludes reports whether DefaultExcludes apply to the transfer.
+// They do unless default_excludes is set to false.
+
+func (e ConfigEntry) UsesDefaultExcludes() bool {
+	return e.DefaultExcludes == nil || *e.DefaultExcludes
+}
+
+// compileRule compiles an include or exclude rule: "regex:" followed by a
+// regular expression matched against the relative path, or a glob ("glob:" is
+// optional). On Windows globs ignore case, as the filesystem does, and may use
+// "\" between directories.
+
+func compileRule(pattern string) (matchRule, error) {
+	if expr, ok := strings.CutPrefix(pattern, "regex:"); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return matchRule{}, fmt.Errorf("not a valid regex: %w", err)
+		}
+		return matchRule{re: re, fullPath: true}, nil
+	}
+
+	glob := strings.TrimPrefix(pattern, "glob:")
+	if runtime.GOOS == "windows" {
+		glob = strings.ReplaceAll(glob, `\`, "/")
+	}
+	if strings.TrimSpace(glob) == "" {
+		return matchRule{}, fmt.Errorf("empty pattern")
+	}
+	expr, err := globToRegexp(glob)
+	if err != nil {
+		return matchRule{}, err
+	}
+	if runtime.GOOS == "windows" {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return matchRule{}, fmt.Errorf("not a valid glob: %w", err)
+	}
+	return matchRule{re: re, fullPath: strings.Contains(glob, "/")}, nil
+}
+
+// globToRegexp converts a glob to an anchored regular expression. "*" and "?"
+// don't match "/", "**" matches any number of directories, and [...] is a
+// character class ("[!...]" negates it).
+
+func globToRegexp(glob string) (string, error) {
+	var b strings.Builder
+	b.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					// "**/" matches zero or more whole directories.
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated [ in glob")
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteString("$")
+	return b.String(), nil
+}
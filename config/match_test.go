@@ -0,0 +1,95 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileMatcher_Match(t *testing.T) {
+	off := false
+
+	tests := []struct {
+		name  string
+		entry ConfigEntry
+		file  string
+		want  bool
+	}{
+		{name: "no rules", entry: ConfigEntry{}, file: "data.csv", want: true},
+		{name: "default exclude tmp", entry: ConfigEntry{}, file: "data.tmp", want: false},
+		{name: "default exclude office lock", entry: ConfigEntry{}, file: "~$report.xlsx", want: false},
+		{name: "default exclude part in subdir", entry: ConfigEntry{}, file: "a/.data.csv.part", want: false},
+		{name: "default excludes off", entry: ConfigEntry{DefaultExcludes: &off}, file: "data.tmp", want: true},
+		{name: "filter on name", entry: ConfigEntry{Filter: `\.csv$`}, file: "a/data.csv", want: true},
+		{name: "filter no match", entry: ConfigEntry{Filter: `\.csv$`}, file: "data.txt", want: false},
+		{name: "include glob", entry: ConfigEntry{Include: []string{"*.csv", "*.txt"}}, file: "sub/notes.txt", want: true},
+		{name: "include glob no match", entry: ConfigEntry{Include: []string{"*.csv"}}, file: "notes.txt", want: false},
+		{name: "include path glob", entry: ConfigEntry{Include: []string{"2024/*/*.csv"}}, file: "2024/03/data.csv", want: true},
+		{name: "path glob star stays in directory", entry: ConfigEntry{Include: []string{"2024/*.csv"}}, file: "2024/03/data.csv", want: false},
+		{name: "double star", entry: ConfigEntry{Include: []string{"**/orders/*.csv"}}, file: "a/b/orders/1.csv", want: true},
+		{name: "double star at top", entry: ConfigEntry{Include: []string{"**/orders/*.csv"}}, file: "orders/1.csv", want: true},
+		{name: "include regex on path", entry: ConfigEntry{Include: []string{`regex:^site\d+/`}}, file: "site2/data.csv", want: true},
+		{name: "include regex no match", entry: ConfigEntry{Include: []string{`regex:^site\d+/`}}, file: "other/data.csv", want: false},
+		{name: "exclude wins", entry: ConfigEntry{Include: []string{"*.csv"}, Exclude: []string{"draft_*"}}, file: "draft_1.csv", want: false},
+		{name: "exclude path", entry: ConfigEntry{Exclude: []string{"glob:scratch/**"}}, file: "scratch/x/data.csv", want: false},
+		{name: "character class", entry: ConfigEntry{Include: []string{"data_[0-9].csv"}}, file: "data_7.csv", want: true},
+		{name: "negated class", entry: ConfigEntry{Include: []string{"data_[!0-9].csv"}}, file: "data_7.csv", want: false},
+		{name: "question mark", entry: ConfigEntry{Include: []string{"??.csv"}}, file: "ab.csv", want: true},
+		{name: "dots are literal", entry: ConfigEntry{Include: []string{"*.csv"}}, file: "data_csv", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := CompileMatcher(tt.entry)
+			if err != nil {
+				t.Fatalf("CompileMatcher: %v", err)
+			}
+			if got := m.Match(filepath.FromSlash(tt.file)); got != tt.want {
+				t.Fatalf("Match(%q) = %v, want %v", tt.file, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileMatcher_InvalidRules(t *testing.T) {
+	for _, e := range []ConfigEntry{
+		{Filter: "[abc"},
+		{Include: []string{"regex:(unclosed"}},
+		{Exclude: []string{"data[0-9"}},
+		{Include: []string{"glob:"}},
+	} {
+		if _, err := CompileMatcher(e); err == nil {
+			t.Errorf("expected error for %+v", e)
+		}
+	}
+}
+
+func TestLoadConfig_CompilesMatcher(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "config.yaml")
+	content := `
+transfers:
+  - name: "rules"
+    source_directory: "/tmp/source"
+    include: ["*.csv"]
+    exclude: ["regex:^archive/"]
+`
+	if err := os.WriteFile(tmpFile, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write temp config file: %v", err)
+	}
+
+	cfg, err := LoadConfig(tmpFile)
+	if err != nil {
+		t.Fatalf("LoadConfig returned an error: %v", err)
+	}
+	entry := cfg.Transfers[0]
+	if entry.matcher == nil {
+		t.Fatal("expected the matcher to be compiled at load")
+	}
+	m, _ := entry.Matcher()
+	if m != entry.matcher {
+		t.Fatal("expected Matcher to return the compiled matcher")
+	}
+	if !m.Match("data.csv") || m.Match("data.txt") {
+		t.Fatal("compiled matcher doesn't follow the rules")
+	}
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"os"
@@ -8,6 +10,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+
+	"github.com/justin-molloy/tfagent/sshkey"
 )
 
 // ValidateConfig checks the loaded config and returns a single error describing all issues.
@@ -24,6 +28,21 @@ func ValidateConfig(cfg *ConfigData) error {
 	if len(cfg.Transfers) == 0 {
 		errs.addf("no transfers defined")
 	}
+	switch cfg.PartialFailurePolicy() {
+	case "fail", "success", "keep":
+	default:
+		errs.addf("partial_failure %q invalid (allowed: fail, success, keep)", cfg.PartialFailure)
+	}
+	if cfg.ShutdownGracePeriod < 0 {
+		errs.addf("shutdown_grace_period must not be negative")
+	}
+	// The journal, pending deferred retries and tofu host keys are kept in
+	// data_dir, so the agent can't start without it.
+	if strings.TrimSpace(cfg.DataDir) == "" {
+		errs.addf("data_dir is required")
+	} else if !isWritableOrCreatable(cfg.DataDir) {
+		errs.addf("data_dir %q cannot be created or written to; set data_dir to a directory the agent can write to", cfg.DataDir)
+	}
 
 	// ---- per-transfer checks ----
 	seenNames := map[string]struct{}{}
@@ -53,44 +72,62 @@ func ValidateConfig(cfg *ConfigData) error {
 		}
 
 		// TransferType
-		switch strings.ToLower(strings.TrimSpace(t.TransferType)) {
+		switch t.Type() {
 		case "sftp":
-			// Required fields for SFTP
-			if strings.TrimSpace(t.Username) == "" {
-				errs.addf("%s: username is required for SFTP", prefix)
+			validateSSHTransfer(&errs, prefix, "SFTP", t, cfg.DataDir)
+
+			switch strings.ToLower(strings.TrimSpace(t.UploadMode)) {
+			case "", "direct", "temp":
+			default:
+				errs.addf("%s: upload_mode %q invalid (allowed: direct, temp)", prefix, t.UploadMode)
+			}
+			if strings.TrimSpace(t.StagingDir) != "" && !t.TempUpload() {
+				errs.addf("%s: staging_dir is only used with upload_mode temp", prefix)
 			}
-			if strings.TrimSpace(t.Server) == "" {
-				errs.addf("%s: server is required for SFTP", prefix)
+			if !isValidConflictPolicy(t.OnConflict) {
+				errs.addf("%s: on_conflict %q invalid (allowed: overwrite, skip, fail, rename)", prefix, t.OnConflict)
 			}
-			if !isValidPort(t.Port) {
-				errs.addf("%s: port %q must be an integer 1-65535 for SFTP", prefix, t.Port)
+			if !isValidVerifyMode(t.Verify) {
+				errs.addf("%s: verify %q invalid (allowed: none, size, checksum)", prefix, t.Verify)
 			}
+
+		case "local":
+			// For local transfers remotepath is the destination directory (eg. a
+			// mounted share or spool directory). It must already exist.
 			if strings.TrimSpace(t.RemotePath) == "" {
-				errs.addf("%s: remotepath is required for SFTP", prefix)
+				errs.addf("%s: remotepath (destination directory) is required for local", prefix)
+			} else if !isWritableDir(t.RemotePath) {
+				errs.addf("%s: remotepath %q does not exist or is not writable", prefix, t.RemotePath)
 			}
-			// Auth: require at least one of PrivateKey or Password
-			if strings.TrimSpace(t.PrivateKey) == "" && strings.TrimSpace(t.Password) == "" {
-				errs.addf("%s: either privatekey or password must be provided for SFTP", prefix)
+			if !isValidConflictPolicy(t.OnConflict) {
+				errs.addf("%s: on_conflict %q invalid (allowed: overwrite, skip, fail, rename)", prefix, t.OnConflict)
 			}
-			if strings.TrimSpace(t.PrivateKey) != "" && !isFile(t.PrivateKey) {
-				errs.addf("%s: privatekey file %q not found or unreadable", prefix, t.PrivateKey)
+			if !isValidVerifyMode(t.Verify) {
+				errs.addf("%s: verify %q invalid (allowed: none, size, checksum)", prefix, t.Verify)
+			}
+			if t.Resume {
+				errs.addf("%s: resume is only supported for sftp", prefix)
 			}
-
-		case "local":
-			// No remote requirements, but RemotePath can still be used by actions; optional.
-			// (Add local-specific requirements here if you introduce them later.)
 
 		case "scp":
-			// If you implement SCP later, mirror SFTP requirements as appropriate.
-			// For now, treat like SFTP minus the SFTP client specifics:
-			if strings.TrimSpace(t.Username) == "" {
-				errs.addf("%s: username is required for SCP", prefix)
+			validateSSHTransfer(&errs, prefix, "SCP", t, cfg.DataDir)
+			if strings.TrimSpace(t.UploadMode) != "" || strings.TrimSpace(t.StagingDir) != "" {
+				errs.addf("%s: upload_mode and staging_dir are only supported for sftp", prefix)
+			}
+			if t.Resume {
+				errs.addf("%s: resume is only supported for sftp", prefix)
 			}
-			if strings.TrimSpace(t.Server) == "" {
-				errs.addf("%s: server is required for SCP", prefix)
+			if t.ConflictPolicy() != "overwrite" {
+				// scp has no way to look at the destination before writing to it.
+				errs.addf("%s: on_conflict %q is not supported for scp (always overwrites)", prefix, t.OnConflict)
 			}
-			if !isValidPort(t.Port) {
-				errs.addf("%s: port %q must be an integer 1-65535 for SCP", prefix, t.Port)
+			if t.VerifyMode() != "none" {
+				errs.addf("%s: verify %q is not supported for scp", prefix, t.Verify)
+			}
+			if strings.TrimSpace(t.FileMode) != "" {
+				if _, err := ParseFileMode(t.FileMode); err != nil {
+					errs.addf("%s: %v", prefix, err)
+				}
 			}
 
 		default:
@@ -101,6 +138,34 @@ func ValidateConfig(cfg *ConfigData) error {
 			}
 		}
 
+		switch strings.ToLower(strings.TrimSpace(t.WatchMode)) {
+		case "", "fsnotify", "poll", "hybrid":
+		default:
+			errs.addf("%s: watch_mode %q invalid (allowed: fsnotify, poll, hybrid)", prefix, t.WatchMode)
+		}
+		if t.PollInterval < 0 {
+			errs.addf("%s: poll_interval must not be negative", prefix)
+		} else if t.PollInterval > 0 && !t.UsesPolling() {
+			errs.addf("%s: poll_interval is only used with watch_mode poll or hybrid", prefix)
+		}
+
+		if t.SettleDelay < 0 {
+			errs.addf("%s: settle_delay must not be negative", prefix)
+		}
+		if t.StablePolls < 0 {
+			errs.addf("%s: stable_polls must not be negative", prefix)
+		}
+
+		if t.ScanMaxAge < 0 {
+			errs.addf("%s: scan_max_age must not be negative", prefix)
+		} else if t.ScanMaxAge > 0 && !t.ScanOnStart {
+			errs.addf("%s: scan_max_age is only used with scan_on_start", prefix)
+		}
+
+		if t.DeferredRetry.Enabled {
+			validateDeferredRetry(&errs, prefix, t.DeferredRetry)
+		}
+
 		// Filter regex (if present)
 		if strings.TrimSpace(t.Filter) != "" {
 			if _, err := regexp.Compile(t.Filter); err != nil {
@@ -108,6 +173,18 @@ func ValidateConfig(cfg *ConfigData) error {
 			}
 		}
 
+		// Include/exclude rules
+		for _, p := range t.Include {
+			if _, err := compileRule(p); err != nil {
+				errs.addf("%s: include %q: %v", prefix, p, err)
+			}
+		}
+		for _, p := range t.Exclude {
+			if _, err := compileRule(p); err != nil {
+				errs.addf("%s: exclude %q: %v", prefix, p, err)
+			}
+		}
+
 		// Success/Fail actions
 		if !isValidAction(t.ActionOnSuccess) {
 			errs.addf("%s: action_on_success %q invalid (allowed: none, archive, delete)", prefix, t.ActionOnSuccess)
@@ -117,10 +194,10 @@ func ValidateConfig(cfg *ConfigData) error {
 		}
 
 		// Archive/fail destinations if needed
-		if isArchive(t.ActionOnSuccess) && strings.TrimSpace(t.ArchiveDest) != "" && !isDirOrCreatable(t.ArchiveDest) {
+		if isArchive(t.ActionOnSuccess) && strings.TrimSpace(t.ArchiveDest) != "" && !isDirOrCreatable(t.ArchiveDirectory()) {
 			errs.addf("%s: archive_dest %q does not exist and cannot be created", prefix, t.ArchiveDest)
 		}
-		if isArchive(t.ActionOnFail) && strings.TrimSpace(t.FailDest) != "" && !isDirOrCreatable(t.FailDest) {
+		if isArchive(t.ActionOnFail) && strings.TrimSpace(t.FailDest) != "" && !isDirOrCreatable(t.FailDirectory()) {
 			errs.addf("%s: fail_dest %q does not exist and cannot be created", prefix, t.FailDest)
 		}
 	}
@@ -131,6 +208,98 @@ func ValidateConfig(cfg *ConfigData) error {
 	return nil
 }
 
+// validateSSHTransfer checks the settings shared by the SSH based transfer types.
+func validateSSHTransfer(errs *multiErr, prefix string, proto string, t *ConfigEntry, dataDir string) {
+	if strings.TrimSpace(t.Username) == "" {
+		errs.addf("%s: username is required for %s", prefix, proto)
+	}
+	if strings.TrimSpace(t.Server) == "" {
+		errs.addf("%s: server is required for %s", prefix, proto)
+	}
+	if !isValidPort(t.Port) {
+		errs.addf("%s: port %q must be an integer 1-65535 for %s", prefix, t.Port, proto)
+	}
+	if strings.TrimSpace(t.RemotePath) == "" {
+		errs.addf("%s: remotepath is required for %s", prefix, proto)
+	}
+	// Auth: require at least one of PrivateKey or Password
+	if strings.TrimSpace(t.PrivateKey) == "" && strings.TrimSpace(t.Password) == "" {
+		errs.addf("%s: either privatekey or password must be provided for %s", prefix, proto)
+	}
+	if strings.TrimSpace(t.PrivateKey) != "" && !isFile(t.PrivateKey) {
+		errs.addf("%s: privatekey file %q not found or unreadable", prefix, t.PrivateKey)
+	} else if strings.TrimSpace(t.PrivateKey) != "" {
+		validatePrivateKey(errs, prefix, t)
+	}
+	if strings.TrimSpace(t.Certificate) != "" && strings.TrimSpace(t.PrivateKey) == "" {
+		errs.addf("%s: certificate requires privatekey", prefix)
+	}
+
+	if t.IdleTimeout < 0 {
+		errs.addf("%s: idle_timeout must not be negative", prefix)
+	}
+	if t.KeepaliveInterval < 0 {
+		errs.addf("%s: keepalive_interval must not be negative", prefix)
+	}
+
+	validateRetry(errs, prefix, t.Retry)
+
+	// Host key verification
+	switch t.HostKeyMode() {
+	case "fingerprint":
+		if !isValidFingerprint(t.HostKeyFingerprint) {
+			errs.addf("%s: host_key_fingerprint %q must be a SHA256 fingerprint (SHA256:...)", prefix, t.HostKeyFingerprint)
+		}
+	case "known_hosts":
+		if !isFile(t.KnownHosts) {
+			errs.addf("%s: known_hosts file %q not found or unreadable", prefix, t.KnownHosts)
+		}
+	case "tofu":
+		// Keys seen for the first time are recorded in an agent managed file,
+		// which LoadConfig puts in the data directory if none is given.
+		knownHosts := t.KnownHosts
+		if strings.TrimSpace(knownHosts) == "" {
+			if strings.TrimSpace(dataDir) == "" {
+				errs.addf("%s: data_dir or known_hosts is required for host_key_check tofu", prefix)
+				break
+			}
+			knownHosts = filepath.Join(dataDir, "known_hosts")
+		}
+		if !isFile(knownHosts) && !isDirOrCreatable(filepath.Dir(knownHosts)) {
+			errs.addf("%s: known_hosts file %q cannot be created", prefix, knownHosts)
+		}
+	case "":
+		errs.addf("%s: no host key verification configured; set host_key_fingerprint or known_hosts, or host_key_check: tofu to trust the key seen on first connect", prefix)
+	default:
+		errs.addf("%s: host_key_check %q invalid (allowed: known_hosts, fingerprint, tofu)", prefix, t.HostKeyCheck)
+	}
+}
+
+// validatePrivateKey loads the private key (and certificate, if any) so that a
+// wrong passphrase or mismatched certificate is reported at startup rather than
+// on the first transfer.
+func validatePrivateKey(errs *multiErr, prefix string, t *ConfigEntry) {
+	sources := 0
+	for _, v := range []string{t.PrivateKeyPassphrase, t.PrivateKeyPassphraseEnv, t.PrivateKeyPassphraseFile} {
+		if strings.TrimSpace(v) != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		errs.addf("%s: only one of privatekey_passphrase, privatekey_passphrase_env or privatekey_passphrase_file may be set", prefix)
+		return
+	}
+
+	passphrase, err := t.KeyPassphrase()
+	if err != nil {
+		errs.addf("%s: %v", prefix, err)
+		return
+	}
+	if _, err := sshkey.LoadSigner(t.PrivateKey, passphrase, t.Certificate); err != nil {
+		errs.addf("%s: privatekey %q: %v", prefix, t.PrivateKey, err)
+	}
+}
+
 // ---- helpers ----
 
 type multiErr struct {
@@ -173,10 +342,77 @@ func isValidAction(a string) bool {
 		return false
 	}
 }
+
+// validateRetry checks a transfer's retry policy. Zero values are fine - they
+// mean the default.
+
+func validateRetry(errs *multiErr, prefix string, r RetryConfig) {
+	if r.Attempts < 0 {
+		errs.addf("%s: retry.attempts must not be negative", prefix)
+	}
+	if r.InitialDelay < 0 || r.MaxDelay < 0 {
+		errs.addf("%s: retry delays must not be negative", prefix)
+	}
+	if r.MaxDelay > 0 && r.MaxDelay < r.InitialDelay {
+		errs.addf("%s: retry.max_delay (%s) is less than retry.initial_delay (%s)", prefix, r.MaxDelay, r.InitialDelay)
+	}
+	if r.Multiplier != 0 && r.Multiplier < 1 {
+		errs.addf("%s: retry.multiplier must be at least 1", prefix)
+	}
+	if r.Jitter != nil && (*r.Jitter < 0 || *r.Jitter > 1) {
+		errs.addf("%s: retry.jitter must be between 0 and 1", prefix)
+	}
+}
+
+// validateDeferredRetry checks the deferred retry settings.
+
+func validateDeferredRetry(errs *multiErr, prefix string, d DeferredRetryConfig) {
+	for _, step := range d.Schedule {
+		if step <= 0 {
+			errs.addf("%s: deferred_retry.schedule steps must be positive, got %s", prefix, step)
+			break
+		}
+	}
+	if d.MaxAttempts < 0 {
+		errs.addf("%s: deferred_retry.max_attempts must not be negative", prefix)
+	}
+	if d.MaxAge < 0 {
+		errs.addf("%s: deferred_retry.max_age must not be negative", prefix)
+	}
+}
+
+func isValidConflictPolicy(p string) bool {
+	switch strings.ToLower(strings.TrimSpace(p)) {
+	case "", "overwrite", "skip", "fail", "rename":
+		return true
+	default:
+		return false
+	}
+}
+
+func isValidVerifyMode(v string) bool {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "", "none", "size", "checksum":
+		return true
+	default:
+		return false
+	}
+}
+
 func isArchive(a string) bool {
 	return strings.ToLower(strings.TrimSpace(a)) == "archive"
 }
 
+// isValidFingerprint checks for an OpenSSH style SHA256 key fingerprint.
+func isValidFingerprint(fp string) bool {
+	b64, ok := strings.CutPrefix(strings.TrimSpace(fp), "SHA256:")
+	if !ok {
+		return false
+	}
+	sum, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(b64, "="))
+	return err == nil && len(sum) == sha256.Size
+}
+
 func isDir(p string) bool {
 	info, err := os.Stat(p)
 	return err == nil && info.IsDir()
@@ -192,12 +428,32 @@ func isDirOrCreatable(p string) bool {
 	if isDir(p) {
 		return true
 	}
-	parent := filepath.Dir(p)
-	if !isDir(parent) {
+	// Check writability of parent (without creating directory p).
+	return isWritableDir(filepath.Dir(p))
+}
+
+// isWritableOrCreatable returns true if p is a directory we can create files in,
+// or one that MkdirAll could create.
+func isWritableOrCreatable(p string) bool {
+	for {
+		if _, err := os.Stat(p); err == nil {
+			return isWritableDir(p)
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return false
+		}
+		p = parent
+	}
+}
+
+// isWritableDir returns true if p is an existing directory that we can create files in.
+func isWritableDir(p string) bool {
+	if !isDir(p) {
 		return false
 	}
-	// Check writability of parent by trying to open a file there (without creating directory p).
-	f, err := os.CreateTemp(parent, ".permcheck-*")
+	// Check writability by trying to open a file there.
+	f, err := os.CreateTemp(p, ".permcheck-*")
 	if err != nil {
 		return false
 	}
@@ -0,0 +1,622 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// validTransfer returns a transfer that passes validation, for tests to modify.
+func validTransfer(t *testing.T) ConfigEntry {
+	t.Helper()
+	return ConfigEntry{
+		Name:            "t1",
+		SourceDirectory: t.TempDir(),
+		TransferType:    "local",
+		RemotePath:      t.TempDir(),
+	}
+}
+
+func TestValidateConfig_Valid(t *testing.T) {
+	cfg := &ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{validTransfer(t)}}
+	if err := ValidateConfig(cfg); err != nil {
+		t.Fatalf("expected valid config, got: %v", err)
+	}
+}
+
+func TestValidateConfig_NoTransfers(t *testing.T) {
+	err := ValidateConfig(&ConfigData{})
+	if err == nil || !strings.Contains(err.Error(), "no transfers defined") {
+		t.Fatalf("expected 'no transfers defined', got: %v", err)
+	}
+}
+
+func TestValidateConfig_Local(t *testing.T) {
+	tests := []struct {
+		name       string
+		remotePath func(t *testing.T) string
+		wantErr    string
+	}{
+		{
+			name:       "destination missing",
+			remotePath: func(t *testing.T) string { return "" },
+			wantErr:    "remotepath (destination directory) is required for local",
+		},
+		{
+			name:       "destination does not exist",
+			remotePath: func(t *testing.T) string { return filepath.Join(t.TempDir(), "nope") },
+			wantErr:    "does not exist or is not writable",
+		},
+		{
+			name:       "destination exists",
+			remotePath: func(t *testing.T) string { return t.TempDir() },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tf := validTransfer(t)
+			tf.RemotePath = tt.remotePath(t)
+
+			err := ValidateConfig(&ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{tf}})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("did not expect error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateConfig_SCP(t *testing.T) {
+	tf := validTransfer(t)
+	tf.TransferType = "scp"
+	tf.Username = "user"
+	tf.Server = "example.com"
+	tf.Port = "22"
+	tf.Password = "secret"
+	tf.HostKeyCheck = "tofu"
+	tf.RemotePath = "/incoming"
+	tf.FileMode = "0640"
+
+	if err := ValidateConfig(&ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{tf}}); err != nil {
+		t.Fatalf("expected valid scp config, got: %v", err)
+	}
+
+	tf.FileMode = "0999"
+	tf.RemotePath = ""
+	err := ValidateConfig(&ConfigData{Transfers: []ConfigEntry{tf}})
+	if err == nil {
+		t.Fatalf("expected validation errors")
+	}
+	for _, want := range []string{"invalid file mode", "remotepath is required for SCP"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error containing %q, got: %v", want, err)
+		}
+	}
+}
+
+func sftpTransfer(t *testing.T) ConfigEntry {
+	t.Helper()
+	tf := validTransfer(t)
+	tf.TransferType = "sftp"
+	tf.Username = "user"
+	tf.Server = "example.com"
+	tf.Port = "22"
+	tf.Password = "secret"
+	tf.RemotePath = "/incoming"
+	tf.HostKeyCheck = "tofu"
+	return tf
+}
+
+func TestValidateConfig_HostKey(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(knownHosts, nil, 0o600); err != nil {
+		t.Fatalf("write known_hosts: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(tf *ConfigEntry)
+		wantErr string
+	}{
+		{name: "not configured", modify: func(tf *ConfigEntry) {}, wantErr: "no host key verification configured"},
+		{name: "tofu", modify: func(tf *ConfigEntry) { tf.HostKeyCheck = "tofu" }},
+		{name: "known_hosts file", modify: func(tf *ConfigEntry) { tf.KnownHosts = knownHosts }},
+		{
+			name:    "known_hosts file missing",
+			modify:  func(tf *ConfigEntry) { tf.KnownHosts = knownHosts + ".missing" },
+			wantErr: "known_hosts file",
+		},
+		{
+			name: "fingerprint",
+			modify: func(tf *ConfigEntry) {
+				tf.HostKeyFingerprint = "SHA256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU"
+			},
+		},
+		{
+			name:    "fingerprint malformed",
+			modify:  func(tf *ConfigEntry) { tf.HostKeyFingerprint = "MD5:aa:bb" },
+			wantErr: "must be a SHA256 fingerprint",
+		},
+		{
+			name:    "unknown mode",
+			modify:  func(tf *ConfigEntry) { tf.HostKeyCheck = "insecure" },
+			wantErr: `host_key_check "insecure" invalid`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tf := sftpTransfer(t)
+			tf.HostKeyCheck = ""
+			tt.modify(&tf)
+
+			err := ValidateConfig(&ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{tf}})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("did not expect error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateConfig_DoesNotDefaultKnownHosts(t *testing.T) {
+	cfg := &ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{sftpTransfer(t)}}
+
+	if err := ValidateConfig(cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.Transfers[0].KnownHosts; got != "" {
+		t.Fatalf("expected the validator to leave known_hosts alone, got %q", got)
+	}
+}
+
+func TestValidateConfig_EncryptedPrivateKey(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	blk, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("right"))
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(blk), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(tf *ConfigEntry)
+		wantErr string
+	}{
+		{name: "correct passphrase", modify: func(tf *ConfigEntry) { tf.PrivateKeyPassphrase = "right" }},
+		{name: "no passphrase", modify: func(tf *ConfigEntry) {}, wantErr: "no passphrase is configured"},
+		{
+			name:    "wrong passphrase",
+			modify:  func(tf *ConfigEntry) { tf.PrivateKeyPassphrase = "wrong" },
+			wantErr: "unable to decrypt private key",
+		},
+		{
+			name: "two passphrase sources",
+			modify: func(tf *ConfigEntry) {
+				tf.PrivateKeyPassphrase = "right"
+				tf.PrivateKeyPassphraseEnv = "SOMETHING"
+			},
+			wantErr: "only one of",
+		},
+		{
+			name:    "certificate not found",
+			modify:  func(tf *ConfigEntry) { tf.PrivateKeyPassphrase = "right"; tf.Certificate = keyPath + "-cert.pub" },
+			wantErr: "unable to read certificate",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tf := sftpTransfer(t)
+			tf.Password = ""
+			tf.PrivateKey = keyPath
+			tt.modify(&tf)
+
+			err := ValidateConfig(&ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{tf}})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("did not expect error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateConfig_UploadMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(tf *ConfigEntry)
+		wantErr string
+	}{
+		{name: "direct", modify: func(tf *ConfigEntry) { tf.UploadMode = "direct" }},
+		{name: "temp", modify: func(tf *ConfigEntry) { tf.UploadMode = "temp" }},
+		{name: "temp with staging dir", modify: func(tf *ConfigEntry) {
+			tf.UploadMode = "temp"
+			tf.StagingDir = "/incoming/.staging"
+		}},
+		{
+			name:    "unknown mode",
+			modify:  func(tf *ConfigEntry) { tf.UploadMode = "atomic" },
+			wantErr: `upload_mode "atomic" invalid`,
+		},
+		{
+			name:    "staging dir without temp",
+			modify:  func(tf *ConfigEntry) { tf.StagingDir = "/incoming/.staging" },
+			wantErr: "staging_dir is only used with upload_mode temp",
+		},
+		{
+			name: "scp",
+			modify: func(tf *ConfigEntry) {
+				tf.TransferType = "scp"
+				tf.UploadMode = "temp"
+			},
+			wantErr: "only supported for sftp",
+		},
+		{name: "resume", modify: func(tf *ConfigEntry) {
+			tf.UploadMode = "temp"
+			tf.Resume = true
+		}},
+		{
+			name: "resume with scp",
+			modify: func(tf *ConfigEntry) {
+				tf.TransferType = "scp"
+				tf.Resume = true
+			},
+			wantErr: "resume is only supported for sftp",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tf := sftpTransfer(t)
+			tt.modify(&tf)
+
+			err := ValidateConfig(&ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{tf}})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("did not expect error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateConfig_OnConflict(t *testing.T) {
+	for _, policy := range []string{"", "overwrite", "skip", "fail", "rename", "Rename"} {
+		tf := sftpTransfer(t)
+		tf.OnConflict = policy
+		if err := ValidateConfig(&ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{tf}}); err != nil {
+			t.Errorf("on_conflict %q: unexpected error: %v", policy, err)
+		}
+	}
+
+	tf := sftpTransfer(t)
+	tf.OnConflict = "append"
+	err := ValidateConfig(&ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{tf}})
+	if err == nil || !strings.Contains(err.Error(), `on_conflict "append" invalid`) {
+		t.Fatalf("expected invalid on_conflict error, got: %v", err)
+	}
+
+	tf = sftpTransfer(t)
+	tf.TransferType = "scp"
+	tf.OnConflict = "skip"
+	err = ValidateConfig(&ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{tf}})
+	if err == nil || !strings.Contains(err.Error(), "not supported for scp") {
+		t.Fatalf("expected scp on_conflict error, got: %v", err)
+	}
+}
+
+func TestValidateConfig_Verify(t *testing.T) {
+	for _, mode := range []string{"", "none", "size", "checksum"} {
+		tf := sftpTransfer(t)
+		tf.Verify = mode
+		if err := ValidateConfig(&ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{tf}}); err != nil {
+			t.Errorf("verify %q: unexpected error: %v", mode, err)
+		}
+	}
+
+	tf := sftpTransfer(t)
+	tf.Verify = "md5"
+	err := ValidateConfig(&ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{tf}})
+	if err == nil || !strings.Contains(err.Error(), `verify "md5" invalid`) {
+		t.Fatalf("expected invalid verify error, got: %v", err)
+	}
+
+	tf = sftpTransfer(t)
+	tf.TransferType = "scp"
+	tf.Verify = "size"
+	err = ValidateConfig(&ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{tf}})
+	if err == nil || !strings.Contains(err.Error(), `verify "size" is not supported for scp`) {
+		t.Fatalf("expected scp verify error, got: %v", err)
+	}
+}
+
+func TestValidateConfig_Retry(t *testing.T) {
+	tests := []struct {
+		name    string
+		retry   RetryConfig
+		wantErr string
+	}{
+		{name: "defaults", retry: RetryConfig{}},
+		{name: "full", retry: RetryConfig{Attempts: 5, InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: 1.5, Jitter: ptr(0.2)}},
+		{name: "no jitter", retry: RetryConfig{Jitter: ptr(0.0)}},
+		{name: "negative attempts", retry: RetryConfig{Attempts: -1}, wantErr: "retry.attempts must not be negative"},
+		{name: "max below initial", retry: RetryConfig{InitialDelay: time.Minute, MaxDelay: time.Second}, wantErr: "less than retry.initial_delay"},
+		{name: "shrinking", retry: RetryConfig{Multiplier: 0.5}, wantErr: "retry.multiplier must be at least 1"},
+		{name: "jitter", retry: RetryConfig{Jitter: ptr(2.0)}, wantErr: "retry.jitter must be between 0 and 1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tf := sftpTransfer(t)
+			tf.Retry = tt.retry
+
+			err := ValidateConfig(&ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{tf}})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("did not expect error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestRetryConfig_WithDefaults(t *testing.T) {
+	got := RetryConfig{}.WithDefaults()
+	want := RetryConfig{
+		Attempts:     DefaultRetryAttempts,
+		InitialDelay: DefaultRetryInitialDelay,
+		MaxDelay:     DefaultRetryMaxDelay,
+		Multiplier:   DefaultRetryMultiplier,
+		Jitter:       ptr(DefaultRetryJitter),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	// jitter: 0 turns jitter off rather than meaning the default.
+	if got := (RetryConfig{Jitter: ptr(0.0)}).WithDefaults(); *got.Jitter != 0 {
+		t.Fatalf("expected jitter left off, got %v", *got.Jitter)
+	}
+
+	// A long initial delay mustn't be cut short by the default max_delay.
+	if got := (RetryConfig{InitialDelay: 5 * time.Minute}).WithDefaults(); got.MaxDelay != 5*time.Minute {
+		t.Fatalf("expected max_delay raised to initial_delay, got %v", got.MaxDelay)
+	}
+}
+
+func TestValidateConfig_DeferredRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		dataDir string
+		retry   DeferredRetryConfig
+		wantErr string
+	}{
+		{name: "defaults", retry: DeferredRetryConfig{Enabled: true}},
+		{name: "disabled ignores settings", retry: DeferredRetryConfig{MaxAttempts: -1}},
+		{name: "bad step", retry: DeferredRetryConfig{Enabled: true, Schedule: []time.Duration{time.Minute, 0}}, wantErr: "schedule steps must be positive"},
+		{name: "negative age", retry: DeferredRetryConfig{Enabled: true, MaxAge: -time.Hour}, wantErr: "max_age must not be negative"},
+		{name: "no data dir", dataDir: "-", retry: DeferredRetryConfig{Enabled: true}, wantErr: "data_dir is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tf := sftpTransfer(t)
+			tf.KnownHosts = filepath.Join(t.TempDir(), "known_hosts")
+			tf.HostKeyCheck = "tofu"
+			tf.DeferredRetry = tt.retry
+
+			dataDir := t.TempDir()
+			if tt.dataDir == "-" {
+				dataDir = ""
+			}
+			err := ValidateConfig(&ConfigData{DataDir: dataDir, Transfers: []ConfigEntry{tf}})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("did not expect error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestDeferredRetryConfig_Delay(t *testing.T) {
+	d := DeferredRetryConfig{Schedule: []time.Duration{time.Minute, time.Hour}}
+	for n, want := range map[int]time.Duration{1: time.Minute, 2: time.Hour, 5: time.Hour} {
+		if got := d.Delay(n); got != want {
+			t.Errorf("Delay(%d) = %v, want %v", n, got, want)
+		}
+	}
+	if got := (DeferredRetryConfig{}).WithDefaults(); got.MaxAttempts != len(DefaultDeferredRetrySchedule) || got.MaxAge != DefaultDeferredRetryMaxAge {
+		t.Errorf("unexpected defaults: %+v", got)
+	}
+}
+
+func TestValidateConfig_ScanMaxAge(t *testing.T) {
+	tf := sftpTransfer(t)
+	tf.ScanMaxAge = time.Hour
+	err := ValidateConfig(&ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{tf}})
+	if err == nil || !strings.Contains(err.Error(), "scan_max_age is only used with scan_on_start") {
+		t.Fatalf("expected scan_max_age error, got: %v", err)
+	}
+
+	tf.ScanOnStart = true
+	if err := ValidateConfig(&ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{tf}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateConfig_WatchMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(tf *ConfigEntry)
+		wantErr string
+	}{
+		{name: "default", modify: func(tf *ConfigEntry) {}},
+		{name: "poll", modify: func(tf *ConfigEntry) { tf.WatchMode = "poll" }},
+		{name: "hybrid with interval", modify: func(tf *ConfigEntry) {
+			tf.WatchMode = "hybrid"
+			tf.PollInterval = 5 * time.Minute
+		}},
+		{name: "unknown", modify: func(tf *ConfigEntry) { tf.WatchMode = "inotify" }, wantErr: `watch_mode "inotify" invalid`},
+		{name: "interval without polling", modify: func(tf *ConfigEntry) { tf.PollInterval = time.Second }, wantErr: "poll_interval is only used"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tf := sftpTransfer(t)
+			tt.modify(&tf)
+
+			err := ValidateConfig(&ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{tf}})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("did not expect error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestPollingInterval(t *testing.T) {
+	if got := (ConfigEntry{WatchMode: "poll"}).PollingInterval(); got != DefaultPollInterval {
+		t.Errorf("poll default: got %v", got)
+	}
+	if got := (ConfigEntry{WatchMode: "hybrid"}).PollingInterval(); got != DefaultHybridPollInterval {
+		t.Errorf("hybrid default: got %v", got)
+	}
+	if got := (ConfigEntry{WatchMode: "poll", PollInterval: time.Second}).PollingInterval(); got != time.Second {
+		t.Errorf("configured: got %v", got)
+	}
+}
+
+func TestSettle(t *testing.T) {
+	if delay, polls := (ConfigEntry{}).Settle(); delay != DefaultSettleDelay || polls != 0 {
+		t.Errorf("defaults: got %v, %d", delay, polls)
+	}
+	if delay, polls := (ConfigEntry{SettleDelay: 30 * time.Second, StablePolls: 3}).Settle(); delay != 30*time.Second || polls != 3 {
+		t.Errorf("configured: got %v, %d", delay, polls)
+	}
+
+	tf := sftpTransfer(t)
+	tf.SettleDelay = -time.Second
+	tf.StablePolls = -1
+	err := ValidateConfig(&ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{tf}})
+	if err == nil {
+		t.Fatal("expected errors for negative settle settings")
+	}
+	for _, want := range []string{"settle_delay must not be negative", "stable_polls must not be negative"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+}
+
+func TestRelativeDir(t *testing.T) {
+	src := filepath.Join("data", "in")
+	e := ConfigEntry{SourceDirectory: src, Recursive: true}
+
+	if got := e.RelativeDir(filepath.Join(src, "a", "b", "f.csv")); got != "a/b" {
+		t.Errorf("nested: got %q", got)
+	}
+	if got := e.RelativeDir(filepath.Join(src, "f.csv")); got != "" {
+		t.Errorf("top level: got %q", got)
+	}
+	if got := e.RelativeDir(filepath.Join("elsewhere", "f.csv")); got != "" {
+		t.Errorf("outside: got %q", got)
+	}
+	e.Recursive = false
+	if got := e.RelativeDir(filepath.Join(src, "a", "f.csv")); got != "" {
+		t.Errorf("not recursive: got %q", got)
+	}
+}
+
+func TestValidateConfig_IncludeExclude(t *testing.T) {
+	tf := sftpTransfer(t)
+	tf.Include = []string{"*.csv", "regex:(bad"}
+	tf.Exclude = []string{"tmp/**", "[oops"}
+
+	err := ValidateConfig(&ConfigData{DataDir: t.TempDir(), Transfers: []ConfigEntry{tf}})
+	if err == nil {
+		t.Fatal("expected errors for the invalid rules")
+	}
+	for _, want := range []string{`include "regex:(bad"`, `exclude "[oops"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error containing %q, got: %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), `"*.csv"`) || strings.Contains(err.Error(), `"tmp/**"`) {
+		t.Errorf("valid rules reported as errors: %v", err)
+	}
+}
+
+func TestValidateConfig_PartialFailure(t *testing.T) {
+	for _, policy := range []string{"", "fail", "Success", "keep"} {
+		cfg := &ConfigData{DataDir: t.TempDir(), PartialFailure: policy, Transfers: []ConfigEntry{sftpTransfer(t)}}
+		if err := ValidateConfig(cfg); err != nil {
+			t.Errorf("partial_failure %q: did not expect error, got: %v", policy, err)
+		}
+	}
+
+	cfg := &ConfigData{DataDir: t.TempDir(), PartialFailure: "retry", Transfers: []ConfigEntry{sftpTransfer(t)}}
+	if err := ValidateConfig(cfg); err == nil || !strings.Contains(err.Error(), `partial_failure "retry" invalid`) {
+		t.Fatalf("expected partial_failure error, got: %v", err)
+	}
+}
+
+func TestValidateConfig_ShutdownGracePeriod(t *testing.T) {
+	cfg := &ConfigData{DataDir: t.TempDir(), ShutdownGracePeriod: -time.Second, Transfers: []ConfigEntry{sftpTransfer(t)}}
+	if err := ValidateConfig(cfg); err == nil || !strings.Contains(err.Error(), "shutdown_grace_period must not be negative") {
+		t.Fatalf("expected shutdown_grace_period error, got: %v", err)
+	}
+
+	if got := (&ConfigData{}).GracePeriod(); got != DefaultShutdownGracePeriod {
+		t.Errorf("expected default grace period %v, got %v", DefaultShutdownGracePeriod, got)
+	}
+	if got := (&ConfigData{ShutdownGracePeriod: time.Minute}).GracePeriod(); got != time.Minute {
+		t.Errorf("expected configured grace period, got %v", got)
+	}
+}
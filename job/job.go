@@ -0,0 +1,153 @@
+package job
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Job is one file on its way through the agent, from the tracker through the
+// selector to the processor. Its ID is added to every log line about the file,
+// so grepping for it shows the file's whole lifecycle.
+
+type Job struct {
+	ID        string            // unique; logged as "job"
+	Path      string            // the source file
+	Transfers []string          // names of the transfers that claim it, in config order
+	RelPath   map[string]string // by transfer name, relative to its source directory, "/" separated
+	Detected  time.Time         // when the tracker first saw the file
+	Attempt   int               // 1 the first time it's sent; counts up with deferred retries
+	Size      int64             // bytes, when it was queued
+}
+
+// New starts a job for a file detected now.
+
+func New(path string) Job {
+	return Job{ID: NewID(), Path: path, Detected: time.Now(), Attempt: 1}
+}
+
+// Claim adds a transfer that claims the job's file, with the file's path
+// relative to the transfer's source directory. Transfers with different source
+// directories can claim the same file, so each has its own.
+
+func (j *Job) Claim(transfer, relPath string) {
+	j.Transfers = append(j.Transfers, transfer)
+	if j.RelPath == nil {
+		j.RelPath = make(map[string]string)
+	}
+	j.RelPath[transfer] = relPath
+}
+
+// NewID returns a new random job ID.
+
+func NewID() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b) // never fails
+	return hex.EncodeToString(b)
+}
+
+// active holds the ID of the job in progress for each file, for Handler.
+var active = struct {
+	mu  sync.Mutex
+	ids map[string]string
+}{ids: make(map[string]string)}
+
+// Track makes j the job in progress for its file, so log lines about the file
+// carry its ID. If the file already has a job in progress (eg. it was written
+// again while it was being sent), j takes that job's ID instead, as it's still
+// the same file's story.
+
+func Track(j *Job) {
+	active.mu.Lock()
+	defer active.mu.Unlock()
+	if id, ok := active.ids[j.Path]; ok {
+		j.ID = id
+		return
+	}
+	active.ids[j.Path] = j.ID
+}
+
+// Finish is called when a job is over: the file has been sent or given up on,
+// or it's gone.
+
+func Finish(j Job) {
+	active.mu.Lock()
+	defer active.mu.Unlock()
+	if active.ids[j.Path] == j.ID {
+		delete(active.ids, j.Path)
+	}
+}
+
+// Lookup returns the ID of the job in progress for a file.
+
+func Lookup(path string) (string, bool) {
+	active.mu.Lock()
+	defer active.mu.Unlock()
+	id, ok := active.ids[path]
+	return id, ok
+}
+
+// Handler adds a "job" attribute to log records with a "file" attribute for a
+// file that has a job in progress. Wrapping the agent's log handler with it
+// tags every line about the file, including those from packages that know
+// nothing about jobs, such as sendfile.
+
+type Handler struct {
+	next   slog.Handler
+	id     string // from a "file" attribute added by WithAttrs
+	tagged bool   // WithAttrs has already added a "job" attribute
+}
+
+func NewHandler(next slog.Handler) *Handler {
+	return &Handler{next: next}
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	if h.tagged {
+		return h.next.Handle(ctx, r)
+	}
+	id, tagged := h.id, false
+	r.Attrs(func(a slog.Attr) bool {
+		switch a.Key {
+		case "job":
+			tagged = true
+			return false
+		case "file":
+			if found, ok := Lookup(a.Value.String()); ok {
+				id = found
+			}
+		}
+		return true
+	})
+	if id != "" && !tagged {
+		r = r.Clone()
+		r.AddAttrs(slog.String("job", id))
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	id, tagged := h.id, h.tagged
+	for _, a := range attrs {
+		switch a.Key {
+		case "job":
+			tagged = true
+		case "file":
+			if found, ok := Lookup(a.Value.String()); ok {
+				id = found
+			}
+		}
+	}
+	return &Handler{next: h.next.WithAttrs(attrs), id: id, tagged: tagged}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{next: h.next.WithGroup(name), id: h.id, tagged: h.tagged}
+}
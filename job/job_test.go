@@ -0,0 +1,83 @@
+package job
+
+import (
+	"bytes"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	a, b := New("a.txt"), New("a.txt")
+	if a.ID == "" || a.ID == b.ID {
+		t.Fatalf("expected unique IDs, got %q and %q", a.ID, b.ID)
+	}
+	if a.Attempt != 1 || a.Detected.IsZero() {
+		t.Fatalf("expected first attempt with a detection time, got %+v", a)
+	}
+}
+
+func TestTrack_KeepsIDOfJobInProgress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	first := New(path)
+	Track(&first)
+	defer Finish(first)
+
+	// Written again while the first job is still in progress.
+	second := New(path)
+	Track(&second)
+	if second.ID != first.ID {
+		t.Fatalf("expected the job in progress's ID %s, got %s", first.ID, second.ID)
+	}
+
+	Finish(first)
+	if _, ok := Lookup(path); ok {
+		t.Fatal("expected no job in progress after Finish")
+	}
+}
+
+func TestFinish_IgnoresOtherJobs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	current := New(path)
+	Track(&current)
+	defer Finish(current)
+
+	Finish(Job{ID: "stale", Path: path})
+	if id, ok := Lookup(path); !ok || id != current.ID {
+		t.Fatalf("expected %s still in progress, got %q", current.ID, id)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	j := New(path)
+	Track(&j)
+	defer Finish(j)
+
+	var buf bytes.Buffer
+	logger := slog.New(NewHandler(slog.NewTextHandler(&buf, nil)))
+
+	tests := []struct {
+		name string
+		log  func()
+		want int // times the job ID should appear
+	}{
+		{name: "file attribute", log: func() { logger.Info("msg", "file", path) }, want: 1},
+		{name: "other file", log: func() { logger.Info("msg", "file", "other.txt") }, want: 0},
+		{name: "no file", log: func() { logger.Info("msg") }, want: 0},
+		{name: "already tagged", log: func() { logger.Info("msg", "file", path, "job", j.ID) }, want: 1},
+		{name: "file from With", log: func() { logger.With("file", path).Info("msg") }, want: 1},
+		{name: "job from With", log: func() { logger.With("job", j.ID).Info("msg", "file", path) }, want: 1},
+		{name: "group", log: func() { logger.With("file", path).WithGroup("g").Info("msg", "x", 1) }, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			tt.log()
+			if got := strings.Count(buf.String(), "job="+j.ID); got != tt.want {
+				t.Fatalf("expected job ID %d times, got %d: %s", tt.want, got, buf.String())
+			}
+		})
+	}
+}
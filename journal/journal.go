@@ -0,0 +1,348 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/justin-molloy/tfagent/job"
+)
+
+// State is where a file has got to on its way through the agent.
+type State string
+
+const (
+	Detected State = "detected" // seen by the tracker, waiting to settle
+	Queued   State = "queued"   // handed to the processor
+	Sending  State = "sending"  // an upload is in progress
+	Deferred State = "deferred" // waiting in the deferred retry queue
+	Done     State = "done"     // sent; recorded before the success action runs
+	Failed   State = "failed"   // given up on; recorded before the fail action runs
+)
+
+// Terminal reports whether a file in this state is finished with.
+func (s State) Terminal() bool {
+	return s == Done || s == Failed
+}
+
+// Record is one line of the journal. A line with a Transfer is about that one
+// transfer's upload of the file; the others are about the file as a whole.
+// Transfers is how each transfer has got on with a file still in progress, and
+// is only written when the journal is compacted.
+type Record struct {
+	Time      time.Time        `json:"time"`
+	File      string           `json:"file"`
+	Job       string           `json:"job,omitempty"`
+	Transfer  string           `json:"transfer,omitempty"`
+	State     State            `json:"state"`
+	Size      int64            `json:"size,omitempty"`
+	ModTime   time.Time        `json:"mtime,omitzero"`
+	Error     string           `json:"error,omitempty"`
+	Transfers map[string]State `json:"transfers,omitempty"`
+}
+
+// compactAfter is how many records are appended before the journal is
+// rewritten with just the files that are still in progress.
+const compactAfter = 1000
+
+// Journal is a write-ahead log of file states, kept as JSON lines in the data
+// directory. Every change is appended and flushed to disk before the agent acts
+// on it, so after a restart the agent knows which files it was part way through.
+//
+// A nil *Journal is valid and records nothing, for callers (and tests) that
+// don't keep one.
+
+type Journal struct {
+	mu       sync.Mutex
+	path     string
+	f        *os.File
+	pending  map[string]Record // latest record for each file not yet done or failed
+	appended int               // records written since the last compaction
+}
+
+// Open reads the journal at path, keeping the latest state of every file that
+// isn't finished, and compacts it before appending new records.
+
+func Open(path string) (*Journal, error) {
+	j := &Journal{path: path, pending: make(map[string]Record)}
+
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create journal directory: %w", err)
+	}
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	f, err := os.Open(j.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read journal: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var r Record
+		if err := json.Unmarshal([]byte(text), &r); err != nil {
+			// A crash part way through an append leaves a torn last line.
+			slog.Warn("Skipping unreadable journal record", "file", j.path, "line", line, "error", err)
+			continue
+		}
+		j.apply(r)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read journal: %w", err)
+	}
+	return nil
+}
+
+func (j *Journal) apply(r Record) {
+	prev, inProgress := j.pending[r.File]
+
+	if r.Transfer == "" {
+		if r.State.Terminal() {
+			delete(j.pending, r.File)
+			return
+		}
+		if r.Transfers == nil {
+			r.Transfers = prev.Transfers
+		}
+		j.pending[r.File] = r
+		return
+	}
+
+	// A transfer's upload doesn't finish the file, but one starting means it is
+	// being sent - unless it is a deferred retry, which the retry queue looks
+	// after.
+	state := prev.State
+	switch {
+	case !inProgress:
+		state = Sending
+	case r.State == Sending && prev.State != Deferred:
+		state = Sending
+	}
+	transfers := make(map[string]State, len(prev.Transfers)+1)
+	maps.Copy(transfers, prev.Transfers)
+	transfers[r.Transfer] = r.State
+
+	r.State = state
+	r.Transfer = ""
+	r.Transfers = transfers
+	if r.Job == "" {
+		r.Job = prev.Job
+	}
+	j.pending[r.File] = r
+}
+
+// Record appends a state change for a file and flushes it to disk. Size and
+// modification time are taken from the file if it is still there, and the ID
+// of its job in progress so it can be carried on after a restart.
+
+func (j *Journal) Record(file string, state State, recErr error) error {
+	return j.record(file, "", state, recErr)
+}
+
+// RecordTransfer appends how one transfer has got on with a file: Sending when
+// its upload starts, then Done, Failed or Deferred. They're kept until the file
+// is finished with, so after a restart it is only sent to the transfers that
+// hadn't finished with it.
+
+func (j *Journal) RecordTransfer(file, transfer string, state State, recErr error) error {
+	return j.record(file, transfer, state, recErr)
+}
+
+func (j *Journal) record(file, transfer string, state State, recErr error) error {
+	if j == nil {
+		return nil
+	}
+
+	r := Record{Time: time.Now().UTC(), File: file, Transfer: transfer, State: state}
+	r.Job, _ = job.Lookup(file)
+	if info, err := os.Stat(file); err == nil {
+		r.Size = info.Size()
+		r.ModTime = info.ModTime().UTC()
+	}
+	if recErr != nil {
+		r.Error = recErr.Error()
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.append(r); err != nil {
+		slog.Error("Unable to write journal", "file", file, "transfer", transfer, "state", state, "error", err)
+		return err
+	}
+	j.apply(r)
+
+	if j.appended >= compactAfter && j.appended >= 4*len(j.pending) {
+		if err := j.compact(); err != nil {
+			slog.Error("Unable to compact journal", "error", err)
+		}
+	}
+	return nil
+}
+
+// Detected records that a file has been seen, unless it is already in progress.
+
+func (j *Journal) Detected(file string) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	_, inProgress := j.pending[file]
+	j.mu.Unlock()
+	if inProgress {
+		return nil
+	}
+	return j.Record(file, Detected, nil)
+}
+
+// State returns the latest state of a file that is still in progress.
+
+func (j *Journal) State(file string) (State, bool) {
+	if j == nil {
+		return "", false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	r, ok := j.pending[file]
+	return r.State, ok
+}
+
+// Transfers returns how each transfer has got on with a file that is still in
+// progress, or nil if none has started on it.
+
+func (j *Journal) Transfers(file string) map[string]State {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return maps.Clone(j.pending[file].Transfers)
+}
+
+// Pending returns the latest record of every file that isn't done or failed,
+// oldest first.
+
+func (j *Journal) Pending() []Record {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	list := make([]Record, 0, len(j.pending))
+	for _, r := range j.pending {
+		list = append(list, r)
+	}
+	slices.SortFunc(list, func(a, b Record) int {
+		if c := a.Time.Compare(b.Time); c != 0 {
+			return c
+		}
+		return strings.Compare(a.File, b.File)
+	})
+	return list
+}
+
+// Close closes the journal file.
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
+
+func (j *Journal) append(r Record) error {
+	if j.f == nil {
+		return errors.New("journal is closed")
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	j.appended++
+	return j.f.Sync()
+}
+
+// compact rewrites the journal with only the files still in progress, via a
+// temporary file and a rename so a crash never loses the old journal.
+
+func (j *Journal) compact() error {
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to compact journal: %w", err)
+	}
+
+	w := bufio.NewWriter(tmp)
+	for _, r := range j.pending {
+		data, err := json.Marshal(r)
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("unable to compact journal: %w", err)
+		}
+		w.Write(append(data, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to compact journal: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to compact journal: %w", err)
+	}
+	tmp.Close()
+
+	if j.f != nil {
+		j.f.Close()
+		j.f = nil
+	}
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return fmt.Errorf("unable to compact journal: %w", err)
+	}
+
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to open journal: %w", err)
+	}
+	j.f = f
+	j.appended = 0
+	return nil
+}
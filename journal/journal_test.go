@@ -0,0 +1,184 @@
+package journal
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/justin-molloy/tfagent/job"
+)
+
+func TestJournal_ReplaysPendingFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "journal.jsonl")
+	src := t.TempDir()
+	a := filepath.Join(src, "a.txt")
+	if err := os.WriteFile(a, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	j, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	j.Record(a, Queued, nil)
+	j.Record(a, Sending, nil)
+	j.Record("/in/b.txt", Queued, nil)
+	j.Record("/in/b.txt", Sending, nil)
+	j.Record("/in/b.txt", Done, nil)
+	j.Record("/in/c.txt", Failed, errors.New("boom"))
+	j.Close()
+
+	j, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer j.Close()
+
+	pending := j.Pending()
+	if len(pending) != 1 || pending[0].File != a || pending[0].State != Sending {
+		t.Fatalf("expected only a.txt (sending) pending, got %+v", pending)
+	}
+	if pending[0].Size != 3 || pending[0].ModTime.IsZero() {
+		t.Fatalf("expected size and mtime recorded, got %+v", pending[0])
+	}
+
+	// Opening compacts the journal down to the files still in progress.
+	data, _ := os.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Fatalf("expected 1 line after compaction, got %d:\n%s", lines, data)
+	}
+}
+
+func TestJournal_SkipsTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	content := `{"file":"/in/a.txt","state":"queued"}` + "\n" + `{"file":"/in/b.txt","sta`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	j, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer j.Close()
+
+	if state, ok := j.State("/in/a.txt"); !ok || state != Queued {
+		t.Fatalf("expected a.txt queued, got %q %v", state, ok)
+	}
+	if _, ok := j.State("/in/b.txt"); ok {
+		t.Fatal("expected the torn record to be skipped")
+	}
+}
+
+func TestJournal_DetectedOnlyOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer j.Close()
+
+	j.Detected("/in/a.txt")
+	j.Detected("/in/a.txt")
+	j.Record("/in/a.txt", Queued, nil)
+	j.Detected("/in/a.txt") // already further along; must not go back to detected
+
+	if state, _ := j.State("/in/a.txt"); state != Queued {
+		t.Fatalf("expected queued, got %q", state)
+	}
+	data, _ := os.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Fatalf("expected 2 records, got %d:\n%s", lines, data)
+	}
+}
+
+func TestJournal_NilIsNoOp(t *testing.T) {
+	var j *Journal
+	if err := j.Record("/in/a.txt", Queued, nil); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	if len(j.Pending()) != 0 {
+		t.Fatal("expected nothing pending")
+	}
+}
+
+func TestJournal_RecordsJobID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	jb := job.New("/in/a.txt")
+	job.Track(&jb)
+	defer job.Finish(jb)
+	j.Record("/in/a.txt", Queued, nil)
+	j.Record("/in/b.txt", Queued, nil)
+	j.Close()
+
+	j, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer j.Close()
+	for _, r := range j.Pending() {
+		want := ""
+		if r.File == "/in/a.txt" {
+			want = jb.ID
+		}
+		if r.Job != want {
+			t.Errorf("expected %s recorded with job %q, got %q", r.File, want, r.Job)
+		}
+	}
+}
+
+func TestJournal_KeepsEachTransfersState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	j.Record("/in/a.txt", Queued, nil)
+	j.RecordTransfer("/in/a.txt", "partner", Sending, nil)
+	j.RecordTransfer("/in/a.txt", "internal", Sending, nil)
+	j.RecordTransfer("/in/a.txt", "partner", Done, nil)
+
+	// A deferred file stays deferred while a retry is being sent.
+	j.RecordTransfer("/in/b.txt", "partner", Failed, errors.New("boom"))
+	j.RecordTransfer("/in/b.txt", "internal", Deferred, errors.New("timeout"))
+	j.Record("/in/b.txt", Deferred, nil)
+	j.RecordTransfer("/in/b.txt", "internal", Sending, nil)
+	j.Close()
+
+	// Reopened twice, so the states also come through compaction.
+	for range 2 {
+		if j, err = Open(path); err != nil {
+			t.Fatalf("reopen: %v", err)
+		}
+		j.Close()
+	}
+	if j, err = Open(path); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer j.Close()
+
+	if state, _ := j.State("/in/a.txt"); state != Sending {
+		t.Errorf("expected a.txt sending, got %q", state)
+	}
+	if got, want := j.Transfers("/in/a.txt"), map[string]State{"partner": Done, "internal": Sending}; !maps.Equal(got, want) {
+		t.Errorf("expected a.txt transfers %v, got %v", want, got)
+	}
+	if state, _ := j.State("/in/b.txt"); state != Deferred {
+		t.Errorf("expected b.txt deferred, got %q", state)
+	}
+	if got, want := j.Transfers("/in/b.txt"), map[string]State{"partner": Failed, "internal": Sending}; !maps.Equal(got, want) {
+		t.Errorf("expected b.txt transfers %v, got %v", want, got)
+	}
+
+	j.Record("/in/a.txt", Done, nil)
+	if j.Transfers("/in/a.txt") != nil {
+		t.Error("expected the transfers forgotten once the file is done")
+	}
+}
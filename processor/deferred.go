@@ -0,0 +1,267 @@
+package processor
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+	"github.com/justin-molloy/tfagent/journal"
+	"github.com/justin-molloy/tfagent/retryqueue"
+	"github.com/justin-molloy/tfagent/sendfile"
+)
+
+// retryQueueFile is where pending deferred retries are kept, in the data directory.
+const retryQueueFile = "deferred_retries.json"
+
+var (
+	// retryCheckInterval is how often the deferred retry queue is checked for
+	// files that are due.
+	retryCheckInterval = 15 * time.Second
+
+	// retrySummaryInterval is how often the pending deferred retries are logged.
+	retrySummaryInterval = 10 * time.Minute
+)
+
+// openRetryQueue loads the deferred retries saved by an earlier run. If none of
+// the transfers use deferred retries, or there is no data directory, the queue
+// is only kept in memory.
+
+func openRetryQueue(cfg *config.ConfigData) *retryqueue.Queue {
+	path := ""
+	if cfg.DataDir != "" && usesDeferredRetry(cfg) {
+		path = filepath.Join(cfg.DataDir, retryQueueFile)
+	}
+
+	q, err := retryqueue.Open(path)
+	if err != nil {
+		// Don't overwrite a file we couldn't read - someone may want to look at it.
+		slog.Error("Unable to load deferred retries; pending retries will not be saved", "file", path, "error", err)
+		q, _ = retryqueue.Open("")
+	}
+	return q
+}
+
+func usesDeferredRetry(cfg *config.ConfigData) bool {
+	for _, t := range cfg.Transfers {
+		if t.DeferredRetry.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// deferRetry puts a failed file into the deferred retry queue, if the transfer
+// uses deferred retries and the error isn't a permanent one. It returns false if
+// the file should fail now instead - including once it has run out of deferred
+// attempts or is older than max_age.
+
+func (p *processor) deferRetry(entry config.ConfigEntry, file string, uploadErr error) bool {
+	if !entry.DeferredRetry.Enabled || sendfile.IsPermanent(uploadErr) {
+		p.clearRetry(file, entry.Name)
+		return false
+	}
+	settings := entry.DeferredRetry.WithDefaults()
+	now := time.Now()
+
+	e, deferred := p.retries.Get(file, entry.Name)
+	if deferred {
+		e.Attempts++
+	} else {
+		e = retryqueue.Entry{File: file, FirstFailed: now}
+	}
+	e.Transfer = entry.Name
+	e.LastError = uploadErr.Error()
+	if id, ok := job.Lookup(file); ok {
+		e.Job = id
+	}
+
+	if e.Attempts >= settings.MaxAttempts || now.Sub(e.FirstFailed) >= settings.MaxAge {
+		slog.Error("Giving up on deferred retries",
+			"file", file, "transfer", entry.Name, "attempts", e.Attempts,
+			"first_failed", e.FirstFailed, "error", uploadErr)
+		p.clearRetry(file, entry.Name)
+		return false
+	}
+
+	e.NextRetry = now.Add(settings.Delay(e.Attempts + 1))
+	if err := p.retries.Put(e); err != nil {
+		slog.Error("Unable to save deferred retry", "file", file, "error", err)
+	}
+	slog.Warn("Deferred retry scheduled",
+		"file", file, "transfer", entry.Name, "attempt", e.Attempts+1,
+		"max_attempts", settings.MaxAttempts, "next_retry", e.NextRetry.Format(time.RFC3339))
+	return true
+}
+
+// clearRetry drops a file's deferred retry for a transfer, if it has one.
+
+func (p *processor) clearRetry(file, transfer string) {
+	if _, ok := p.retries.Get(file, transfer); !ok {
+		return
+	}
+	if err := p.retries.Remove(file, transfer); err != nil {
+		slog.Error("Unable to save deferred retries", "file", file, "error", err)
+	}
+	slog.Info("Removed from deferred retries", "file", file, "transfer", transfer)
+}
+
+// runDeferredRetries hands files in the deferred retry queue back to the
+// worker of the transfer they're waiting for when they are due, until stop is
+// closed. Anything left over from an earlier run is due straight away if its
+// time has passed.
+
+func (p *processor) runDeferredRetries(stop <-chan struct{}) {
+	p.resumeDeferred()
+	p.logPendingRetries()
+	p.dispatchDueRetries()
+
+	check := time.NewTicker(retryCheckInterval)
+	defer check.Stop()
+	summary := time.NewTicker(retrySummaryInterval)
+	defer summary.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-check.C:
+			p.dispatchDueRetries()
+		case <-summary.C:
+			p.logPendingRetries()
+		}
+	}
+}
+
+// resumeDeferred checks the files the journal has as waiting for a deferred
+// retry against the retry queue. The queue may not have an entry for them: it
+// is only kept in memory if deferred_retry has been turned off since, and is
+// started afresh if it couldn't be read. A transfer left without one is
+// retried straight away, so the file is sent or failed rather than waiting
+// forever; the startup scan won't pick it up again. A file every transfer has
+// finished with is settled, and one no transfer claims any more is failed.
+
+func (p *processor) resumeDeferred() {
+	now := time.Now()
+	for _, r := range p.journal.Pending() {
+		if r.State != journal.Deferred {
+			continue
+		}
+
+		claims := p.claims(r.File)
+		if len(claims) == 0 {
+			if !slices.ContainsFunc(p.retries.List(), func(e retryqueue.Entry) bool { return e.File == r.File }) {
+				slog.Warn("File waiting for deferred retry no longer matches any transfer; marking failed", "file", r.File)
+				p.journal.Record(r.File, journal.Failed, errors.New("no matching transfer"))
+			}
+			continue
+		}
+
+		waiting := false
+		for _, i := range claims {
+			name := p.cfg.Transfers[i].Name
+			if s := r.Transfers[name]; s == journal.Done || s == journal.Failed {
+				continue
+			}
+			waiting = true
+			if _, ok := p.retries.Get(r.File, name); ok {
+				continue
+			}
+			slog.Warn("File waiting for deferred retry is missing from the retry queue; retrying it now", "file", r.File, "transfer", name)
+			e := retryqueue.Entry{File: r.File, Transfer: name, Job: r.Job, FirstFailed: r.Time, NextRetry: now, LastError: r.Error}
+			if err := p.retries.Put(e); err != nil {
+				slog.Error("Unable to save deferred retry", "file", r.File, "error", err)
+			}
+		}
+		if !waiting {
+			p.finish(p.restore(r.File, r.Job, time.Time{}))
+		}
+	}
+}
+
+func (p *processor) dispatchDueRetries() {
+	for _, e := range p.retries.Due(time.Now()) {
+		transfer := slices.IndexFunc(p.cfg.Transfers, func(t config.ConfigEntry) bool { return t.Name == e.Transfer })
+
+		if _, err := os.Stat(e.File); errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("File waiting for deferred retry has gone; dropping it", "file", e.File, "transfer", e.Transfer)
+			p.dropDeferred(e, transfer, err)
+			continue
+		}
+
+		// The file may have been picked up again in the meantime. Whatever
+		// happens to that attempt updates or clears its retry entry.
+		p.mu.Lock()
+		d := p.deliveries[e.File]
+		p.mu.Unlock()
+		if transfer >= 0 && d != nil && d.outcome(transfer) == pending {
+			slog.Debug("Deferred retry skipped; already processing", "file", e.File, "transfer", e.Transfer)
+			continue
+		}
+
+		// Other transfers may still be busy with the file, in which case it's
+		// already in the processing set.
+		added := !p.processingSet.AlreadyExists(e.File)
+		if added {
+			p.processingSet.AddFile(e.File)
+		}
+		if transfer < 0 || !p.redeliver(e, transfer) {
+			slog.Warn("File waiting for deferred retry no longer matches its transfer; dropping it", "file", e.File, "transfer", e.Transfer)
+			if added {
+				p.processingSet.Delete(e.File)
+			}
+			p.dropDeferred(e, transfer, errors.New("transfer no longer claims the file"))
+			continue
+		}
+		slog.Info("Deferred retry due", "file", e.File, "transfer", e.Transfer, "attempt", e.Attempts+1)
+	}
+}
+
+// dropDeferred ends a transfer's deferred retries of a file that has gone or
+// that the transfer no longer claims. The transfer counts as failed in the
+// file's delivery, rebuilt from the journal if the agent has been restarted,
+// and the file is settled once no other transfer is still busy with it or
+// waiting to retry it. A file no transfer claims any more is failed.
+
+func (p *processor) dropDeferred(e retryqueue.Entry, transfer int, err error) {
+	p.clearRetry(e.File, e.Transfer)
+
+	d := p.restore(e.File, e.Job, e.FirstFailed)
+	if transfer >= 0 && slices.Contains(d.claims, transfer) {
+		p.settle(task{d: d, transfer: transfer}, failed, err)
+		return
+	}
+
+	p.journal.RecordTransfer(e.File, e.Transfer, journal.Failed, err)
+	if len(d.claims) == 0 {
+		p.mu.Lock()
+		if p.deliveries[e.File] == d {
+			delete(p.deliveries, e.File)
+		}
+		p.mu.Unlock()
+		p.journal.Record(e.File, journal.Failed, err)
+		job.Finish(d.job)
+		return
+	}
+	if d.idle() {
+		p.finish(d)
+	}
+}
+
+func (p *processor) logPendingRetries() {
+	pending := p.retries.List()
+	if len(pending) == 0 {
+		return
+	}
+	slog.Info("Deferred retries pending", "count", len(pending))
+	for _, e := range pending {
+		slog.Info("Deferred retry pending",
+			"file", e.File, "transfer", e.Transfer, "attempts", e.Attempts,
+			"next_retry", e.NextRetry.Format(time.RFC3339), "last_error", e.LastError)
+	}
+}
@@ -0,0 +1,293 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+	"github.com/justin-molloy/tfagent/journal"
+	"github.com/justin-molloy/tfagent/retryqueue"
+)
+
+func fastRetryChecks(t *testing.T) {
+	t.Helper()
+	old := retryCheckInterval
+	retryCheckInterval = 10 * time.Millisecond
+	t.Cleanup(func() { retryCheckInterval = old })
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func savedRetries(t *testing.T, dataDir string) []retryqueue.Entry {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dataDir, retryQueueFile))
+	if err != nil {
+		return nil
+	}
+	var entries []retryqueue.Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatalf("parse retry queue: %v", err)
+	}
+	return entries
+}
+
+func deferredLocalConfig(src, dest, dataDir string, d config.DeferredRetryConfig) *config.ConfigData {
+	d.Enabled = true
+	return &config.ConfigData{
+		DataDir: dataDir,
+		Transfers: []config.ConfigEntry{
+			{
+				Name:            "t",
+				SourceDirectory: src,
+				RemotePath:      dest,
+				TransferType:    "local",
+				ActionOnFail:    "archive",
+				DeferredRetry:   d,
+			},
+		},
+	}
+}
+
+func TestStartProcessor_DeferredRetrySucceedsLater(t *testing.T) {
+	fastRetryChecks(t)
+	tmp := t.TempDir()
+	dataDir := t.TempDir()
+	dest := filepath.Join(tmp, "dest") // doesn't exist yet, so the copy fails
+	src := mustWriteTempFile(t, filepath.Join(tmp, "src"), "in.txt", "x")
+
+	cfg := deferredLocalConfig(filepath.Dir(src), dest, dataDir,
+		config.DeferredRetryConfig{Schedule: []time.Duration{50 * time.Millisecond}, MaxAttempts: 100})
+
+	q := make(chan job.Job, 1)
+	done := make(chan struct{})
+	go func() {
+		StartProcessor(t.Context(), cfg, q, newProcessingSet(t), nil)
+		close(done)
+	}()
+	j := job.New(src)
+	job.Track(&j)
+	q <- j
+
+	waitFor(t, "the file to be deferred", func() bool { return len(savedRetries(t, dataDir)) == 1 })
+	if got := savedRetries(t, dataDir)[0].Job; got != j.ID {
+		t.Fatalf("expected the retry saved with job %s, got %q", j.ID, got)
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Fatalf("a deferred file must stay where it is: %v", err)
+	}
+
+	// The destination comes back; the next deferred attempt delivers the file.
+	if err := os.Mkdir(dest, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	waitFor(t, "the deferred retry to deliver the file", func() bool {
+		_, err := os.Stat(filepath.Join(dest, "in.txt"))
+		return err == nil
+	})
+	waitFor(t, "the retry queue to empty", func() bool { return len(savedRetries(t, dataDir)) == 0 })
+
+	close(q)
+	<-done
+}
+
+func TestStartProcessor_DeferredRetryGivesUp(t *testing.T) {
+	fastRetryChecks(t)
+	tmp := t.TempDir()
+	dataDir := t.TempDir()
+	srcDir := filepath.Join(tmp, "src")
+	src := mustWriteTempFile(t, srcDir, "in.txt", "x")
+
+	cfg := deferredLocalConfig(srcDir, filepath.Join(tmp, "missing"), dataDir,
+		config.DeferredRetryConfig{Schedule: []time.Duration{20 * time.Millisecond}, MaxAttempts: 2})
+
+	q := make(chan job.Job, 1)
+	done := make(chan struct{})
+	go func() {
+		StartProcessor(t.Context(), cfg, q, newProcessingSet(t), nil)
+		close(done)
+	}()
+	q <- job.New(src)
+
+	waitFor(t, "the file to be failed", func() bool {
+		_, err := os.Stat(filepath.Join(srcDir, "fail", "in.txt"))
+		return err == nil
+	})
+	if got := savedRetries(t, dataDir); len(got) != 0 {
+		t.Fatalf("expected the retry queue to be empty, got %+v", got)
+	}
+
+	close(q)
+	<-done
+}
+
+func TestStartProcessor_ResumesSavedRetries(t *testing.T) {
+	fastRetryChecks(t)
+	tmp := t.TempDir()
+	dataDir := t.TempDir()
+	dest := t.TempDir()
+	srcDir := filepath.Join(tmp, "src")
+	src := mustWriteTempFile(t, srcDir, "in.txt", "x")
+
+	// Left over from an earlier run.
+	q0, err := retryqueue.Open(filepath.Join(dataDir, retryQueueFile))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := q0.Put(retryqueue.Entry{File: src, Transfer: "t", FirstFailed: time.Now().Add(-time.Hour), Attempts: 1, NextRetry: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	cfg := deferredLocalConfig(srcDir, dest, dataDir, config.DeferredRetryConfig{})
+	q := make(chan job.Job)
+	done := make(chan struct{})
+	go func() {
+		StartProcessor(t.Context(), cfg, q, newProcessingSet(t), nil)
+		close(done)
+	}()
+
+	waitFor(t, "the saved retry to be delivered", func() bool {
+		_, err := os.Stat(filepath.Join(dest, "in.txt"))
+		return err == nil
+	})
+	waitFor(t, "the retry queue to empty", func() bool { return len(savedRetries(t, dataDir)) == 0 })
+
+	close(q)
+	<-done
+}
+
+func TestDispatchDueRetries_DropsDeliveryOfVanishedFile(t *testing.T) {
+	src := t.TempDir()
+	gone := filepath.Join(src, "gone.txt")
+	cfg := &config.ConfigData{
+		Transfers: []config.ConfigEntry{
+			{Name: "partner", SourceDirectory: src, TransferType: "local", DeferredRetry: config.DeferredRetryConfig{Enabled: true}},
+			{Name: "internal", SourceDirectory: src, TransferType: "local"},
+		},
+	}
+	retries, _ := retryqueue.Open("")
+	p := &processor{
+		cfg:           cfg,
+		processingSet: newProcessingSet(t),
+		workers:       []*transferQueue{newTransferQueue(), newTransferQueue()},
+		retries:       retries,
+		deliveries:    make(map[string]*delivery),
+	}
+
+	// partner is waiting for a deferred retry; internal has sent the file.
+	j := job.New(gone)
+	job.Track(&j)
+	p.deliveries[gone] = &delivery{job: j, claims: []int{0, 1}, outcomes: map[int]outcome{0: deferred, 1: sent}}
+	retries.Put(retryqueue.Entry{File: gone, Transfer: "partner", Job: j.ID, NextRetry: time.Now().Add(-time.Second)})
+
+	p.dispatchDueRetries()
+
+	if len(p.deliveries) != 0 {
+		t.Errorf("expected the vanished file's delivery to be dropped, got %v", p.deliveries)
+	}
+	if _, ok := retries.Get(gone, "partner"); ok {
+		t.Error("expected the retry entry to be removed")
+	}
+	if _, ok := job.Lookup(gone); ok {
+		t.Error("expected the file's job to be finished")
+	}
+}
+
+func TestStartProcessor_RetriesDeferredFileMissingFromQueue(t *testing.T) {
+	fastRetryChecks(t)
+	tmp := t.TempDir()
+	dataDir := t.TempDir()
+	dest := t.TempDir()
+	srcDir := filepath.Join(tmp, "src")
+	src := mustWriteTempFile(t, srcDir, "in.txt", "x")
+
+	// The file was deferred before the restart, but deferred_retry has been
+	// turned off since, so the retry queue doesn't have it.
+	jrnl := openJournal(t, dataDir)
+	jrnl.RecordTransfer(src, "t", journal.Deferred, errors.New("boom"))
+	jrnl.Record(src, journal.Deferred, errors.New("boom"))
+
+	cfg := deferredLocalConfig(srcDir, dest, dataDir, config.DeferredRetryConfig{})
+	cfg.Transfers[0].DeferredRetry.Enabled = false
+
+	q := make(chan job.Job)
+	done := make(chan struct{})
+	go func() {
+		StartProcessor(t.Context(), cfg, q, newProcessingSet(t), jrnl)
+		close(done)
+	}()
+
+	waitFor(t, "the file to be finished with", func() bool {
+		_, ok := jrnl.State(src)
+		return !ok
+	})
+	close(q)
+	<-done
+
+	if _, err := os.Stat(filepath.Join(dest, "in.txt")); err != nil {
+		t.Fatalf("expected the stranded file to be sent: %v", err)
+	}
+}
+
+func TestDispatchDueRetries_FailsDroppedRetriesAfterRestart(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	kept := mustWriteTempFile(t, src, "kept.txt", "x")
+	gone := filepath.Join(src, "gone.txt")
+
+	cfg := &config.ConfigData{
+		Transfers: []config.ConfigEntry{
+			{Name: "t", SourceDirectory: src, TransferType: "local", DeferredRetry: config.DeferredRetryConfig{Enabled: true}},
+		},
+	}
+	jrnl := openJournal(t, tmp)
+	retries, _ := retryqueue.Open("")
+	p := &processor{
+		cfg:           cfg,
+		processingSet: newProcessingSet(t),
+		journal:       jrnl,
+		workers:       []*transferQueue{newTransferQueue()},
+		retries:       retries,
+		deliveries:    make(map[string]*delivery),
+	}
+
+	// Both were deferred before the restart. gone.txt has been removed since,
+	// and kept.txt, which t had sent, was waiting for a transfer that has been
+	// removed from the config.
+	jrnl.RecordTransfer(kept, "t", journal.Done, nil)
+	for _, e := range []retryqueue.Entry{
+		{File: gone, Transfer: "t", NextRetry: time.Now().Add(-time.Second)},
+		{File: kept, Transfer: "old", NextRetry: time.Now().Add(-time.Second)},
+	} {
+		jrnl.RecordTransfer(e.File, e.Transfer, journal.Deferred, errors.New("boom"))
+		jrnl.Record(e.File, journal.Deferred, errors.New("boom"))
+		retries.Put(e)
+	}
+
+	p.dispatchDueRetries()
+
+	for _, f := range []string{gone, kept} {
+		if state, ok := jrnl.State(f); ok {
+			t.Errorf("expected %s finished with in the journal, got %q", f, state)
+		}
+	}
+	if got := retries.List(); len(got) != 0 {
+		t.Errorf("expected the retry entries to be removed, got %+v", got)
+	}
+	if len(p.deliveries) != 0 {
+		t.Errorf("expected no deliveries left, got %v", p.deliveries)
+	}
+}
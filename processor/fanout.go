@@ -0,0 +1,394 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+	"github.com/justin-molloy/tfagent/journal"
+	"github.com/justin-molloy/tfagent/retryqueue"
+	"github.com/justin-molloy/tfagent/selector"
+	"github.com/justin-molloy/tfagent/tracker"
+)
+
+// outcome is how one transfer got on with a file.
+type outcome int
+
+const (
+	pending  outcome = iota // queued or being sent
+	sent                    // sent, or skipped by on_conflict
+	failed                  // failed, and not going to be retried
+	deferred                // waiting for a deferred retry
+)
+
+// state is how the journal records an outcome.
+func (o outcome) state() journal.State {
+	switch o {
+	case sent:
+		return journal.Done
+	case failed:
+		return journal.Failed
+	case deferred:
+		return journal.Deferred
+	}
+	return journal.Sending
+}
+
+// finished returns the outcome of a transfer the journal has as finished with
+// a file, or false if it hasn't.
+func finished(s journal.State) (outcome, bool) {
+	switch s {
+	case journal.Done:
+		return sent, true
+	case journal.Failed:
+		return failed, true
+	case journal.Deferred:
+		return deferred, true
+	}
+	return pending, false
+}
+
+// errFailedBeforeRestart stands in for the error of a transfer that failed
+// before the agent was restarted.
+var errFailedBeforeRestart = errors.New("failed before the agent was restarted")
+
+// delivery is one file on its way to every transfer that claims it. The source
+// file is only archived or deleted once all of them have finished with it, so
+// one transfer can't move it out from under another.
+
+type delivery struct {
+	job    job.Job
+	claims []int // indexes into cfg.Transfers, in config order
+
+	mu       sync.Mutex
+	outcomes map[int]outcome
+	err      error // the last failure, for the journal
+}
+
+// task is one file for one transfer's worker.
+type task struct {
+	d        *delivery
+	transfer int
+	attempt  int // 1 the first time; counts up with deferred retries
+}
+
+// set records how a transfer got on. It returns true once no transfer is still
+// pending.
+
+func (d *delivery) set(transfer int, o outcome, err error) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.outcomes[transfer] = o
+	if err != nil {
+		d.err = err
+	}
+	for _, o := range d.outcomes {
+		if o == pending {
+			return false
+		}
+	}
+	return true
+}
+
+// idle reports whether no transfer is still sending the file.
+
+func (d *delivery) idle() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, o := range d.outcomes {
+		if o == pending {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *delivery) outcome(transfer int) outcome {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.outcomes[transfer]
+}
+
+func (d *delivery) count() (nSent, nFailed, nDeferred int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, o := range d.outcomes {
+		switch o {
+		case sent:
+			nSent++
+		case failed:
+			nFailed++
+		case deferred:
+			nDeferred++
+		}
+	}
+	return nSent, nFailed, nDeferred, d.err
+}
+
+// claims returns the transfers that want a file: those whose source directory
+// it is in and whose rules it matches. Jobs from the tracker already name them;
+// this is for files that don't have one, such as deferred retries saved by an
+// earlier run.
+
+func (p *processor) claims(file string) []int {
+	var claims []int
+	for i := range p.cfg.Transfers {
+		if match, err := tracker.FilterMatcher(file, p.cfg.Transfers[i]); err == nil && match {
+			claims = append(claims, i)
+		}
+	}
+	return claims
+}
+
+// jobClaims returns the indexes of the transfers a job names. A job without
+// any is resolved here instead.
+
+func (p *processor) jobClaims(j job.Job) []int {
+	if len(j.Transfers) == 0 {
+		return p.claims(j.Path)
+	}
+	var claims []int
+	for i := range p.cfg.Transfers {
+		if slices.Contains(j.Transfers, p.cfg.Transfers[i].Name) {
+			claims = append(claims, i)
+		}
+	}
+	return claims
+}
+
+// dispatch starts a delivery of a job to every transfer that claims its file.
+// A job replayed from the journal only names the transfers that hadn't
+// finished with the file when the agent stopped; the others keep the outcome
+// the journal has for them, so they still count when the file is settled.
+// It returns false if there aren't any transfers to send it to.
+
+func (p *processor) dispatch(j job.Job) bool {
+	send := p.jobClaims(j)
+	if len(send) == 0 {
+		return false
+	}
+	if len(j.Transfers) == 0 {
+		for _, i := range send {
+			j.Claim(p.cfg.Transfers[i].Name, p.cfg.Transfers[i].RelativePath(j.Path))
+		}
+	}
+
+	saved := p.journal.Transfers(j.Path)
+	d := &delivery{job: j, outcomes: make(map[int]outcome, len(send))}
+	for i := range p.cfg.Transfers {
+		if slices.Contains(send, i) {
+			d.claims = append(d.claims, i)
+			d.outcomes[i] = pending
+			continue
+		}
+		if o, ok := finished(saved[p.cfg.Transfers[i].Name]); ok {
+			d.claims = append(d.claims, i)
+			d.outcomes[i] = o
+			if o == failed {
+				d.err = errFailedBeforeRestart
+			}
+		}
+	}
+	p.mu.Lock()
+	p.deliveries[j.Path] = d
+	p.mu.Unlock()
+
+	if len(d.claims) > 1 {
+		slog.Info("File claimed by several transfers", "file", j.Path, "transfers", p.names(d.claims))
+	}
+	if len(send) < len(d.claims) {
+		slog.Info("Sending file only to the transfers that hadn't finished with it", "file", j.Path, "transfers", p.names(send))
+	}
+	for _, i := range send {
+		p.workers[i].push(task{d: d, transfer: i, attempt: j.Attempt})
+	}
+	return true
+}
+
+func (p *processor) names(claims []int) []string {
+	names := make([]string, len(claims))
+	for n, i := range claims {
+		names[n] = p.cfg.Transfers[i].Name
+	}
+	return names
+}
+
+// restore returns the delivery of a file, rebuilding it from the outcomes in
+// the journal if it has been forgotten (the agent was restarted). Transfers
+// with a retry of their own are still deferred, and any the journal has
+// nothing on finished with the file before it kept each transfer's outcome, so
+// are taken as having sent it. The file carries on with the job ID it had.
+
+func (p *processor) restore(file, id string, detected time.Time) *delivery {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if d, ok := p.deliveries[file]; ok {
+		return d
+	}
+
+	claims := p.claims(file)
+	j := job.New(file)
+	if id != "" {
+		j.ID = id
+	}
+	if !detected.IsZero() {
+		j.Detected = detected
+	}
+	for _, i := range claims {
+		j.Claim(p.cfg.Transfers[i].Name, p.cfg.Transfers[i].RelativePath(file))
+	}
+	job.Track(&j)
+
+	d := &delivery{job: j, claims: claims, outcomes: make(map[int]outcome, len(claims))}
+	saved := p.journal.Transfers(file)
+	for _, i := range claims {
+		name := p.cfg.Transfers[i].Name
+		o, ok := finished(saved[name])
+		if _, retrying := p.retries.Get(file, name); retrying {
+			o = deferred
+		} else if !ok {
+			o = sent
+		}
+		d.outcomes[i] = o
+		if o == failed {
+			d.err = errFailedBeforeRestart
+		}
+	}
+	p.deliveries[file] = d
+	return d
+}
+
+// redeliver hands a file back to one transfer for a deferred retry. The other
+// transfers in its delivery keep their outcomes.
+// It returns false if the transfer no longer claims the file.
+
+func (p *processor) redeliver(e retryqueue.Entry, transfer int) bool {
+	if !slices.Contains(p.claims(e.File), transfer) {
+		return false
+	}
+
+	d := p.restore(e.File, e.Job, e.FirstFailed)
+	d.set(transfer, pending, nil)
+	// The first attempt, then one for each deferred retry.
+	p.workers[transfer].push(task{d: d, transfer: transfer, attempt: e.Attempts + 2})
+	return true
+}
+
+// SettleJournal settles the files the journal has as finished with by every
+// transfer that claims them but not as a whole, because the agent stopped in
+// between. Each is settled from the journaled outcomes as if its last transfer
+// had just finished, so a file that was delivered still gets the success
+// action and isn't sent again. It is called at startup, before the journal is
+// replayed and the source directories are scanned. Files waiting for a
+// deferred retry are left to the processor.
+
+func SettleJournal(cfg *config.ConfigData, jrnl *journal.Journal) {
+	retries, _ := retryqueue.Open("")
+	p := &processor{
+		cfg:           cfg,
+		processingSet: selector.NewFileSelector(),
+		journal:       jrnl,
+		retries:       retries,
+		deliveries:    make(map[string]*delivery),
+	}
+
+	for _, r := range jrnl.Pending() {
+		if r.State == journal.Deferred || !p.finishedWith(r) {
+			continue
+		}
+		slog.Warn("File had been through every transfer when the agent stopped; settling it", "file", r.File, "transfers", r.Transfers)
+		p.finish(p.restore(r.File, r.Job, time.Time{}))
+	}
+}
+
+// finishedWith reports whether every transfer that claims a file in the
+// journal had sent it or failed it. Files no transfer claims any more are left
+// for the journal replay to fail.
+
+func (p *processor) finishedWith(r journal.Record) bool {
+	claims := p.claims(r.File)
+	if len(claims) == 0 {
+		return false
+	}
+	for _, i := range claims {
+		if o, ok := finished(r.Transfers[p.cfg.Transfers[i].Name]); !ok || o == deferred {
+			return false
+		}
+	}
+	return true
+}
+
+// settle is called when a transfer has finished with a file. Once every
+// transfer in the delivery has, the file is either left waiting for deferred
+// retries or finished with.
+
+func (p *processor) settle(t task, o outcome, err error) {
+	d := t.d
+	file := d.job.Path
+	p.journal.RecordTransfer(file, p.cfg.Transfers[t.transfer].Name, o.state(), err)
+	if !d.set(t.transfer, o, err) {
+		return
+	}
+	p.finish(d)
+}
+
+// finish settles a file once no transfer in its delivery is still sending it:
+// it is either left waiting for deferred retries or finished with.
+
+func (p *processor) finish(d *delivery) {
+	file := d.job.Path
+	nSent, nFailed, nDeferred, lastErr := d.count()
+	if nDeferred > 0 {
+		// Nothing happens to the file until the deferred retries are done.
+		p.journal.Record(file, journal.Deferred, lastErr)
+		p.processingSet.Delete(file)
+		slog.Info("Removed from processing set while waiting for deferred retry", "file", file)
+		return
+	}
+
+	p.mu.Lock()
+	if p.deliveries[file] == d {
+		delete(p.deliveries, file)
+	}
+	p.mu.Unlock()
+
+	// The first transfer that claims the file decides what happens to it.
+	primary := p.cfg.Transfers[d.claims[0]]
+	partial := nSent > 0 && nFailed > 0
+	policy := p.cfg.PartialFailurePolicy()
+	if partial {
+		slog.Warn("File was only sent by some of its transfers",
+			"file", file, "sent", nSent, "failed", nFailed, "partial_failure", policy)
+	}
+
+	switch {
+	case nFailed == 0 || (partial && policy == "success"):
+		// Recorded before the success action, so a restart part way through
+		// never sends the file a second time.
+		p.journal.Record(file, journal.Done, nil)
+		// On success → success action
+		if aerr := ActionOnSuccess(primary, file); aerr != nil {
+			slog.Warn("ActionOnSuccess error", "file", file, "error", aerr)
+		}
+
+	case partial && policy == "keep":
+		p.journal.Record(file, journal.Failed, fmt.Errorf("sent by %d of %d transfers: %w", nSent, nSent+nFailed, lastErr))
+		slog.Warn("Leaving partly sent file in place", "file", file)
+
+	default:
+		p.journal.Record(file, journal.Failed, lastErr)
+		// On error → fail action
+		if aerr := ActionOnFail(primary, file); aerr != nil {
+			slog.Warn("ActionOnFail error", "file", file, "error", aerr)
+		}
+	}
+
+	p.processingSet.Delete(file)
+	slog.Info("Removed from processing set", "file", file)
+	job.Finish(d.job)
+}
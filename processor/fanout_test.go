@@ -0,0 +1,326 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+	"github.com/justin-molloy/tfagent/journal"
+	"github.com/justin-molloy/tfagent/tracker"
+)
+
+// fanOutConfig has two local transfers watching the same directory. The
+// second one's destination can be made to fail by not creating it.
+
+func fanOutConfig(src, dest1, dest2 string) *config.ConfigData {
+	return &config.ConfigData{
+		Transfers: []config.ConfigEntry{
+			{Name: "partner", SourceDirectory: src, RemotePath: dest1, TransferType: "local", ActionOnSuccess: "archive", ActionOnFail: "archive"},
+			{Name: "internal", SourceDirectory: src, RemotePath: dest2, TransferType: "local"},
+		},
+	}
+}
+
+func runProcessor(t *testing.T, cfg *config.ConfigData, files ...string) {
+	t.Helper()
+	q := make(chan job.Job, len(files))
+	for _, f := range files {
+		q <- job.New(f)
+	}
+	close(q)
+
+	done := make(chan struct{})
+	go func() {
+		StartProcessor(t.Context(), cfg, q, newProcessingSet(t), nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("processor did not return")
+	}
+}
+
+func TestStartProcessor_FansOutToEveryTransfer(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	dest1, dest2 := t.TempDir(), t.TempDir()
+	file := mustWriteTempFile(t, src, "data.csv", "x")
+
+	runProcessor(t, fanOutConfig(src, dest1, dest2), file)
+
+	for _, dest := range []string{dest1, dest2} {
+		if _, err := os.Stat(filepath.Join(dest, "data.csv")); err != nil {
+			t.Errorf("expected file in %s: %v", dest, err)
+		}
+	}
+	// Archived once, by the first transfer, after both had sent it.
+	if _, err := os.Stat(filepath.Join(src, "archive", "data.csv")); err != nil {
+		t.Fatalf("expected file archived: %v", err)
+	}
+}
+
+func TestStartProcessor_PartialFailurePolicy(t *testing.T) {
+	tests := []struct {
+		policy   string
+		wantPath string // where the source file should end up, relative to src
+	}{
+		{policy: "", wantPath: "fail/data.csv"},
+		{policy: "fail", wantPath: "fail/data.csv"},
+		{policy: "success", wantPath: "archive/data.csv"},
+		{policy: "keep", wantPath: "data.csv"},
+	}
+
+	for _, tt := range tests {
+		t.Run("policy "+tt.policy, func(t *testing.T) {
+			tmp := t.TempDir()
+			src := filepath.Join(tmp, "src")
+			file := mustWriteTempFile(t, src, "data.csv", "x")
+
+			cfg := fanOutConfig(src, t.TempDir(), filepath.Join(tmp, "missing"))
+			cfg.PartialFailure = tt.policy
+			runProcessor(t, cfg, file)
+
+			if _, err := os.Stat(filepath.Join(src, filepath.FromSlash(tt.wantPath))); err != nil {
+				t.Fatalf("expected source file at %s: %v", tt.wantPath, err)
+			}
+		})
+	}
+}
+
+func TestStartProcessor_SourceDirectoryPrefixIsNotAMatch(t *testing.T) {
+	tmp := t.TempDir()
+	data := filepath.Join(tmp, "data")
+	data2 := filepath.Join(tmp, "data2")
+	dest1, dest2 := t.TempDir(), t.TempDir()
+	file := mustWriteTempFile(t, data2, "x.txt", "x")
+
+	cfg := &config.ConfigData{
+		Transfers: []config.ConfigEntry{
+			{Name: "data", SourceDirectory: data, RemotePath: dest1, TransferType: "local"},
+			{Name: "data2", SourceDirectory: data2, RemotePath: dest2, TransferType: "local"},
+		},
+	}
+	runProcessor(t, cfg, file)
+
+	if _, err := os.Stat(filepath.Join(dest1, "x.txt")); !os.IsNotExist(err) {
+		t.Fatalf("file in %s must not go to the %s transfer", data2, data)
+	}
+	if _, err := os.Stat(filepath.Join(dest2, "x.txt")); err != nil {
+		t.Fatalf("expected file sent by the data2 transfer: %v", err)
+	}
+}
+
+func TestStartProcessor_SendsToTheJobsTransfers(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	dest1, dest2 := t.TempDir(), t.TempDir()
+	file := mustWriteTempFile(t, src, "data.csv", "x")
+
+	// Both transfers would match, but the job was only claimed by the second.
+	j := job.New(file)
+	j.Transfers = []string{"internal"}
+
+	q := make(chan job.Job, 1)
+	q <- j
+	close(q)
+	StartProcessor(t.Context(), fanOutConfig(src, dest1, dest2), q, newProcessingSet(t), nil)
+
+	if _, err := os.Stat(filepath.Join(dest1, "data.csv")); !os.IsNotExist(err) {
+		t.Fatalf("file must only go to the transfers the job names")
+	}
+	if _, err := os.Stat(filepath.Join(dest2, "data.csv")); err != nil {
+		t.Fatalf("expected file sent by the internal transfer: %v", err)
+	}
+}
+
+func TestStartProcessor_ReplayedJobKeepsFinishedOutcomes(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	dest1, dest2 := t.TempDir(), t.TempDir()
+	file := mustWriteTempFile(t, src, "data.csv", "x")
+
+	// Before the restart partner failed for good, and internal hadn't finished.
+	jrnl := openJournal(t, tmp)
+	jrnl.RecordTransfer(file, "partner", journal.Failed, errors.New("boom"))
+	jrnl.RecordTransfer(file, "internal", journal.Sending, nil)
+
+	j := job.New(file)
+	j.Transfers = []string{"internal"}
+	q := make(chan job.Job, 1)
+	q <- j
+	close(q)
+	StartProcessor(t.Context(), fanOutConfig(src, dest1, dest2), q, newProcessingSet(t), jrnl)
+
+	if _, err := os.Stat(filepath.Join(dest1, "data.csv")); !os.IsNotExist(err) {
+		t.Fatal("file must not be sent again to a transfer that had finished with it")
+	}
+	if _, err := os.Stat(filepath.Join(dest2, "data.csv")); err != nil {
+		t.Fatalf("expected file sent by the internal transfer: %v", err)
+	}
+	// partner's failure still counts, so the partial failure fails the file.
+	if _, err := os.Stat(filepath.Join(src, "fail", "data.csv")); err != nil {
+		t.Fatalf("expected the fail action to run: %v", err)
+	}
+	if _, ok := jrnl.State(file); ok {
+		t.Error("expected the file finished with in the journal")
+	}
+}
+
+func TestStartProcessor_FanOutWaitsForDeferredRetry(t *testing.T) {
+	fastRetryChecks(t)
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	dest1 := t.TempDir()
+	dest2 := filepath.Join(tmp, "later") // doesn't exist yet, so the copy is deferred
+	file := mustWriteTempFile(t, src, "data.csv", "x")
+
+	cfg := fanOutConfig(src, dest1, dest2)
+	cfg.DataDir = t.TempDir()
+	cfg.Transfers[1].DeferredRetry = config.DeferredRetryConfig{
+		Enabled: true, Schedule: []time.Duration{50 * time.Millisecond}, MaxAttempts: 100,
+	}
+
+	q := make(chan job.Job, 1)
+	done := make(chan struct{})
+	go func() {
+		StartProcessor(t.Context(), cfg, q, newProcessingSet(t), nil)
+		close(done)
+	}()
+	q <- job.New(file)
+
+	waitFor(t, "the second transfer to be deferred", func() bool { return len(savedRetries(t, cfg.DataDir)) == 1 })
+	if _, err := os.Stat(filepath.Join(dest1, "data.csv")); err != nil {
+		t.Fatalf("expected the first transfer to have sent the file: %v", err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("the file must stay in place until every transfer is done: %v", err)
+	}
+
+	if err := os.Mkdir(dest2, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	waitFor(t, "the file to be archived", func() bool {
+		_, err := os.Stat(filepath.Join(src, "archive", "data.csv"))
+		return err == nil
+	})
+	if _, err := os.Stat(filepath.Join(dest2, "data.csv")); err != nil {
+		t.Fatalf("expected the deferred retry to have sent the file: %v", err)
+	}
+
+	close(q)
+	<-done
+}
+
+func TestStartProcessor_DeferredRetryAfterRestartKeepsFailures(t *testing.T) {
+	fastRetryChecks(t)
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	dest1 := filepath.Join(tmp, "gone")  // never there, so partner fails for good
+	dest2 := filepath.Join(tmp, "later") // not there yet, so internal is deferred
+	file := mustWriteTempFile(t, src, "data.csv", "x")
+
+	cfg := fanOutConfig(src, dest1, dest2)
+	cfg.DataDir = t.TempDir()
+	cfg.Transfers[1].DeferredRetry = config.DeferredRetryConfig{
+		Enabled: true, Schedule: []time.Duration{50 * time.Millisecond}, MaxAttempts: 100,
+	}
+
+	jrnl := openJournal(t, cfg.DataDir)
+	ctx, cancel := context.WithCancel(t.Context())
+	q := make(chan job.Job, 1)
+	done := make(chan struct{})
+	go func() {
+		StartProcessor(ctx, cfg, q, newProcessingSet(t), jrnl)
+		close(done)
+	}()
+	q <- job.New(file)
+	waitFor(t, "the file to be deferred", func() bool {
+		state, _ := jrnl.State(file)
+		return state == journal.Deferred
+	})
+	cancel()
+	<-done
+	jrnl.Close()
+
+	// The agent restarts, and internal's retry now succeeds.
+	if err := os.Mkdir(dest2, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	jrnl = openJournal(t, cfg.DataDir)
+	q = make(chan job.Job)
+	done = make(chan struct{})
+	go func() {
+		StartProcessor(t.Context(), cfg, q, newProcessingSet(t), jrnl)
+		close(done)
+	}()
+	waitFor(t, "the file to be finished with", func() bool {
+		_, ok := jrnl.State(file)
+		return !ok
+	})
+	close(q)
+	<-done
+
+	if _, err := os.Stat(filepath.Join(dest2, "data.csv")); err != nil {
+		t.Fatalf("expected the deferred retry to have sent the file: %v", err)
+	}
+	// partner never got the file, so the partial failure fails it.
+	if _, err := os.Stat(filepath.Join(src, "fail", "data.csv")); err != nil {
+		t.Fatalf("expected the fail action to run: %v", err)
+	}
+}
+
+func TestSettleJournal(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	through := mustWriteTempFile(t, src, "through.csv", "x")
+	partly := mustWriteTempFile(t, src, "partly.csv", "x")
+	sending := mustWriteTempFile(t, src, "sending.csv", "x")
+
+	// The agent stopped after the transfers had finished with through.csv and
+	// partly.csv, but before either was settled.
+	jrnl := openJournal(t, tmp)
+	jrnl.RecordTransfer(through, "partner", journal.Done, nil)
+	jrnl.RecordTransfer(through, "internal", journal.Done, nil)
+	jrnl.RecordTransfer(partly, "partner", journal.Done, nil)
+	jrnl.RecordTransfer(partly, "internal", journal.Failed, errors.New("boom"))
+	jrnl.RecordTransfer(sending, "partner", journal.Done, nil)
+	jrnl.RecordTransfer(sending, "internal", journal.Sending, nil)
+
+	cfg := fanOutConfig(src, t.TempDir(), t.TempDir())
+	cfg.Transfers[0].ScanOnStart = true
+	SettleJournal(cfg, jrnl)
+
+	if _, err := os.Stat(filepath.Join(src, "archive", "through.csv")); err != nil {
+		t.Fatalf("expected the success action to run on the delivered file: %v", err)
+	}
+	if _, ok := jrnl.State(through); ok {
+		t.Error("expected through.csv recorded as done")
+	}
+	if _, err := os.Stat(filepath.Join(src, "fail", "partly.csv")); err != nil {
+		t.Fatalf("expected the partial failure to fail the file: %v", err)
+	}
+	if _, ok := jrnl.State(partly); ok {
+		t.Error("expected partly.csv recorded as failed")
+	}
+	if state, _ := jrnl.State(sending); state != journal.Sending {
+		t.Errorf("expected sending.csv left for the journal replay, got %q", state)
+	}
+
+	// Neither the replay nor the startup scan sends the settled files again.
+	et := tracker.NewEventTracker()
+	tracker.ReplayJournal(cfg, jrnl, et)
+	tracker.ScanSourceDirectory(cfg, cfg.Transfers[0], et, jrnl)
+	snapshot := et.GetSnapshot()
+	if len(snapshot) != 1 {
+		t.Fatalf("expected only sending.csv picked up again, got %v", snapshot)
+	}
+	if _, ok := snapshot[sending]; !ok {
+		t.Errorf("expected sending.csv replayed, got %v", snapshot)
+	}
+}
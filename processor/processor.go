@@ -1,77 +1,204 @@
 package processor
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+	"github.com/justin-molloy/tfagent/journal"
+	"github.com/justin-molloy/tfagent/retryqueue"
 	"github.com/justin-molloy/tfagent/selector"
 	"github.com/justin-molloy/tfagent/sendfile"
 )
 
+// StartProcessor takes jobs off the queue and hands each one to the worker of
+// every transfer it names. Every transfer has its own worker, so retries
+// against a slow or unreachable server only hold up that transfer's files.
+// Files waiting for a deferred retry are handed to the workers again when due.
+// It returns once the queue is closed and the workers have finished.
+//
+// When ctx is cancelled it stops taking files off the queue and starting new
+// uploads, and returns once the uploads in progress have finished, or the
+// shutdown grace period is over. Files that weren't sent are left as they are
+// in the journal and the deferred retry queue, to be picked up again at the
+// next start.
+
 func StartProcessor(
+	ctx context.Context,
 	cfg *config.ConfigData,
-	fileQueue <-chan string,
+	fileQueue <-chan job.Job,
 	processingSet *selector.FileSelector,
+	jrnl *journal.Journal,
 ) {
-	for file := range fileQueue {
-		slog.Info("Processing file from queue", "file", file)
-
-		matched := false
+	p := &processor{
+		cfg:           cfg,
+		processingSet: processingSet,
+		journal:       jrnl,
+		workers:       make([]*transferQueue, len(cfg.Transfers)),
+		retries:       openRetryQueue(cfg),
+		deliveries:    make(map[string]*delivery),
+	}
+	var wg sync.WaitGroup
 
-		// Use index form to avoid pointer-to-range-variable bug.
-		for i := range cfg.Transfers {
-			entry := cfg.Transfers[i]
-			if !strings.HasPrefix(file, entry.SourceDirectory) {
-				continue
+	// Use index form to avoid pointer-to-range-variable bug.
+	for i := range cfg.Transfers {
+		p.workers[i] = newTransferQueue()
+		wg.Add(1)
+		go func(entry config.ConfigEntry, q *transferQueue) {
+			defer wg.Done()
+			for {
+				t, ok := q.next()
+				if !ok {
+					return
+				}
+				p.inFlight.Add(1)
+				p.processFile(ctx, entry, t)
+				p.inFlight.Add(-1)
 			}
-			matched = true
-
-			var (
-				result string
-				err    error
-			)
-
-			switch entry.TransferType {
-			case "sftp":
-				// Prefer passing the entry by VALUE unless UploadSFTP needs to mutate it.
-				// If UploadSFTP wants a pointer, pass &cfg.Transfers[i] (not &entry).
-				result, err = sendfile.UploadSFTP(file, entry) // value
-				// result, err = sendfile.UploadSFTP(file, &cfg.Transfers[i]) // pointer version
-			case "local":
-				slog.Warn("Local transfer not implemented", "file", file)
-			case "scp":
-				slog.Warn("SCP transfer not implemented", "file", file)
-			default:
-				slog.Warn("Unsupported transfer type", "file", file, "type", entry.TransferType)
+		}(cfg.Transfers[i], p.workers[i])
+	}
+
+	stopRetries := make(chan struct{})
+	retriesDone := make(chan struct{})
+	go func() {
+		defer close(retriesDone)
+		p.runDeferredRetries(stopRetries)
+	}()
+
+queue:
+	for {
+		select {
+		case <-ctx.Done():
+			break queue
+
+		case j, ok := <-fileQueue:
+			if !ok {
+				break queue
 			}
+			slog.Info("Processing file from queue", "file", j.Path, "transfers", j.Transfers, "attempt", j.Attempt)
 
-			if err != nil {
-				slog.Error("Upload failed", "file", file, "error", err)
-				// On error → fail action
-				if aerr := ActionOnFail(entry, file); aerr != nil {
-					slog.Warn("ActionOnFail error", "file", file, "error", aerr)
-				}
-			} else {
-				slog.Info("Upload complete", "file", file, "result", result)
-				// On success → success action
-				if aerr := ActionOnSuccess(entry, file); aerr != nil {
-					slog.Warn("ActionOnSuccess error", "file", file, "error", aerr)
-				}
+			if !p.dispatch(j) {
+				slog.Warn("File did not match any transfer config", "file", j.Path)
+				p.journal.Record(j.Path, journal.Failed, errors.New("no matching transfer"))
+				job.Finish(j)
 			}
+		}
+	}
 
-			processingSet.Delete(file)
-			slog.Info("Removed from processing set", "file", file)
-			break
+	close(stopRetries)
+	<-retriesDone
+
+	if ctx.Err() == nil {
+		for _, q := range p.workers {
+			q.close()
 		}
+		wg.Wait()
+		return
+	}
+
+	workersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(workersDone)
+	}()
+	p.shutdown(len(fileQueue), workersDone)
+}
+
+// shutdown stops the workers once the agent is stopping: files that haven't
+// been started are left for the next start, and the uploads in progress get
+// until the end of the grace period to finish. One that doesn't is still
+// "sending" in the journal, so it's sent again at the next start.
 
-		if !matched {
-			slog.Warn("File did not match any transfer config", "file", file)
+func (p *processor) shutdown(queued int, workersDone <-chan struct{}) {
+	left := queued
+	for _, q := range p.workers {
+		for _, t := range q.abandon() {
+			slog.Info("Left queued for the next start", "file", t.d.job.Path, "transfer", p.cfg.Transfers[t.transfer].Name)
+			left++
 		}
 	}
+
+	grace := p.cfg.GracePeriod()
+	slog.Info("Waiting for uploads in progress to finish",
+		"in_flight", p.inFlight.Load(), "left_queued", left, "grace_period", grace)
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-workersDone:
+		slog.Info("Uploads in progress finished")
+	case <-timer.C:
+		p.abandoned.Store(true)
+		slog.Warn("Shutdown grace period is over; uploads still in progress will be sent again at the next start",
+			"in_flight", p.inFlight.Load())
+	}
+}
+
+type processor struct {
+	cfg           *config.ConfigData
+	processingSet *selector.FileSelector
+	workers       []*transferQueue // one per transfer, in the same order as cfg.Transfers
+	retries       *retryqueue.Queue
+	journal       *journal.Journal
+
+	mu         sync.Mutex
+	deliveries map[string]*delivery // by file, until every claiming transfer has finished
+
+	inFlight  atomic.Int64 // uploads the workers are part way through
+	abandoned atomic.Bool  // the shutdown grace period is over
+}
+
+// processFile sends one file for a transfer. A failure that can be retried
+// later is deferred instead of failing. What happens to the file afterwards is
+// up to settle, once every transfer that claims it is done. An upload
+// interrupted because the agent is stopping is neither: the journal still has
+// the file as sending, so it's sent again at the next start.
+
+func (p *processor) processFile(ctx context.Context, entry config.ConfigEntry, t task) {
+	var (
+		result string
+		err    error
+	)
+	file := t.d.job.Path
+
+	p.journal.RecordTransfer(file, entry.Name, journal.Sending, nil)
+
+	switch entry.Type() {
+	case "sftp":
+		result, err = sendfile.UploadSFTP(ctx, file, entry)
+	case "local":
+		result, err = sendfile.CopyLocal(ctx, file, entry)
+	case "scp":
+		result, err = sendfile.UploadSCP(ctx, file, entry)
+	default:
+		err = fmt.Errorf("unsupported transfer type %q", entry.TransferType)
+	}
+
+	switch {
+	case err == nil:
+		slog.Info("Upload complete", "file", file, "transfer", entry.Name, "path", t.d.job.RelPath[entry.Name], "attempt", t.attempt, "result", result)
+		p.clearRetry(file, entry.Name)
+		p.settle(t, sent, nil)
+	case errors.Is(err, context.Canceled), p.abandoned.Load():
+		// Once the grace period is over an upload can also fail because its
+		// connection was closed under it.
+		slog.Warn("Upload interrupted; it will be sent again at the next start", "file", file, "transfer", entry.Name, "attempt", t.attempt)
+	case p.deferRetry(entry, file, err):
+		slog.Error("Upload failed", "file", file, "transfer", entry.Name, "attempt", t.attempt, "permanent", false, "error", err)
+		p.settle(t, deferred, err)
+	default:
+		slog.Error("Upload failed", "file", file, "transfer", entry.Name, "attempt", t.attempt, "permanent", sendfile.IsPermanent(err), "error", err)
+		p.settle(t, failed, err)
+	}
 }
 
 func ActionOnSuccess(transfer config.ConfigEntry, file string) error {
@@ -83,11 +210,7 @@ func ActionOnSuccess(transfer config.ConfigEntry, file string) error {
 
 	switch strings.ToLower(strings.TrimSpace(transfer.ActionOnSuccess)) {
 	case "archive":
-		archiveDest := strings.TrimSpace(transfer.ArchiveDest)
-		if archiveDest == "" {
-			archiveDest = filepath.Join(transfer.SourceDirectory, "archive")
-			slog.Debug("No ArchiveDest specified, defaulting to", "path", archiveDest)
-		}
+		archiveDest := transfer.ArchiveDirectory()
 
 		// Ensure archive directory exists (try configured; fall back to source/archive)
 		if err := os.MkdirAll(archiveDest, 0o755); err != nil {
@@ -100,6 +223,16 @@ func ActionOnSuccess(transfer config.ConfigEntry, file string) error {
 			}
 		}
 
+		// Files from a recursive transfer keep their subdirectory, so files with
+		// the same name from different directories don't overwrite each other.
+		if sub := transfer.RelativeDir(file); sub != "" {
+			archiveDest = filepath.Join(archiveDest, filepath.FromSlash(sub))
+			if err := os.MkdirAll(archiveDest, 0o755); err != nil {
+				slog.Error("Failed to create archive subdirectory", "path", archiveDest, "error", err)
+				return err
+			}
+		}
+
 		destPath := filepath.Join(archiveDest, filepath.Base(file))
 		if err := os.Rename(file, destPath); err != nil {
 			slog.Error("Failed to move file to archive", "file", file, "dest", destPath, "error", err)
@@ -139,11 +272,7 @@ func ActionOnFail(transfer config.ConfigEntry, file string) error {
 
 	switch strings.ToLower(strings.TrimSpace(transfer.ActionOnFail)) {
 	case "archive":
-		failDest := strings.TrimSpace(transfer.FailDest)
-		if failDest == "" {
-			failDest = filepath.Join(transfer.SourceDirectory, "fail")
-			slog.Debug("No ArchiveDest specified, defaulting to", "path", failDest)
-		}
+		failDest := transfer.FailDirectory()
 
 		// Ensure fail directory exists (try configured; fall back to source/fail)
 		if err := os.MkdirAll(failDest, 0o755); err != nil {
@@ -156,6 +285,16 @@ func ActionOnFail(transfer config.ConfigEntry, file string) error {
 			}
 		}
 
+		// Files from a recursive transfer keep their subdirectory, so files with
+		// the same name from different directories don't overwrite each other.
+		if sub := transfer.RelativeDir(file); sub != "" {
+			failDest = filepath.Join(failDest, filepath.FromSlash(sub))
+			if err := os.MkdirAll(failDest, 0o755); err != nil {
+				slog.Error("Failed to create fail subdirectory", "path", failDest, "error", err)
+				return err
+			}
+		}
+
 		destPath := filepath.Join(failDest, filepath.Base(file))
 		if err := os.Rename(file, destPath); err != nil {
 			slog.Error("Failed to move file to fail", "file", file, "dest", destPath, "error", err)
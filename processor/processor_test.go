@@ -1,6 +1,8 @@
 package processor
 
 import (
+	"context"
+	"net"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -8,6 +10,8 @@ import (
 	"time"
 
 	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+	"github.com/justin-molloy/tfagent/journal"
 	"github.com/justin-molloy/tfagent/selector"
 )
 
@@ -109,6 +113,28 @@ func TestActionOnSuccess_Archive_ConfiguredDest(t *testing.T) {
 	}
 }
 
+func TestActionOnSuccess_Archive_RecursiveKeepsSubdirectory(t *testing.T) {
+	tmp := t.TempDir()
+	dst := filepath.Join(tmp, "custom-arc")
+	src := mustWriteTempFile(t, filepath.Join(tmp, "2024", "03"), "e.txt", "data")
+
+	entry := config.ConfigEntry{
+		Name:            "archive-recursive",
+		SourceDirectory: tmp,
+		Recursive:       true,
+		ActionOnSuccess: "archive",
+		ArchiveDest:     dst,
+	}
+
+	if err := ActionOnSuccess(entry, src); err != nil {
+		t.Fatalf("archive recursive failed: %v", err)
+	}
+	dest := filepath.Join(dst, "2024", "03", "e.txt")
+	if _, err := os.Stat(dest); err != nil {
+		t.Fatalf("expected archived file at %s: %v", dest, err)
+	}
+}
+
 func TestActionOnSuccess_Archive_FallbackWhenConfiguredMkdirFails(t *testing.T) {
 	tmp := t.TempDir()
 	src := mustWriteTempFile(t, tmp, "f.txt", "data")
@@ -175,6 +201,7 @@ func newProcessingSet(t *testing.T) *selector.FileSelector {
 
 func TestStartProcessor_Success_Local_Delete(t *testing.T) {
 	tmp := t.TempDir()
+	dest := t.TempDir()
 	src := filepath.Join(tmp, "in.txt")
 	if err := os.WriteFile(src, []byte("x"), 0o644); err != nil {
 		t.Fatalf("write src: %v", err)
@@ -185,27 +212,101 @@ func TestStartProcessor_Success_Local_Delete(t *testing.T) {
 			{
 				Name:            "t",
 				SourceDirectory: tmp,
+				RemotePath:      dest,
 				TransferType:    "local",  // will not call SFTP
 				ActionOnSuccess: "delete", // exercises success action
 			},
 		},
 	}
 
-	q := make(chan string, 1)
-	q <- src
+	q := make(chan job.Job, 1)
+	q <- job.New(src)
 	close(q)
 
 	ps := newProcessingSet(t)
 
 	// Run synchronously; StartProcessor returns when channel closes.
-	StartProcessor(cfg, q, ps)
+	StartProcessor(t.Context(), cfg, q, ps, nil)
 
-	// File should have been deleted by ActionOnSuccess.
+	// File should have been copied to the destination...
+	if got, err := os.ReadFile(filepath.Join(dest, "in.txt")); err != nil || string(got) != "x" {
+		t.Fatalf("expected copied file in destination, got %q err=%v", got, err)
+	}
+
+	// ...and then deleted by ActionOnSuccess.
 	if _, err := os.Stat(src); !os.IsNotExist(err) {
 		t.Fatalf("expected deleted file, got err=%v", err)
 	}
 }
 
+func TestStartProcessor_TransferTypeCase(t *testing.T) {
+	tmp := t.TempDir()
+	dest := t.TempDir()
+	src := mustWriteTempFile(t, tmp, "in.txt", "x")
+
+	cfg := &config.ConfigData{
+		Transfers: []config.ConfigEntry{
+			{Name: "t", SourceDirectory: tmp, RemotePath: dest, TransferType: " Local ", ActionOnSuccess: "delete"},
+		},
+	}
+	runProcessor(t, cfg, src)
+
+	if got, err := os.ReadFile(filepath.Join(dest, "in.txt")); err != nil || string(got) != "x" {
+		t.Fatalf("expected copied file in destination, got %q err=%v", got, err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("expected deleted file, got err=%v", err)
+	}
+}
+
+func TestStartProcessor_UnsupportedTransferTypeFails(t *testing.T) {
+	tmp := t.TempDir()
+	src := mustWriteTempFile(t, tmp, "in.txt", "x")
+
+	cfg := &config.ConfigData{
+		Transfers: []config.ConfigEntry{
+			{Name: "t", SourceDirectory: tmp, RemotePath: t.TempDir(), TransferType: "ftp", ActionOnSuccess: "delete", ActionOnFail: "archive"},
+		},
+	}
+	runProcessor(t, cfg, src)
+
+	if _, err := os.Stat(filepath.Join(tmp, "fail", "in.txt")); err != nil {
+		t.Fatalf("expected the fail action to run: %v", err)
+	}
+}
+
+func TestStartProcessor_Failure_Local_FailAction(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "in.txt")
+	if err := os.WriteFile(src, []byte("x"), 0o644); err != nil {
+		t.Fatalf("write src: %v", err)
+	}
+
+	cfg := &config.ConfigData{
+		Transfers: []config.ConfigEntry{
+			{
+				Name:            "t",
+				SourceDirectory: tmp,
+				RemotePath:      filepath.Join(tmp, "missing-dest"), // copy will fail
+				TransferType:    "local",
+				ActionOnSuccess: "delete",
+				ActionOnFail:    "archive",
+			},
+		},
+	}
+
+	q := make(chan job.Job, 1)
+	q <- job.New(src)
+	close(q)
+
+	StartProcessor(t.Context(), cfg, q, newProcessingSet(t), nil)
+
+	// A failed copy must not run the success action; the file goes to fail instead.
+	if _, err := os.Stat(filepath.Join(tmp, "fail", "in.txt")); err != nil {
+		t.Fatalf("expected file moved to fail directory: %v", err)
+	}
+}
+
 func TestStartProcessor_UnmatchedFile_Returns(t *testing.T) {
 	tmp := t.TempDir()
 	other := filepath.Join(tmp, "outside.txt")
@@ -223,15 +324,15 @@ func TestStartProcessor_UnmatchedFile_Returns(t *testing.T) {
 		},
 	}
 
-	q := make(chan string, 1)
-	q <- other
+	q := make(chan job.Job, 1)
+	q <- job.New(other)
 	close(q)
 
 	ps := newProcessingSet(t)
 
 	done := make(chan struct{})
 	go func() {
-		StartProcessor(cfg, q, ps)
+		StartProcessor(t.Context(), cfg, q, ps, nil)
 		close(done)
 	}()
 
@@ -389,3 +490,252 @@ func TestActionOnFail_Archive_RenameFailure(t *testing.T) {
 		t.Fatalf("expected source to remain after failure: %v", statErr)
 	}
 }
+
+func TestStartProcessor_SlowTransferDoesNotBlockOthers(t *testing.T) {
+	tmp := t.TempDir()
+	sftpSrc := filepath.Join(tmp, "sftp")
+	localSrc := filepath.Join(tmp, "local")
+	dest := t.TempDir()
+
+	// Every sftp attempt fails and is retried, holding up that transfer.
+	cfg := &config.ConfigData{
+		Transfers: []config.ConfigEntry{
+			retryingTransfer(t, sftpSrc, time.Second),
+			{
+				Name:            "local",
+				SourceDirectory: localSrc,
+				RemotePath:      dest,
+				TransferType:    "local",
+			},
+		},
+	}
+
+	q := make(chan job.Job, 2)
+	q <- job.New(mustWriteTempFile(t, sftpSrc, "a.txt", "a"))
+	q <- job.New(mustWriteTempFile(t, localSrc, "b.txt", "b"))
+	close(q)
+
+	done := make(chan struct{})
+	go func() {
+		StartProcessor(t.Context(), cfg, q, newProcessingSet(t), nil)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(dest, "b.txt")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("local transfer was held up behind the failing sftp transfer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("expected the sftp transfer to still be retrying")
+	default:
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("processor did not return")
+	}
+}
+
+func TestStartProcessor_Journal(t *testing.T) {
+	tmp := t.TempDir()
+	dest := t.TempDir()
+	ok := mustWriteTempFile(t, filepath.Join(tmp, "src"), "ok.txt", "x")
+
+	cfg := &config.ConfigData{
+		Transfers: []config.ConfigEntry{
+			{Name: "t", SourceDirectory: filepath.Join(tmp, "src"), RemotePath: dest, TransferType: "local"},
+		},
+	}
+
+	jrnl, err := journal.Open(filepath.Join(tmp, "journal.jsonl"))
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	defer jrnl.Close()
+
+	unmatched := filepath.Join(tmp, "elsewhere", "x.txt")
+	jrnl.Record(ok, journal.Queued, nil)
+	jrnl.Record(unmatched, journal.Queued, nil)
+
+	q := make(chan job.Job, 2)
+	q <- job.New(ok)
+	q <- job.New(unmatched)
+	close(q)
+	StartProcessor(t.Context(), cfg, q, newProcessingSet(t), jrnl)
+
+	if pending := jrnl.Pending(); len(pending) != 0 {
+		t.Fatalf("expected every file finished in the journal, got %+v", pending)
+	}
+}
+
+// retryingTransfer is an sftp transfer to a port nothing is listening on, so an
+// upload spends a while retrying before it fails.
+func retryingTransfer(t *testing.T, src string, initialDelay time.Duration) config.ConfigEntry {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	_, deadPort, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+
+	return config.ConfigEntry{
+		Name:            "dead-server",
+		SourceDirectory: src,
+		TransferType:    "sftp",
+		Username:        "user",
+		Password:        "secret",
+		Server:          "127.0.0.1",
+		Port:            deadPort,
+		HostKeyCheck:    "tofu",
+		KnownHosts:      filepath.Join(t.TempDir(), "known_hosts"),
+		Retry:           config.RetryConfig{Attempts: 3, InitialDelay: initialDelay},
+	}
+}
+
+// stallingTransfer is an sftp transfer to a server that accepts the connection
+// and says nothing for stall before hanging up, so a single upload attempt
+// takes that long and then fails.
+func stallingTransfer(t *testing.T, src string, stall time.Duration) config.ConfigEntry {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			time.AfterFunc(stall, func() { conn.Close() })
+		}
+	}()
+
+	tf := retryingTransfer(t, src, time.Second)
+	tf.Name = "stalling-server"
+	_, tf.Port, _ = net.SplitHostPort(ln.Addr().String())
+	tf.Retry.Attempts = 1
+	return tf
+}
+
+// stopProcessor runs the processor over the files, cancels it once the first
+// one is being sent and returns how long it took to return after that.
+func stopProcessor(t *testing.T, cfg *config.ConfigData, jrnl *journal.Journal, files ...string) time.Duration {
+	t.Helper()
+	q := make(chan job.Job, len(files))
+	for _, f := range files {
+		jrnl.Record(f, journal.Queued, nil)
+		q <- job.New(f)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		StartProcessor(ctx, cfg, q, newProcessingSet(t), jrnl)
+		close(done)
+	}()
+
+	waitFor(t, "the first upload to start", func() bool {
+		s, _ := jrnl.State(files[0])
+		return s == journal.Sending
+	})
+	// Let the attempt get going.
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	stopped := time.Now()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("processor did not return after its context was cancelled")
+	}
+	return time.Since(stopped)
+}
+
+func openJournal(t *testing.T, dir string) *journal.Journal {
+	t.Helper()
+	jrnl, err := journal.Open(filepath.Join(dir, "journal.jsonl"))
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	t.Cleanup(func() { jrnl.Close() })
+	return jrnl
+}
+
+func TestStartProcessor_StopWaitsForUploadInProgress(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	cfg := &config.ConfigData{
+		ShutdownGracePeriod: 10 * time.Second,
+		Transfers:           []config.ConfigEntry{stallingTransfer(t, src, 500*time.Millisecond)},
+	}
+	jrnl := openJournal(t, tmp)
+
+	first := mustWriteTempFile(t, src, "first.txt", "1")
+	second := mustWriteTempFile(t, src, "second.txt", "2")
+	if took := stopProcessor(t, cfg, jrnl, first, second); took < 200*time.Millisecond {
+		t.Errorf("expected the processor to wait for the upload in progress, returned after %v", took)
+	}
+
+	// The upload in progress ran to the end; the file behind it wasn't started.
+	if s, ok := jrnl.State(first); ok {
+		t.Errorf("expected the upload in progress to finish, got state %q", s)
+	}
+	if s, _ := jrnl.State(second); s != journal.Queued {
+		t.Errorf("expected the second file left queued for the next start, got %q", s)
+	}
+}
+
+func TestStartProcessor_StopGivesUpAfterGracePeriod(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	cfg := &config.ConfigData{
+		ShutdownGracePeriod: 100 * time.Millisecond,
+		Transfers:           []config.ConfigEntry{stallingTransfer(t, src, 10*time.Second)},
+	}
+	jrnl := openJournal(t, tmp)
+
+	file := mustWriteTempFile(t, src, "slow.txt", "x")
+	if took := stopProcessor(t, cfg, jrnl, file); took > time.Second {
+		t.Errorf("expected the processor to give up after the grace period, returned after %v", took)
+	}
+	if s, _ := jrnl.State(file); s != journal.Sending {
+		t.Errorf("expected the unfinished upload to be sent again at the next start, got %q", s)
+	}
+}
+
+func TestStartProcessor_StopInterruptsRetryBackoff(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	tf := retryingTransfer(t, src, time.Minute)
+	tf.ActionOnFail = "archive"
+	cfg := &config.ConfigData{
+		ShutdownGracePeriod: 10 * time.Second,
+		Transfers:           []config.ConfigEntry{tf},
+	}
+	jrnl := openJournal(t, tmp)
+
+	file := mustWriteTempFile(t, src, "retrying.txt", "x")
+	if took := stopProcessor(t, cfg, jrnl, file); took > time.Second {
+		t.Errorf("expected the retry backoff to be cut short, returned after %v", took)
+	}
+
+	// Neither failed nor moved: it's sent again at the next start.
+	if s, _ := jrnl.State(file); s != journal.Sending {
+		t.Errorf("expected the interrupted upload to still be sending, got %q", s)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("expected the file left in place, got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package processor
+
+import "sync"
+
+// transferQueue is an unbounded FIFO of files waiting for one transfer's worker.
+// It never blocks the sender, so the dispatcher can't be held up by a transfer
+// whose worker is busy retrying.
+
+type transferQueue struct {
+	mu     sync.Mutex
+	tasks  []task
+	closed bool
+	ready  chan struct{} // signalled when files are added or the queue is closed
+}
+
+func newTransferQueue() *transferQueue {
+	return &transferQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *transferQueue) push(t task) {
+	q.mu.Lock()
+	q.tasks = append(q.tasks, t)
+	q.mu.Unlock()
+	q.signal()
+}
+
+// close lets the worker finish what's queued and then stop.
+
+func (q *transferQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+// abandon closes the queue and takes back the files that haven't been started,
+// so the worker stops once it's finished the one it's on.
+
+func (q *transferQueue) abandon() []task {
+	q.mu.Lock()
+	left := q.tasks
+	q.tasks = nil
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+	return left
+}
+
+// next waits for the next file. It returns false once the queue is closed and empty.
+
+func (q *transferQueue) next() (task, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.tasks) > 0 {
+			t := q.tasks[0]
+			q.tasks = q.tasks[1:]
+			q.mu.Unlock()
+			return t, true
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return task{}, false
+		}
+		q.mu.Unlock()
+		<-q.ready
+	}
+}
+
+func (q *transferQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,202 @@
+package retryqueue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a file waiting for a deferred retry on one transfer - one that still
+// failed after the transfer's retry policy was used up. A file sent to several
+// transfers can have an entry for each.
+
+type Entry struct {
+	File        string    `json:"file"`
+	Transfer    string    `json:"transfer"`      // name of the transfer to retry it on
+	Job         string    `json:"job,omitempty"` // ID of the file's job, so its log lines can still be followed
+	FirstFailed time.Time `json:"first_failed"`  // when the file was first deferred
+	Attempts    int       `json:"attempts"`      // failed deferred attempts so far
+	NextRetry   time.Time `json:"next_retry"`
+	LastError   string    `json:"last_error"`
+}
+
+// Queue holds the files waiting for a deferred retry. It is saved to a JSON file
+// in the data directory after every change so pending retries survive a restart.
+// A Queue with no path is kept in memory only.
+
+type Queue struct {
+	mu         sync.Mutex
+	path       string
+	entries    map[string]*Entry // by key(file, transfer)
+	dispatched map[string]bool   // handed out by Due and not yet Put or Removed
+}
+
+func key(file, transfer string) string {
+	return transfer + "\x00" + file
+}
+
+// Open loads the queue saved at path, or starts an empty one if there isn't one yet.
+
+func Open(path string) (*Queue, error) {
+	q := &Queue{
+		path:       path,
+		entries:    make(map[string]*Entry),
+		dispatched: make(map[string]bool),
+	}
+	if path == "" {
+		return q, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read retry queue: %w", err)
+	}
+
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("unable to parse retry queue %s: %w", path, err)
+	}
+	for i := range entries {
+		q.entries[key(entries[i].File, entries[i].Transfer)] = &entries[i]
+	}
+	return q, nil
+}
+
+// Get returns the pending entry for a file on a transfer, if there is one.
+
+func (q *Queue) Get(file, transfer string) (Entry, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.entries[key(file, transfer)]
+	if !ok {
+		return Entry{}, false
+	}
+	return *e, true
+}
+
+// Put adds or replaces the entry for a file on a transfer and saves the queue.
+
+func (q *Queue) Put(e Entry) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	k := key(e.File, e.Transfer)
+	q.entries[k] = &e
+	delete(q.dispatched, k)
+	return q.save()
+}
+
+// Remove drops a file's entry for a transfer, eg. once it has been sent. It does
+// nothing if there isn't one.
+
+func (q *Queue) Remove(file, transfer string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	k := key(file, transfer)
+	if _, ok := q.entries[k]; !ok {
+		return nil
+	}
+	delete(q.entries, k)
+	delete(q.dispatched, k)
+	return q.save()
+}
+
+// Due returns the entries whose retry time has come. Each entry is only returned
+// once until it is Put back (after another failure) or Removed.
+
+func (q *Queue) Due(now time.Time) []Entry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var due []Entry
+	for k, e := range q.entries {
+		if q.dispatched[k] || e.NextRetry.After(now) {
+			continue
+		}
+		q.dispatched[k] = true
+		due = append(due, *e)
+	}
+	sortByNextRetry(due)
+	return due
+}
+
+// List returns every pending entry, soonest retry first.
+
+func (q *Queue) List() []Entry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	list := make([]Entry, 0, len(q.entries))
+	for _, e := range q.entries {
+		list = append(list, *e)
+	}
+	sortByNextRetry(list)
+	return list
+}
+
+// save writes the queue to a temporary file, syncs it and renames it over the
+// old one, so a crash part way through never leaves a truncated queue behind.
+
+func (q *Queue) save() error {
+	if q.path == "" {
+		return nil
+	}
+
+	list := make([]Entry, 0, len(q.entries))
+	for _, e := range q.entries {
+		list = append(list, *e)
+	}
+	sortByNextRetry(list)
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode retry queue: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(q.path), 0o755); err != nil {
+		return fmt.Errorf("unable to create retry queue directory: %w", err)
+	}
+	tmpPath := q.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to write retry queue: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write retry queue: %w", err)
+	}
+	// Synced before the rename, so a power cut can't leave an empty queue
+	// where the old one was.
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write retry queue: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write retry queue: %w", err)
+	}
+	if err := os.Rename(tmpPath, q.path); err != nil {
+		return fmt.Errorf("unable to save retry queue: %w", err)
+	}
+	return nil
+}
+
+func sortByNextRetry(entries []Entry) {
+	slices.SortFunc(entries, func(a, b Entry) int {
+		if c := a.NextRetry.Compare(b.NextRetry); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.File, b.File); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Transfer, b.Transfer)
+	})
+}
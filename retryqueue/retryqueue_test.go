@@ -0,0 +1,93 @@
+package retryqueue
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueue_PersistsAcrossOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "retries.json")
+	now := time.Now().Truncate(time.Second)
+
+	q, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := q.Put(Entry{File: "/in/a.txt", Transfer: "t", FirstFailed: now, NextRetry: now.Add(time.Minute)}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := q.Put(Entry{File: "/in/b.txt", Transfer: "t", FirstFailed: now, NextRetry: now.Add(time.Second)}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	list := reopened.List()
+	if len(list) != 2 || list[0].File != "/in/b.txt" || !list[1].NextRetry.Equal(now.Add(time.Minute)) {
+		t.Fatalf("unexpected entries after reopen: %+v", list)
+	}
+
+	if err := reopened.Remove("/in/a.txt", "t"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if again, _ := Open(path); len(again.List()) != 1 {
+		t.Fatalf("expected removal to be saved, got %+v", again.List())
+	}
+}
+
+func TestQueue_DueOnlyOnce(t *testing.T) {
+	q, _ := Open("")
+	now := time.Now()
+	q.Put(Entry{File: "due", NextRetry: now.Add(-time.Second)})
+	q.Put(Entry{File: "later", NextRetry: now.Add(time.Hour)})
+
+	due := q.Due(now)
+	if len(due) != 1 || due[0].File != "due" {
+		t.Fatalf("expected only the due entry, got %+v", due)
+	}
+	if again := q.Due(now); len(again) != 0 {
+		t.Fatalf("expected a dispatched entry not to be due again, got %+v", again)
+	}
+
+	// Putting it back (after another failure) makes it eligible again.
+	q.Put(Entry{File: "due", Attempts: 1, NextRetry: now.Add(-time.Second)})
+	if again := q.Due(now); len(again) != 1 || again[0].Attempts != 1 {
+		t.Fatalf("expected the re-queued entry, got %+v", again)
+	}
+}
+
+func TestOpen_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "retries.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Fatal("expected an error for a corrupt queue file")
+	}
+}
+
+func TestQueue_EntryPerTransfer(t *testing.T) {
+	q, _ := Open("")
+	now := time.Now()
+	q.Put(Entry{File: "/in/a.txt", Transfer: "partner", NextRetry: now})
+	q.Put(Entry{File: "/in/a.txt", Transfer: "archive", NextRetry: now, Attempts: 2})
+
+	if len(q.List()) != 2 {
+		t.Fatalf("expected an entry for each transfer, got %+v", q.List())
+	}
+	if e, ok := q.Get("/in/a.txt", "archive"); !ok || e.Attempts != 2 {
+		t.Fatalf("unexpected entry for archive: %+v (found %v)", e, ok)
+	}
+
+	q.Remove("/in/a.txt", "partner")
+	if _, ok := q.Get("/in/a.txt", "partner"); ok {
+		t.Fatal("expected the partner entry to be removed")
+	}
+	if _, ok := q.Get("/in/a.txt", "archive"); !ok {
+		t.Fatal("removing one transfer's entry must leave the other")
+	}
+}
@@ -0,0 +1,35 @@
+//go:build unix
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/justin-molloy/tfagent/service"
+)
+
+// run runs the agent in the foreground until it's told to stop. It doesn't
+// fork into the background itself; systemd, or whatever else starts it, looks
+// after that. It returns the exit code.
+
+func run(a *agent) int {
+	// Block and create a channel to receive OS signals for interrupts, and
+	// SIGHUP for log rotation
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	slog.Info("Running in the foreground", "pid", os.Getpid())
+	d := &service.Daemon{
+		Name:       a.name,
+		Config:     a.cfg,
+		Tracker:    a.tracker,
+		FileQueue:  a.fileQueue,
+		Processing: a.processing,
+		Journal:    a.journal,
+		ReopenLog:  a.reopenLog,
+	}
+	return d.Run(sigs)
+}
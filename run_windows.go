@@ -0,0 +1,53 @@
+//go:build windows
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+
+	"golang.org/x/sys/windows/svc"
+
+	"github.com/justin-molloy/tfagent/service"
+)
+
+// run runs the service if called from Windows Service, or runs standalone if not.
+// It returns the exit code.
+
+func run(a *agent) int {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		slog.Error("failed to determine session type", "error", err)
+		return 1
+	}
+
+	if isService {
+		slog.Info("Running as Windows Service", "isService", isService)
+		if err := svc.Run(a.name, &service.TFAgentService{
+			Name:       a.name,
+			Config:     a.cfg,
+			Tracker:    a.tracker,
+			FileQueue:  a.fileQueue,
+			Processing: a.processing,
+			Journal:    a.journal}); err != nil {
+			slog.Error("Windows service failed", "error", err)
+			return 1
+		}
+		return 0
+	}
+
+	// Ctrl+C stops the agent the same way a service stop does.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+
+	slog.Info("Running as standalone app outside of Windows Service Control Manager")
+	p := service.Start(a.cfg, a.tracker, a.fileQueue, a.processing, a.journal)
+
+	sig := <-sigs
+	slog.Info("Program terminated by signal; stopping", "signal", sig.String())
+	if !p.Stop(nil) {
+		return 1
+	}
+	return 0
+}
@@ -2,40 +2,94 @@
 package selector
 
 import (
+	"context"
 	"log/slog"
+	"os"
 	"time"
 
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+	"github.com/justin-molloy/tfagent/journal"
 	"github.com/justin-molloy/tfagent/tracker"
 	"github.com/justin-molloy/tfagent/utils"
 )
 
 // processSnapshot checks all tracked events and queues files that are ready for processing.
 // filters and transfer eligibility will be determined here as well, using values from the
-// transfer configuration.
+// transfer configuration. Each file goes on to the processor as the job the
+// tracker started for it.
+//
+// It runs until ctx is cancelled. Files that are still waiting to be queued are
+// then recorded in the journal, so they're picked up again at the next start.
 
 func StartSelector(
+	ctx context.Context,
+	cfg *config.ConfigData,
 	trackerMap *tracker.EventTracker,
-	fileQueue chan<- string,
+	fileQueue chan<- job.Job,
 	processingSet *FileSelector,
+	jrnl *journal.Journal,
 ) {
+	transfers := make(map[string]config.ConfigEntry, len(cfg.Transfers))
+	for _, entry := range cfg.Transfers {
+		transfers[entry.Name] = entry
+	}
+	checks := make(map[string]*stability) // files waiting for their size and mtime to settle
+
 	ticker := time.NewTicker(500 * time.Millisecond)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			persistWaiting(trackerMap, jrnl)
+			return
+		case <-ticker.C:
+		}
+
 		now := time.Now()
 		snapshot := trackerMap.GetSnapshot()
+		ready := utils.NewReadyChecker() // shared by this tick's files
 
 		if len(snapshot) > 0 {
 			slog.Debug("Snapshot of lastEvents", "events", snapshot)
 		}
 
-		// hasDelayElapsed - currently hardcoded to 1 second (may fix this later)
+		// Files that have left the tracker don't need checking any more.
+		for file := range checks {
+			if _, ok := snapshot[file]; !ok {
+				delete(checks, file)
+			}
+		}
+
 		for file, t := range snapshot {
-			if !hasDelayElapsed(t, now, 1) {
+			j, ok := trackerMap.Job(file)
+			if !ok {
+				continue // removed since the snapshot
+			}
+			jrnl.Detected(file)
+
+			delay, polls := settle(transfers, j)
+			if !hasDelayElapsed(t, now, delay) {
 				continue
 			}
 
-			if !utils.CheckReadyForProcessing(file) {
+			if polls > 0 {
+				info, err := os.Stat(file)
+				if err != nil {
+					continue
+				}
+				s, ok := checks[file]
+				if !ok {
+					s = &stability{file: file}
+					checks[file] = s
+				}
+				if !s.check(info, now, delay, polls) {
+					continue
+				}
+			}
+
+			if !ready.Ready(file) {
 				continue
 			}
 
@@ -45,15 +99,40 @@ func StartSelector(
 				continue
 			}
 
+			if info, err := os.Stat(file); err == nil {
+				j.Size = info.Size()
+			}
+
 			processingSet.AddFile(file)
-			slog.Info("Queued file after delay", "file", file)
-			fileQueue <- file
+			jrnl.Record(file, journal.Queued, nil)
+			slog.Info("Queued file after delay", "file", file, "size", j.Size, "waited", now.Sub(j.Detected).Round(time.Millisecond))
+			select {
+			case fileQueue <- j:
+			case <-ctx.Done():
+				// Already journaled as queued, so it's sent at the next start.
+				persistWaiting(trackerMap, jrnl)
+				return
+			}
 			trackerMap.Delete(file)
+			delete(checks, file)
 		}
 	}
 }
 
+// persistWaiting makes sure every file the tracker is holding is in the
+// journal. Most already are; any detected since the last tick aren't yet.
+
+func persistWaiting(trackerMap *tracker.EventTracker, jrnl *journal.Journal) {
+	waiting := trackerMap.GetSnapshot()
+	for file := range waiting {
+		jrnl.Detected(file)
+	}
+	if len(waiting) > 0 {
+		slog.Info("Files waiting to be queued are left for the next start", "files", len(waiting))
+	}
+}
+
 // hasDelayElapsed checks if the required delay has passed since the event time.
-func hasDelayElapsed(t time.Time, now time.Time, delaySec int) bool {
-	return now.Sub(t) > time.Duration(delaySec)*time.Second
+func hasDelayElapsed(t time.Time, now time.Time, delay time.Duration) bool {
+	return now.Sub(t) > delay
 }
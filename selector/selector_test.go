@@ -3,12 +3,16 @@
 package selector
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"runtime"
 	"testing"
 	"time"
 
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+	"github.com/justin-molloy/tfagent/journal"
 	"github.com/justin-molloy/tfagent/tracker"
 )
 
@@ -22,16 +26,16 @@ func TestStartSelector_RespectsDelay_NoEnqueueTooSoon(t *testing.T) {
 	et := tracker.NewEventTracker()
 	et.RecordEvent(file) // timestamp = now
 
-	q := make(chan string, 1)
+	q := make(chan job.Job, 1)
 	ps := NewFileSelector()
 
-	go StartSelector(et, q, ps)
+	go StartSelector(t.Context(), &config.ConfigData{}, et, q, ps, nil)
 
 	// Wait > ticker (0.5s) but < hard-coded delay (1s): nothing should arrive.
 	// Use 800ms to be safely below 1s on all OSes.
 	select {
 	case got := <-q:
-		t.Fatalf("did not expect enqueue yet, got %s", got)
+		t.Fatalf("did not expect enqueue yet, got %s", got.Path)
 	case <-time.After(800 * time.Millisecond):
 		// OK
 	}
@@ -44,26 +48,35 @@ func TestStartSelector_EnqueuesAfterDelay(t *testing.T) {
 		t.Fatalf("write: %v", err)
 	}
 
-	// Small settle so utils.CheckReadyForProcessing is less likely to reject the file.
+	// Small settle so the readiness check is less likely to reject the file.
 	time.Sleep(100 * time.Millisecond)
 
 	et := tracker.NewEventTracker()
 	et.RecordEvent(file) // now
+	recorded, _ := et.Job(file)
 
-	q := make(chan string, 1)
+	q := make(chan job.Job, 1)
 	ps := NewFileSelector()
 
-	go StartSelector(et, q, ps)
+	go StartSelector(t.Context(), &config.ConfigData{}, et, q, ps, nil)
 
 	// Wait for: delay (1s) + one tick (0.5s) + cushion
 	timeout := 2 * time.Second
 	if runtime.GOOS == "windows" {
 		timeout = 2500 * time.Millisecond
 	}
+	if runtime.GOOS == "linux" && os.Geteuid() != 0 {
+		// Without root the readiness check can't see other users' open files,
+		// so it also waits for the file to stop changing.
+		timeout = 5 * time.Second
+	}
 	select {
 	case got := <-q:
-		if got != file {
-			t.Fatalf("expected %s, got %s", file, got)
+		if got.Path != file {
+			t.Fatalf("expected %s, got %s", file, got.Path)
+		}
+		if got.ID != recorded.ID || got.Size != 4 {
+			t.Fatalf("expected the tracker's job (%s) with size 4, got %+v", recorded.ID, got)
 		}
 	case <-time.After(timeout):
 		t.Fatalf("timeout waiting for enqueue")
@@ -77,7 +90,7 @@ func TestStartSelector_EnqueuesAfterDelay(t *testing.T) {
 	time.Sleep(700 * time.Millisecond)
 	select {
 	case again := <-q:
-		t.Fatalf("did not expect duplicate enqueue, got %s", again)
+		t.Fatalf("did not expect duplicate enqueue, got %s", again.Path)
 	default:
 	}
 }
@@ -95,20 +108,25 @@ func TestStartSelector_SkipsIfAlreadyProcessing(t *testing.T) {
 	et := tracker.NewEventTracker()
 	et.RecordEvent(file) // eligible after 1s
 
-	q := make(chan string, 1)
+	q := make(chan job.Job, 1)
 	ps := NewFileSelector()
 	ps.AddFile(file) // mark as already processing
 
-	go StartSelector(et, q, ps)
+	go StartSelector(t.Context(), &config.ConfigData{}, et, q, ps, nil)
 
 	// Give it enough time to consider (≥ delay + ≥ one tick)
 	timeout := 2 * time.Second
 	if runtime.GOOS == "windows" {
 		timeout = 2500 * time.Millisecond
 	}
+	if runtime.GOOS == "linux" && os.Geteuid() != 0 {
+		// Without root the readiness check can't see other users' open files,
+		// so it also waits for the file to stop changing.
+		timeout = 5 * time.Second
+	}
 	select {
 	case got := <-q:
-		t.Fatalf("expected skip due to AlreadyExists; got %s", got)
+		t.Fatalf("expected skip due to AlreadyExists; got %s", got.Path)
 	case <-time.After(timeout):
 		// OK: not enqueued
 	}
@@ -119,3 +137,38 @@ func TestStartSelector_SkipsIfAlreadyProcessing(t *testing.T) {
 		t.Fatalf("expected file to be deleted from tracker when already processing")
 	}
 }
+
+func TestStartSelector_StopJournalsWaitingFiles(t *testing.T) {
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "waiting.txt")
+	if err := os.WriteFile(file, []byte("x"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	jrnl, err := journal.Open(filepath.Join(tmp, "journal.jsonl"))
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	defer jrnl.Close()
+
+	et := tracker.NewEventTracker()
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		StartSelector(ctx, &config.ConfigData{}, et, make(chan job.Job), NewFileSelector(), jrnl)
+		close(done)
+	}()
+
+	// Detected just before the stop, so the selector hasn't ticked since.
+	et.RecordEvent(file)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("StartSelector did not return after its context was cancelled")
+	}
+	if s, ok := jrnl.State(file); !ok || s != journal.Detected {
+		t.Errorf("expected waiting file to be journaled as detected, got %q (%v)", s, ok)
+	}
+}
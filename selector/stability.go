@@ -0,0 +1,65 @@
+package selector
+
+import (
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+)
+
+// stability follows a file's size and modification time while it settles. A
+// writer that is slow or stalls (eg. copying over a WAN share) can go quiet for
+// longer than settle_delay without having finished, and unlike on Windows there
+// may be no lock to show the file is still open. Checking that neither changes
+// over several polls works the same on every OS.
+
+type stability struct {
+	file    string
+	size    int64
+	modTime time.Time
+	checked time.Time // when the last check was made
+	polls   int       // checks in a row that found no change
+}
+
+// check compares the file with the last check, if at least interval has passed
+// since then. It reports whether polls checks in a row have now found it
+// unchanged. Any change starts the count again.
+
+func (s *stability) check(info os.FileInfo, now time.Time, interval time.Duration, polls int) bool {
+	if s.checked.IsZero() {
+		s.size, s.modTime, s.checked = info.Size(), info.ModTime(), now
+		return false
+	}
+	if now.Sub(s.checked) < interval {
+		return s.polls >= polls
+	}
+
+	if info.Size() != s.size || !info.ModTime().Equal(s.modTime) {
+		slog.Debug("File still changing; waiting for it to settle",
+			"file", s.file, "size", info.Size(), "modified", info.ModTime())
+		s.size, s.modTime, s.polls = info.Size(), info.ModTime(), 0
+	} else {
+		s.polls++
+	}
+	s.checked = now
+	return s.polls >= polls
+}
+
+// settle returns the settle delay and stable polls for a job. A file claimed by
+// several transfers waits as long as the most cautious of them.
+
+func settle(transfers map[string]config.ConfigEntry, j job.Job) (delay time.Duration, polls int) {
+	for _, name := range j.Transfers {
+		if entry, ok := transfers[name]; ok {
+			d, p := entry.Settle()
+			delay, polls = max(delay, d), max(polls, p)
+		}
+	}
+	if delay == 0 {
+		// Not claimed by any transfer we know of; use the defaults.
+		return config.ConfigEntry{}.Settle()
+	}
+	return delay, polls
+}
@@ -0,0 +1,120 @@
+package selector
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+	"github.com/justin-molloy/tfagent/tracker"
+)
+
+type fakeInfo struct {
+	size    int64
+	modTime time.Time
+}
+
+func (f fakeInfo) Name() string       { return "f" }
+func (f fakeInfo) Size() int64        { return f.size }
+func (f fakeInfo) Mode() fs.FileMode  { return 0o644 }
+func (f fakeInfo) ModTime() time.Time { return f.modTime }
+func (f fakeInfo) IsDir() bool        { return false }
+func (f fakeInfo) Sys() any           { return nil }
+
+func TestStability_Check(t *testing.T) {
+	start := time.Now()
+	mtime := start.Add(-time.Minute)
+	at := func(n int) time.Time { return start.Add(time.Duration(n) * time.Second) }
+
+	s := &stability{}
+	steps := []struct {
+		info fakeInfo
+		now  time.Time
+		want bool
+	}{
+		{fakeInfo{10, mtime}, at(0), false},                      // first look
+		{fakeInfo{10, mtime}, at(1), false},                      // 1 unchanged
+		{fakeInfo{20, mtime.Add(time.Second)}, at(2), false},     // grew; start again
+		{fakeInfo{20, mtime.Add(time.Second)}, at(2), false},     // too soon to count
+		{fakeInfo{20, mtime.Add(time.Second)}, at(3), false},     // 1 unchanged
+		{fakeInfo{20, mtime.Add(2 * time.Second)}, at(4), false}, // touched; start again
+		{fakeInfo{20, mtime.Add(2 * time.Second)}, at(5), false}, // 1 unchanged
+		{fakeInfo{20, mtime.Add(2 * time.Second)}, at(6), true},  // 2 unchanged
+	}
+	for i, step := range steps {
+		if got := s.check(step.info, step.now, time.Second, 2); got != step.want {
+			t.Fatalf("step %d: expected %v, got %v (%+v)", i, step.want, got, s)
+		}
+	}
+}
+
+func TestSettle(t *testing.T) {
+	transfers := map[string]config.ConfigEntry{
+		"quick": {Name: "quick", SettleDelay: 200 * time.Millisecond},
+		"wan":   {Name: "wan", SettleDelay: 30 * time.Second, StablePolls: 3},
+	}
+	tests := []struct {
+		claims    []string
+		wantDelay time.Duration
+		wantPolls int
+	}{
+		{claims: nil, wantDelay: config.DefaultSettleDelay},
+		{claims: []string{"gone"}, wantDelay: config.DefaultSettleDelay},
+		{claims: []string{"quick"}, wantDelay: 200 * time.Millisecond},
+		{claims: []string{"quick", "wan"}, wantDelay: 30 * time.Second, wantPolls: 3},
+	}
+	for _, tt := range tests {
+		j := job.Job{Transfers: tt.claims}
+		if delay, polls := settle(transfers, j); delay != tt.wantDelay || polls != tt.wantPolls {
+			t.Errorf("%v: expected %v, %d; got %v, %d", tt.claims, tt.wantDelay, tt.wantPolls, delay, polls)
+		}
+	}
+}
+
+func TestStartSelector_WaitsForSlowWriter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "slow.csv")
+	if err := os.WriteFile(file, []byte("a"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	cfg := &config.ConfigData{Transfers: []config.ConfigEntry{
+		{Name: "wan", SettleDelay: 200 * time.Millisecond, StablePolls: 2},
+	}}
+	et := tracker.NewEventTracker()
+	j := job.New(file)
+	j.Transfers = []string{"wan"}
+	et.RecordJob(j)
+
+	q := make(chan job.Job, 1)
+	go StartSelector(t.Context(), cfg, et, q, NewFileSelector(), nil)
+
+	// The writer keeps adding to the file without any more events, as a copy
+	// over a share that fsnotify can't see would.
+	writing := time.Now()
+	for time.Since(writing) < 2*time.Second {
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		f.WriteString("a")
+		f.Close()
+
+		select {
+		case got := <-q:
+			t.Fatalf("queued while still being written: %+v", got)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	select {
+	case got := <-q:
+		if got.Path != file || got.Size < 2 {
+			t.Fatalf("expected the whole of %s, got %+v", file, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the file to be queued once it stopped changing")
+	}
+}
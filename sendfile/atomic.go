@@ -0,0 +1,71 @@
+package sendfile
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/pkg/sftp"
+)
+
+// tempUploadPath is where a file is written before being renamed to its final
+// name: ".name.part" next to the destination, or "name.part" in staging_dir if
+// one is set. A staging directory must be on the same remote filesystem as
+// remotepath, otherwise the rename will fail.
+
+func tempUploadPath(transfer config.ConfigEntry, dstPath string) string {
+	dir, name := path.Split(dstPath)
+	if staging := strings.TrimSpace(transfer.StagingDir); staging != "" {
+		return path.Join(staging, name+".part")
+	}
+	return path.Join(dir, "."+name+".part")
+}
+
+// syncRemote asks the server to flush a file to disk, if it supports the
+// fsync@openssh.com extension. Servers without it are left to their own devices.
+
+func syncRemote(sftpClient *sftp.Client, f *sftp.File) error {
+	if _, ok := sftpClient.HasExtension("fsync@openssh.com"); !ok {
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync remote file: %w", err)
+	}
+	return nil
+}
+
+// remoteRename moves the temporary upload to its final name.
+// posix-rename@openssh.com replaces an existing file atomically. Without it, a
+// plain SFTP rename won't replace an existing file on most servers, so any
+// existing file is removed first - there is a brief window where the file is
+// missing.
+
+func remoteRename(sftpClient *sftp.Client, from, to string) error {
+	if _, ok := sftpClient.HasExtension("posix-rename@openssh.com"); ok {
+		if err := sftpClient.PosixRename(from, to); err != nil {
+			return fmt.Errorf("failed to rename remote file: %w", err)
+		}
+		return nil
+	}
+
+	err := sftpClient.Rename(from, to)
+	if err == nil {
+		return nil
+	}
+
+	if fi, statErr := sftpClient.Stat(to); statErr != nil || fi.IsDir() {
+		// No file in the way, so the rename failed for some other reason.
+		return fmt.Errorf("failed to rename remote file %s to %s: %w", from, to, err)
+	}
+
+	slog.Debug("Server has no posix-rename; replacing existing file", "file", to)
+	if err := sftpClient.Remove(to); err != nil {
+		return fmt.Errorf("failed to remove existing remote file: %w", err)
+	}
+	if err := sftpClient.Rename(from, to); err != nil {
+		return fmt.Errorf("failed to rename remote file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package sendfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestUploadSFTP_TempModeReplacesExisting(t *testing.T) {
+	tmp := t.TempDir()
+	remote := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	tf := srv.transfer(keyPath, remote)
+	tf.UploadMode = "temp"
+
+	mustWriteFile(t, remote, "data.csv", "old contents")
+	local := mustWriteFile(t, tmp, "data.csv", "new contents")
+
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("UploadSFTP: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(remote, "data.csv"))
+	if err != nil || string(got) != "new contents" {
+		t.Fatalf("expected new contents, got %q (err %v)", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(remote, ".data.csv.part")); !os.IsNotExist(err) {
+		t.Fatalf("expected temp file to be renamed away, stat err: %v", err)
+	}
+}
+
+func TestUploadSFTP_TempModeWritesPartFile(t *testing.T) {
+	tmp := t.TempDir()
+	remote := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	tf := srv.transfer(keyPath, remote)
+	tf.UploadMode = "temp"
+
+	// A directory in the way of the final name makes the rename fail, which
+	// leaves the temporary file behind to look at.
+	if err := os.MkdirAll(filepath.Join(remote, "data.csv", "x"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	local := mustWriteFile(t, tmp, "data.csv", "payload")
+
+	if _, err := uploadOnce(local, tf, mustClientConfig(t, tf), &uploadState{}); err == nil {
+		t.Fatal("expected rename onto a directory to fail")
+	}
+
+	got, err := os.ReadFile(filepath.Join(remote, ".data.csv.part"))
+	if err != nil || string(got) != "payload" {
+		t.Fatalf("expected payload in temp file, got %q (err %v)", got, err)
+	}
+}
+
+func TestUploadSFTP_StagingDir(t *testing.T) {
+	tmp := t.TempDir()
+	remote := t.TempDir()
+	staging := filepath.Join(remote, ".staging")
+	if err := os.Mkdir(staging, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	tf := srv.transfer(keyPath, remote)
+	tf.UploadMode = "temp"
+	tf.StagingDir = filepath.ToSlash(staging)
+
+	local := mustWriteFile(t, tmp, "data.csv", "payload")
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("UploadSFTP: %v", err)
+	}
+
+	if got, _ := os.ReadFile(filepath.Join(remote, "data.csv")); string(got) != "payload" {
+		t.Fatalf("expected payload at final name, got %q", got)
+	}
+	if entries, _ := os.ReadDir(staging); len(entries) != 0 {
+		t.Fatalf("expected empty staging dir, got %d entries", len(entries))
+	}
+}
+
+func TestUploadSFTP_TempModeWithoutPosixRename(t *testing.T) {
+	if err := sftp.SetSFTPExtensions("statvfs@openssh.com"); err != nil {
+		t.Fatalf("SetSFTPExtensions: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = sftp.SetSFTPExtensions("hardlink@openssh.com", "posix-rename@openssh.com", "statvfs@openssh.com")
+	})
+
+	tmp := t.TempDir()
+	remote := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	tf := srv.transfer(keyPath, remote)
+	tf.UploadMode = "temp"
+
+	mustWriteFile(t, remote, "data.csv", "old contents")
+	local := mustWriteFile(t, tmp, "data.csv", "new contents")
+
+	sshConfig := mustClientConfig(t, tf)
+	_, err := defaultPool.withConn(tf, sshConfig, func(c *pooledConn) (string, error) {
+		sftpClient, err := c.SFTP()
+		if err != nil {
+			return "failed", err
+		}
+		if _, ok := sftpClient.HasExtension("posix-rename@openssh.com"); ok {
+			t.Error("expected server not to offer posix-rename")
+		}
+		return sftpUpload(c, local, tf, &uploadState{})
+	})
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+
+	if got, _ := os.ReadFile(filepath.Join(remote, "data.csv")); string(got) != "new contents" {
+		t.Fatalf("expected new contents, got %q", got)
+	}
+}
+
+func mustClientConfig(t *testing.T, tf config.ConfigEntry) *ssh.ClientConfig {
+	t.Helper()
+	sshConfig, err := sshClientConfig(tf)
+	if err != nil {
+		t.Fatalf("sshClientConfig: %v", err)
+	}
+	return sshConfig
+}
+
+func TestUploadSFTP_RecursiveCreatesSubdirectories(t *testing.T) {
+	tmp := t.TempDir()
+	remote := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	source := filepath.Join(tmp, "source")
+	tf := srv.transfer(keyPath, remote)
+	tf.SourceDirectory = source
+	tf.Recursive = true
+	tf.UploadMode = "temp"
+
+	local := mustWriteFile(t, filepath.Join(source, "2024", "03"), "data.csv", "payload")
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("UploadSFTP: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(remote, "2024", "03", "data.csv"))
+	if err != nil || string(got) != "payload" {
+		t.Fatalf("expected payload under the same subdirectory, got %q (err %v)", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "2024", "03", ".data.csv.part")); !os.IsNotExist(err) {
+		t.Fatalf("expected temp file to be renamed away, stat err: %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package sendfile
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestUploadSFTP_PasswordAuth(t *testing.T) {
+	tmp := t.TempDir()
+	remote := t.TempDir()
+	srv := newTestSSHServer(t, nil) // no keys accepted
+	srv.allowPassword("s3cret")
+
+	tf := srv.transfer(filepath.Join(tmp, "unused"), remote)
+	tf.PrivateKey = ""
+	tf.Password = "s3cret"
+
+	local := mustWriteFile(t, tmp, "a.txt", "a")
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("UploadSFTP: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "a.txt")); err != nil {
+		t.Fatalf("expected uploaded file: %v", err)
+	}
+	if got := srv.successfulAuths(); !slices.Equal(got, []string{"password"}) {
+		t.Fatalf("expected password auth, got %v", got)
+	}
+}
+
+func TestUploadSFTP_KeyboardInteractiveAuth(t *testing.T) {
+	tmp := t.TempDir()
+	srv := newTestSSHServer(t, nil)
+	srv.allowKeyboardInteractive("s3cret") // password method not offered
+
+	tf := srv.transfer(filepath.Join(tmp, "unused"), t.TempDir())
+	tf.PrivateKey = ""
+	tf.Password = "s3cret"
+
+	local := mustWriteFile(t, tmp, "a.txt", "a")
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("UploadSFTP: %v", err)
+	}
+	if got := srv.successfulAuths(); !slices.Equal(got, []string{"keyboard-interactive"}) {
+		t.Fatalf("expected keyboard-interactive auth, got %v", got)
+	}
+}
+
+func TestUploadSFTP_KeyFallsBackToPassword(t *testing.T) {
+	tmp := t.TempDir()
+	keyPath, _ := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, nil) // rejects our key
+	srv.allowPassword("s3cret")
+
+	tf := srv.transfer(keyPath, t.TempDir())
+	tf.Password = "s3cret"
+
+	local := mustWriteFile(t, tmp, "a.txt", "a")
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("UploadSFTP: %v", err)
+	}
+	if got := srv.successfulAuths(); !slices.Equal(got, []string{"password"}) {
+		t.Fatalf("expected fallback to password auth, got %v", got)
+	}
+}
+
+func TestUploadSFTP_KeyPreferredOverPassword(t *testing.T) {
+	tmp := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	srv.allowPassword("s3cret")
+
+	tf := srv.transfer(keyPath, t.TempDir())
+	tf.Password = "s3cret"
+
+	local := mustWriteFile(t, tmp, "a.txt", "a")
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("UploadSFTP: %v", err)
+	}
+	if got := srv.successfulAuths(); !slices.Equal(got, []string{"publickey"}) {
+		t.Fatalf("expected publickey auth, got %v", got)
+	}
+}
+
+func TestAuthMethods_NoCredentials(t *testing.T) {
+	tf := minimalTransfer("")
+	_, err := authMethods(tf)
+	if err == nil || !strings.Contains(err.Error(), "no credentials configured") {
+		t.Fatalf("expected no credentials error, got %v", err)
+	}
+}
+
+func TestPasswordChallenge_AnswersEveryPrompt(t *testing.T) {
+	answers, err := passwordChallenge("pw")("", "", []string{"Password: ", "Again: "}, []bool{false, false})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(answers, []string{"pw", "pw"}) {
+		t.Fatalf("unexpected answers %v", answers)
+	}
+}
+
+func TestUploadSFTP_EncryptedKey(t *testing.T) {
+	tmp := t.TempDir()
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	blk, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("pass phrase"))
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	keyPath := filepath.Join(tmp, "id_ed25519")
+	os.WriteFile(keyPath, pem.EncodeToMemory(blk), 0o600)
+	pub, _ := ssh.NewPublicKey(priv.Public())
+
+	srv := newTestSSHServer(t, pub)
+	tf := srv.transfer(keyPath, t.TempDir())
+	local := mustWriteFile(t, tmp, "a.txt", "a")
+
+	// Passphrase supplied via the environment.
+	t.Setenv("TFAGENT_TEST_PASSPHRASE", "pass phrase")
+	tf.PrivateKeyPassphraseEnv = "TFAGENT_TEST_PASSPHRASE"
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("UploadSFTP: %v", err)
+	}
+
+	tf.PrivateKeyPassphraseEnv = ""
+	if _, err := UploadSFTP(t.Context(), local, tf); err == nil || !strings.Contains(err.Error(), "encrypted") {
+		t.Fatalf("expected encrypted key error without passphrase, got %v", err)
+	}
+}
+
+func TestUploadSFTP_Certificate(t *testing.T) {
+	tmp := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+
+	_, caPriv, _ := ed25519.GenerateKey(rand.Reader)
+	ca, _ := ssh.NewSignerFromKey(caPriv)
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"user"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("sign cert: %v", err)
+	}
+	certPath := filepath.Join(tmp, "id_ed25519-cert.pub")
+	os.WriteFile(certPath, ssh.MarshalAuthorizedKey(cert), 0o644)
+
+	srv := newTestSSHServer(t, nil)
+	srv.trustUserCA(ca.PublicKey()) // plain keys are rejected
+
+	tf := srv.transfer(keyPath, t.TempDir())
+	local := mustWriteFile(t, tmp, "a.txt", "a")
+
+	if _, err := UploadSFTP(t.Context(), local, tf); err == nil {
+		t.Fatalf("expected plain key to be rejected")
+	}
+
+	tf.Certificate = certPath
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("UploadSFTP with certificate: %v", err)
+	}
+}
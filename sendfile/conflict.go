@@ -0,0 +1,88 @@
+package sendfile
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/justin-molloy/tfagent/config"
+)
+
+// ErrDestinationExists is returned when on_conflict is "fail" and the file is
+// already at the destination. Retrying won't help, so it isn't retried.
+var ErrDestinationExists = errors.New("destination file already exists")
+
+// maxRenameSuffix bounds the search for a free name with on_conflict "rename".
+const maxRenameSuffix = 1000
+
+// statFunc looks up a destination file - os.Stat for local copies, the sftp
+// client's Stat for uploads.
+type statFunc func(name string) (fs.FileInfo, error)
+
+// resolveConflict applies the transfer's on_conflict policy to the destination
+// of a file, which keeps the local file's name in dir. It returns the path to
+// write to, or skip=true if the upload should be left out and treated as a
+// success. join is path.Join for remote paths or filepath.Join for local ones.
+
+func resolveConflict(transfer config.ConfigEntry, file, dir string, join func(...string) string, stat statFunc) (dst string, skip bool, err error) {
+	name := filepath.Base(file)
+	dst = join(dir, name)
+	policy := transfer.ConflictPolicy()
+	if policy == "overwrite" {
+		return dst, false, nil
+	}
+
+	exists, err := destExists(stat, dst)
+	if err != nil {
+		return "", false, err
+	}
+	if !exists {
+		return dst, false, nil
+	}
+
+	switch policy {
+	case "skip":
+		slog.Info("Destination file exists; skipping", "file", file, "dest", dst, "on_conflict", policy)
+		return dst, true, nil
+
+	case "fail":
+		slog.Warn("Destination file exists", "file", file, "dest", dst, "on_conflict", policy)
+		return "", false, fmt.Errorf("%w: %s", ErrDestinationExists, dst)
+
+	case "rename":
+		ext := path.Ext(name)
+		stem := strings.TrimSuffix(name, ext)
+		for n := 1; n <= maxRenameSuffix; n++ {
+			candidate := join(dir, stem+"_"+strconv.Itoa(n)+ext)
+			exists, err := destExists(stat, candidate)
+			if err != nil {
+				return "", false, err
+			}
+			if !exists {
+				slog.Info("Destination file exists; uploading under a new name",
+					"file", file, "dest", dst, "renamed", candidate, "on_conflict", policy)
+				return candidate, false, nil
+			}
+		}
+		return "", false, fmt.Errorf("no free name for %s after %d attempts", dst, maxRenameSuffix)
+
+	default:
+		return "", false, fmt.Errorf("unknown on_conflict policy %q", transfer.OnConflict)
+	}
+}
+
+func destExists(stat statFunc, name string) (bool, error) {
+	_, err := stat(name)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to check destination %s: %w", name, err)
+}
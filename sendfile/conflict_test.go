@@ -0,0 +1,156 @@
+package sendfile
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+)
+
+func TestResolveConflict(t *testing.T) {
+	dir := t.TempDir()
+	mustWriteFile(t, dir, "data.csv", "existing")
+	mustWriteFile(t, dir, "data_1.csv", "existing")
+
+	tests := []struct {
+		policy   string
+		name     string
+		wantDst  string
+		wantSkip bool
+		wantErr  error
+	}{
+		{policy: "", name: "data.csv", wantDst: "data.csv"},
+		{policy: "overwrite", name: "data.csv", wantDst: "data.csv"},
+		{policy: "skip", name: "data.csv", wantDst: "data.csv", wantSkip: true},
+		{policy: "skip", name: "new.csv", wantDst: "new.csv"},
+		{policy: "fail", name: "data.csv", wantErr: ErrDestinationExists},
+		{policy: "fail", name: "new.csv", wantDst: "new.csv"},
+		{policy: "rename", name: "data.csv", wantDst: "data_2.csv"},
+		{policy: "rename", name: "new.csv", wantDst: "new.csv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy+"/"+tt.name, func(t *testing.T) {
+			tf := config.ConfigEntry{OnConflict: tt.policy}
+			dst, skip, err := resolveConflict(tf, filepath.Join("src", tt.name), dir, filepath.Join, os.Stat)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if want := filepath.Join(dir, tt.wantDst); dst != want || skip != tt.wantSkip {
+				t.Fatalf("got (%q, skip=%v), want (%q, skip=%v)", dst, skip, want, tt.wantSkip)
+			}
+		})
+	}
+}
+
+func TestUploadSFTP_OnConflict(t *testing.T) {
+	tmp := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	local := mustWriteFile(t, tmp, "data.csv", "new")
+
+	t.Run("skip", func(t *testing.T) {
+		remote := t.TempDir()
+		mustWriteFile(t, remote, "data.csv", "old")
+		tf := srv.transfer(keyPath, remote)
+		tf.OnConflict = "skip"
+
+		result, err := UploadSFTP(t.Context(), local, tf)
+		if err != nil || result != "skipped" {
+			t.Fatalf("expected skipped, got %q (err %v)", result, err)
+		}
+		if got, _ := os.ReadFile(filepath.Join(remote, "data.csv")); string(got) != "old" {
+			t.Fatalf("expected existing file untouched, got %q", got)
+		}
+	})
+
+	t.Run("fail is not retried", func(t *testing.T) {
+		remote := t.TempDir()
+		mustWriteFile(t, remote, "data.csv", "old")
+		tf := srv.transfer(keyPath, remote)
+		tf.OnConflict = "fail"
+
+		start := time.Now()
+		if _, err := UploadSFTP(t.Context(), local, tf); !errors.Is(err, ErrDestinationExists) {
+			t.Fatalf("expected ErrDestinationExists, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("expected no retries, took %v", elapsed)
+		}
+	})
+
+	t.Run("rename with temp upload", func(t *testing.T) {
+		remote := t.TempDir()
+		mustWriteFile(t, remote, "data.csv", "old")
+		tf := srv.transfer(keyPath, remote)
+		tf.OnConflict = "rename"
+		tf.UploadMode = "temp"
+
+		if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+			t.Fatalf("UploadSFTP: %v", err)
+		}
+		if got, _ := os.ReadFile(filepath.Join(remote, "data.csv")); string(got) != "old" {
+			t.Fatalf("expected existing file untouched, got %q", got)
+		}
+		if got, _ := os.ReadFile(filepath.Join(remote, "data_1.csv")); string(got) != "new" {
+			t.Fatalf("expected upload as data_1.csv, got %q", got)
+		}
+	})
+}
+
+func TestCopyLocal_OnConflictSkip(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	mustWriteFile(t, dest, "data.csv", "old")
+	local := mustWriteFile(t, src, "data.csv", "new")
+
+	tf := config.ConfigEntry{TransferType: "local", RemotePath: dest, OnConflict: "skip"}
+	result, err := CopyLocal(t.Context(), local, tf)
+	if err != nil || result != "skipped" {
+		t.Fatalf("expected skipped, got %q (err %v)", result, err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dest, "data.csv")); string(got) != "old" {
+		t.Fatalf("expected existing file untouched, got %q", got)
+	}
+}
+
+func TestCopyLocal_LogLinesCarryJobID(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	mustWriteFile(t, dest, "data.csv", "old")
+	local := mustWriteFile(t, src, "data.csv", "new")
+
+	j := job.New(local)
+	job.Track(&j)
+	defer job.Finish(j)
+
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(job.NewHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+
+	tf := config.ConfigEntry{TransferType: "local", RemotePath: dest, OnConflict: "rename", Verify: "size"}
+	if _, err := CopyLocal(t.Context(), local, tf); err != nil {
+		t.Fatalf("CopyLocal: %v", err)
+	}
+
+	// Every line about the file, including the destination ones, can be found
+	// by its job ID.
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if !strings.Contains(line, "job="+j.ID) {
+			t.Errorf("expected job ID on log line: %s", line)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package sendfile
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/justin-molloy/tfagent/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ErrHostKeyMismatch is returned (wrapped) when the server's host key can't be
+// verified. Transfers that fail this way are not retried.
+
+var ErrHostKeyMismatch = errors.New("host key verification failed")
+
+// tofuMu serialises reads and writes of trust-on-first-use known_hosts files, so
+// two transfers to a new server don't both append a key.
+
+var tofuMu sync.Mutex
+
+// HostKeyCallback returns the host key check for a transfer, as selected by
+// ConfigEntry.HostKeyMode.
+
+func HostKeyCallback(transfer config.ConfigEntry) (ssh.HostKeyCallback, error) {
+	switch mode := transfer.HostKeyMode(); mode {
+	case "fingerprint":
+		return fingerprintCallback(transfer.HostKeyFingerprint), nil
+
+	case "known_hosts":
+		cb, err := knownhosts.New(transfer.KnownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read known_hosts: %w", err)
+		}
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return hostKeyError(hostname, key, cb(hostname, remote, key))
+		}, nil
+
+	case "tofu":
+		return tofuCallback(transfer.KnownHosts)
+
+	case "":
+		return nil, errors.New("no host key verification configured")
+
+	default:
+		return nil, fmt.Errorf("unsupported host_key_check %q", mode)
+	}
+}
+
+// fingerprintCallback accepts only a host key with the given SHA256 fingerprint.
+
+func fingerprintCallback(pinned string) ssh.HostKeyCallback {
+	// OpenSSH prints fingerprints unpadded, but accept a pasted padded value too.
+	want := strings.TrimRight(strings.TrimSpace(pinned), "=")
+
+	return func(hostname string, _ net.Addr, key ssh.PublicKey) error {
+		got := ssh.FingerprintSHA256(key)
+		if got != want {
+			return fmt.Errorf("%w: %s presented %s, expected %s", ErrHostKeyMismatch, hostname, got, want)
+		}
+		return nil
+	}
+}
+
+// tofuCallback trusts the first key seen for a host and records it in the
+// known_hosts file. After that the host must keep presenting the same key.
+
+func tofuCallback(path string) (ssh.HostKeyCallback, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, errors.New("no known_hosts file configured for trust-on-first-use")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create known_hosts directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create known_hosts: %w", err)
+	}
+	f.Close()
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		tofuMu.Lock()
+		defer tofuMu.Unlock()
+
+		// Re-read the file each time so keys recorded by other transfers are seen.
+		cb, err := knownhosts.New(path)
+		if err != nil {
+			return fmt.Errorf("unable to read known_hosts: %w", err)
+		}
+
+		err = cb(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return hostKeyError(hostname, key, err)
+		}
+
+		// Unknown host - record the key we were given.
+		line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("unable to update known_hosts: %w", err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(line + "\n"); err != nil {
+			return fmt.Errorf("unable to update known_hosts: %w", err)
+		}
+
+		slog.Warn("Trusting host key on first use", "host", hostname,
+			"fingerprint", ssh.FingerprintSHA256(key), "known_hosts", path)
+		return nil
+	}, nil
+}
+
+// hostKeyError converts errors from a knownhosts callback into ErrHostKeyMismatch.
+
+func hostKeyError(hostname string, key ssh.PublicKey, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var keyErr *knownhosts.KeyError
+	var revokedErr *knownhosts.RevokedError
+	switch {
+	case errors.As(err, &keyErr) && len(keyErr.Want) > 0:
+		return fmt.Errorf("%w: %s presented %s, which does not match known_hosts (%s line %d)",
+			ErrHostKeyMismatch, hostname, ssh.FingerprintSHA256(key), keyErr.Want[0].Filename, keyErr.Want[0].Line)
+	case errors.As(err, &keyErr):
+		return fmt.Errorf("%w: %s is not in known_hosts", ErrHostKeyMismatch, hostname)
+	case errors.As(err, &revokedErr):
+		return fmt.Errorf("%w: %s presented a revoked key", ErrHostKeyMismatch, hostname)
+	default:
+		return err
+	}
+}
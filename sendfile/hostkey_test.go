@@ -0,0 +1,173 @@
+package sendfile
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// knownHostsLine returns a known_hosts entry for the test server with the given key.
+func knownHostsLine(srv *testSSHServer, key ssh.PublicKey) string {
+	return knownhosts.Line([]string{knownhosts.Normalize(srv.ln.Addr().String())}, key) + "\n"
+}
+
+func otherHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	_, pub := mustWriteEd25519Key(t, t.TempDir(), "other")
+	return pub
+}
+
+func TestUploadSFTP_TOFU_RecordsAndReusesKey(t *testing.T) {
+	tmp := t.TempDir()
+	remote := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	tf := srv.transfer(keyPath, remote)
+
+	local := mustWriteFile(t, tmp, "a.txt", "a")
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("first upload: %v", err)
+	}
+
+	recorded, err := os.ReadFile(tf.KnownHosts)
+	if err != nil {
+		t.Fatalf("read known_hosts: %v", err)
+	}
+	if string(recorded) != knownHostsLine(srv, srv.hostKey.PublicKey()) {
+		t.Fatalf("unexpected known_hosts contents:\n%s", recorded)
+	}
+
+	// Second connection must be accepted against the recorded key, without
+	// adding it again.
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("second upload: %v", err)
+	}
+	again, _ := os.ReadFile(tf.KnownHosts)
+	if string(again) != string(recorded) {
+		t.Fatalf("known_hosts changed on second upload:\n%s", again)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "a.txt")); err != nil {
+		t.Fatalf("expected uploaded file: %v", err)
+	}
+}
+
+func TestUploadSFTP_TOFU_MismatchFailsWithoutRetry(t *testing.T) {
+	tmp := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	tf := srv.transfer(keyPath, t.TempDir())
+
+	// A different key was recorded for this host earlier.
+	if err := os.WriteFile(tf.KnownHosts, []byte(knownHostsLine(srv, otherHostKey(t))), 0o600); err != nil {
+		t.Fatalf("write known_hosts: %v", err)
+	}
+
+	local := mustWriteFile(t, tmp, "a.txt", "a")
+	start := time.Now()
+	_, err := UploadSFTP(t.Context(), local, tf)
+	if !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("expected ErrHostKeyMismatch, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("host key mismatch should not be retried; took %v", elapsed)
+	}
+}
+
+func TestUploadSFTP_KnownHosts(t *testing.T) {
+	tmp := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	local := mustWriteFile(t, tmp, "a.txt", "a")
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "host listed", content: knownHostsLine(srv, srv.hostKey.PublicKey())},
+		{name: "host not listed", content: "", wantErr: true},
+		{name: "different key", content: knownHostsLine(srv, otherHostKey(t)), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			khPath := filepath.Join(t.TempDir(), "known_hosts")
+			if err := os.WriteFile(khPath, []byte(tt.content), 0o600); err != nil {
+				t.Fatalf("write known_hosts: %v", err)
+			}
+			tf := srv.transfer(keyPath, t.TempDir())
+			tf.HostKeyCheck = ""
+			tf.KnownHosts = khPath // known_hosts without a mode is strict
+
+			_, err := UploadSFTP(t.Context(), local, tf)
+			if tt.wantErr != errors.Is(err, ErrHostKeyMismatch) {
+				t.Fatalf("wantErr=%v, got %v", tt.wantErr, err)
+			}
+
+			// Strict mode never writes to the file.
+			after, _ := os.ReadFile(khPath)
+			if string(after) != tt.content {
+				t.Fatalf("known_hosts was modified in strict mode")
+			}
+		})
+	}
+}
+
+func TestUploadSFTP_PinnedFingerprint(t *testing.T) {
+	tmp := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	local := mustWriteFile(t, tmp, "a.txt", "a")
+
+	tf := srv.transfer(keyPath, t.TempDir())
+	tf.HostKeyCheck = "" // a pinned fingerprint without a mode is used on its own
+	tf.HostKeyFingerprint = ssh.FingerprintSHA256(srv.hostKey.PublicKey())
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("upload with correct pin: %v", err)
+	}
+
+	tf.HostKeyFingerprint = ssh.FingerprintSHA256(otherHostKey(t))
+	_, err := UploadSFTP(t.Context(), local, tf)
+	if !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("expected ErrHostKeyMismatch, got %v", err)
+	}
+}
+
+func TestFingerprintCallback_AcceptsPaddedPin(t *testing.T) {
+	key := otherHostKey(t)
+	cb := fingerprintCallback(ssh.FingerprintSHA256(key) + "=")
+	if err := cb("example.com:22", &net.TCPAddr{}, key); err != nil {
+		t.Fatalf("expected padded pin to match: %v", err)
+	}
+}
+
+func TestHostKeyCallback_TOFURequiresPath(t *testing.T) {
+	_, err := HostKeyCallback(minimalTransfer(filepath.Join(t.TempDir(), "key")))
+	if err != nil {
+		t.Fatalf("unexpected error with known_hosts set: %v", err)
+	}
+
+	tf := minimalTransfer("")
+	tf.HostKeyCheck = "tofu"
+	tf.KnownHosts = ""
+	_, err = HostKeyCallback(tf)
+	if err == nil || !strings.Contains(err.Error(), "no known_hosts file") {
+		t.Fatalf("expected missing known_hosts error, got %v", err)
+	}
+}
+
+func TestHostKeyCallback_NotConfigured(t *testing.T) {
+	tf := minimalTransfer("")
+	tf.HostKeyCheck = ""
+	tf.KnownHosts = ""
+	if _, err := HostKeyCallback(tf); err == nil || !strings.Contains(err.Error(), "no host key verification configured") {
+		t.Fatalf("expected an error for a transfer without host key verification, got %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package sendfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/justin-molloy/tfagent/config"
+)
+
+// CopyLocal copies a file into the destination directory of a "local" transfer
+// (remotepath), eg. a mounted share or an outbound spool directory. The data is
+// written to a temporary file in the destination, flushed to disk and then renamed
+// to the final name, so anything watching the destination never sees a partial file.
+// Nothing is copied if ctx has already been cancelled.
+
+func CopyLocal(ctx context.Context, filePath string, transfer config.ConfigEntry) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "failed", fmt.Errorf("copy interrupted: %w", err)
+	}
+
+	destDir := strings.TrimSpace(transfer.RemotePath)
+	if destDir == "" {
+		return "failed", errors.New("no destination directory (remotepath) set for local transfer")
+	}
+
+	slog.Info("Attempting local copy", "file", filePath, "dest", destDir)
+
+	srcFile, err := os.Open(filePath)
+	if err != nil {
+		return "failed", localFileError(err)
+	}
+	defer srcFile.Close()
+
+	info, err := srcFile.Stat()
+	if err != nil {
+		return "failed", fmt.Errorf("failed to stat local file: %w", err)
+	}
+
+	if sub := transfer.RelativeDir(filePath); sub != "" {
+		destDir = filepath.Join(destDir, filepath.FromSlash(sub))
+		if err := os.MkdirAll(destDir, 0o755); err != nil {
+			return "failed", fmt.Errorf("failed to create destination directory %s: %w", destDir, err)
+		}
+	}
+
+	fileName := filepath.Base(filePath)
+	dstPath, skip, err := resolveConflict(transfer, filePath, destDir, filepath.Join, os.Stat)
+	if err != nil {
+		return "failed", err
+	}
+	if skip {
+		return "skipped", nil
+	}
+
+	// The temp file lives in the destination directory so the final rename never
+	// crosses a filesystem boundary.
+
+	tmpFile, err := os.CreateTemp(destDir, "."+fileName+".*.tmp")
+	if err != nil {
+		return "failed", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpName := tmpFile.Name()
+
+	src, localSum, err := hashingReader(transfer, srcFile, 0)
+	if err != nil {
+		tmpFile.Close()
+		_ = os.Remove(tmpName)
+		return "failed", err
+	}
+	if err := writeAndSync(tmpFile, src); err != nil {
+		_ = os.Remove(tmpName)
+		return "failed", err
+	}
+
+	if err := verifyLocal(filePath, tmpName, transfer, info.Size(), localSum()); err != nil {
+		_ = os.Remove(tmpName)
+		return "failed", err
+	}
+
+	if err := os.Chmod(tmpName, info.Mode().Perm()); err != nil {
+		slog.Warn("Unable to set file mode on copy", "file", tmpName, "error", err)
+	}
+
+	if err := os.Rename(tmpName, dstPath); err != nil {
+		_ = os.Remove(tmpName)
+		return "failed", fmt.Errorf("failed to rename temporary file: %w", err)
+	}
+
+	slog.Debug("Local copy complete", "file", filePath, "dest", dstPath)
+	return "success", nil
+}
+
+// writeAndSync copies src into dst, flushes it to stable storage and closes it.
+// dst is always closed, even on error.
+
+func writeAndSync(dst *os.File, src io.Reader) error {
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("file copy failed: %w", err)
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	return nil
+}
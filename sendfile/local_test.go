@@ -0,0 +1,110 @@
+package sendfile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/justin-molloy/tfagent/config"
+)
+
+func TestCopyLocal_CopiesIntoDestination(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	local := mustWriteFile(t, src, "report.csv", "a,b,c\n")
+
+	result, err := CopyLocal(t.Context(), local, config.ConfigEntry{Name: "t", RemotePath: dest})
+	if err != nil {
+		t.Fatalf("CopyLocal: %v", err)
+	}
+	if result != "success" {
+		t.Fatalf("expected result 'success', got %q", result)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dest, "report.csv"))
+	if err != nil {
+		t.Fatalf("read copy: %v", err)
+	}
+	if string(got) != "a,b,c\n" {
+		t.Fatalf("unexpected copy contents %q", got)
+	}
+
+	// Source must be left alone (success/fail actions handle it) and no
+	// temporary files should be left behind in the destination.
+	if _, err := os.Stat(local); err != nil {
+		t.Fatalf("expected source to remain: %v", err)
+	}
+	entries, _ := os.ReadDir(dest)
+	if len(entries) != 1 {
+		t.Fatalf("expected only the copied file in destination, got %d entries", len(entries))
+	}
+}
+
+func TestCopyLocal_ReplacesExistingFile(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	local := mustWriteFile(t, src, "data.txt", "new")
+	mustWriteFile(t, dest, "data.txt", "old contents")
+
+	if _, err := CopyLocal(t.Context(), local, config.ConfigEntry{RemotePath: dest}); err != nil {
+		t.Fatalf("CopyLocal: %v", err)
+	}
+	got, _ := os.ReadFile(filepath.Join(dest, "data.txt"))
+	if string(got) != "new" {
+		t.Fatalf("expected destination to be replaced, got %q", got)
+	}
+}
+
+func TestCopyLocal_NoDestination(t *testing.T) {
+	local := mustWriteFile(t, t.TempDir(), "x.txt", "x")
+
+	_, err := CopyLocal(t.Context(), local, config.ConfigEntry{})
+	if err == nil || !strings.Contains(err.Error(), "no destination directory") {
+		t.Fatalf("expected missing destination error, got %v", err)
+	}
+}
+
+func TestCopyLocal_MissingDestinationDir(t *testing.T) {
+	tmp := t.TempDir()
+	local := mustWriteFile(t, tmp, "x.txt", "x")
+
+	_, err := CopyLocal(t.Context(), local, config.ConfigEntry{RemotePath: filepath.Join(tmp, "nope")})
+	if err == nil {
+		t.Fatalf("expected error for missing destination directory")
+	}
+}
+
+func TestCopyLocal_MissingSource(t *testing.T) {
+	tmp := t.TempDir()
+
+	_, err := CopyLocal(t.Context(), filepath.Join(tmp, "gone.txt"), config.ConfigEntry{RemotePath: tmp})
+	if err == nil || !strings.Contains(err.Error(), "failed to open local file") {
+		t.Fatalf("expected open error, got %v", err)
+	}
+}
+
+func TestCopyLocal_RecursiveKeepsSubdirectory(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	local := mustWriteFile(t, filepath.Join(src, "site1", "2024-03-01"), "report.csv", "a,b,c\n")
+
+	tf := config.ConfigEntry{Name: "t", SourceDirectory: src, RemotePath: dest, Recursive: true}
+	if _, err := CopyLocal(t.Context(), local, tf); err != nil {
+		t.Fatalf("CopyLocal: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dest, "site1", "2024-03-01", "report.csv"))
+	if err != nil || string(got) != "a,b,c\n" {
+		t.Fatalf("expected copy under the same subdirectory, got %q (err %v)", got, err)
+	}
+
+	// Without recursive the subdirectory is flattened, as before.
+	tf.Recursive = false
+	if _, err := CopyLocal(t.Context(), local, tf); err != nil {
+		t.Fatalf("CopyLocal: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "report.csv")); err != nil {
+		t.Fatalf("expected flattened copy: %v", err)
+	}
+}
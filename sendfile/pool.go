@@ -0,0 +1,331 @@
+package sendfile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultIdleTimeout       = 60 * time.Second
+	defaultKeepaliveInterval = 30 * time.Second
+	keepaliveTimeout         = 10 * time.Second
+)
+
+// defaultPool holds the connections shared by all of the SSH based uploaders.
+
+var defaultPool = NewPool()
+
+// ClosePool closes every pooled connection, eg. when the agent is stopping.
+
+func ClosePool() {
+	defaultPool.CloseAll()
+}
+
+// Pool keeps SSH (and SFTP) sessions open between files, so a burst of files to
+// the same server only pays for one dial and handshake. Connections are kept
+// alive with keepalive requests, closed once they have been idle for the
+// transfer's idle_timeout, and redialled if they break.
+
+type Pool struct {
+	mu    sync.Mutex
+	conns map[poolKey]*pooledConn
+}
+
+// poolKey identifies the connections that can be shared. As well as the server,
+// port and user it includes the credentials and host key settings, so a
+// connection is never reused by a transfer that would have verified it differently.
+
+type poolKey struct {
+	server   string
+	port     string
+	user     string
+	settings string
+}
+
+type pooledConn struct {
+	key    poolKey
+	client *ssh.Client
+
+	mu                sync.Mutex
+	sftpClient        *sftp.Client
+	inUse             int
+	lastUsed          time.Time
+	idleTimeout       time.Duration
+	keepaliveInterval time.Duration
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func NewPool() *Pool {
+	return &Pool{conns: make(map[poolKey]*pooledConn)}
+}
+
+func newPoolKey(transfer config.ConfigEntry) poolKey {
+	h := sha256.New()
+	for _, v := range []string{
+		transfer.PrivateKey, transfer.Certificate, transfer.Password,
+		transfer.HostKeyMode(), transfer.KnownHosts, transfer.HostKeyFingerprint,
+	} {
+		fmt.Fprintf(h, "%d:%s;", len(v), v)
+	}
+
+	return poolKey{
+		server:   strings.ToLower(transfer.Server),
+		port:     transfer.Port,
+		user:     transfer.Username,
+		settings: hex.EncodeToString(h.Sum(nil)),
+	}
+}
+
+// withConn runs fn on a connection to the transfer's server, dialling one if
+// there isn't an open connection in the pool. If fn fails on a pooled connection
+// and the connection turns out to be dead, fn is run again on a fresh connection -
+// a session that broke while idle shouldn't count as a failed attempt.
+
+func (p *Pool) withConn(transfer config.ConfigEntry, sshConfig *ssh.ClientConfig, fn func(*pooledConn) (string, error)) (string, error) {
+	c, reused, err := p.get(transfer, sshConfig)
+	if err != nil {
+		return "failed", err
+	}
+
+	result, err := fn(c)
+	if err != nil && !c.alive() {
+		p.discard(c)
+		if reused {
+			slog.Info("Pooled connection broken; redialling", "server", transfer.Server, "port", transfer.Port)
+			c, _, err = p.get(transfer, sshConfig)
+			if err != nil {
+				return "failed", err
+			}
+			result, err = fn(c)
+			if err != nil && !c.alive() {
+				p.discard(c)
+			}
+		}
+	}
+
+	p.release(c)
+	return result, err
+}
+
+// get returns an open connection for the transfer, and whether it came from the
+// pool.
+
+func (p *Pool) get(transfer config.ConfigEntry, sshConfig *ssh.ClientConfig) (*pooledConn, bool, error) {
+	key := newPoolKey(transfer)
+
+	p.mu.Lock()
+	if c, ok := p.conns[key]; ok && !c.isClosed() {
+		c.acquire(transfer)
+		p.mu.Unlock()
+		slog.Debug("Reusing pooled connection", "server", key.server, "port", key.port, "user", key.user)
+		return c, true, nil
+	}
+	p.mu.Unlock()
+
+	// Dial without holding the lock, so a slow or dead server doesn't hold up
+	// transfers to other servers.
+
+	client, err := dialSSH(transfer, sshConfig)
+	if err != nil {
+		return nil, false, err
+	}
+
+	c := &pooledConn{key: key, client: client, closed: make(chan struct{})}
+	c.acquire(transfer)
+
+	p.mu.Lock()
+	if existing, ok := p.conns[key]; ok && !existing.isClosed() {
+		// Someone else dialled at the same time; keep theirs.
+		existing.acquire(transfer)
+		p.mu.Unlock()
+		c.close()
+		return existing, true, nil
+	}
+	p.conns[key] = c
+	p.mu.Unlock()
+
+	slog.Debug("Opened pooled connection", "server", key.server, "port", key.port, "user", key.user)
+
+	go func() {
+		// Wait returns when the connection goes away for any reason.
+		_ = client.Wait()
+		p.discard(c)
+	}()
+	go p.monitor(c)
+
+	return c, false, nil
+}
+
+// release hands a connection back to the pool once an upload is finished with it.
+
+func (p *Pool) release(c *pooledConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inUse--
+	c.lastUsed = time.Now()
+}
+
+// discard closes a connection and removes it from the pool.
+
+func (p *Pool) discard(c *pooledConn) {
+	p.mu.Lock()
+	if p.conns[c.key] == c {
+		delete(p.conns, c.key)
+	}
+	p.mu.Unlock()
+	c.close()
+}
+
+// CloseAll closes every connection in the pool.
+
+func (p *Pool) CloseAll() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = make(map[poolKey]*pooledConn)
+	p.mu.Unlock()
+
+	for _, c := range conns {
+		c.close()
+	}
+}
+
+// monitor sends keepalives on an idle connection and closes it once it has been
+// unused for longer than its idle timeout.
+
+func (p *Pool) monitor(c *pooledConn) {
+	c.mu.Lock()
+	tick := min(c.idleTimeout, c.keepaliveInterval) / 2
+	c.mu.Unlock()
+
+	ticker := time.NewTicker(max(tick, 10*time.Millisecond))
+	defer ticker.Stop()
+
+	lastKeepalive := time.Now()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			idle := c.inUse == 0 && now.Sub(c.lastUsed) >= c.idleTimeout
+			keepaliveDue := now.Sub(lastKeepalive) >= c.keepaliveInterval
+			c.mu.Unlock()
+
+			if idle {
+				slog.Debug("Closing idle pooled connection", "server", c.key.server, "port", c.key.port)
+				p.discard(c)
+				return
+			}
+			if keepaliveDue {
+				lastKeepalive = now
+				if !c.alive() {
+					slog.Warn("Pooled connection failed keepalive; closing", "server", c.key.server, "port", c.key.port)
+					p.discard(c)
+					return
+				}
+			}
+		}
+	}
+}
+
+// acquire marks the connection as in use and picks up the transfer's timeouts.
+
+func (c *pooledConn) acquire(transfer config.ConfigEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inUse++
+	c.lastUsed = time.Now()
+
+	c.idleTimeout = transfer.IdleTimeout
+	if c.idleTimeout <= 0 {
+		c.idleTimeout = defaultIdleTimeout
+	}
+	c.keepaliveInterval = transfer.KeepaliveInterval
+	if c.keepaliveInterval <= 0 {
+		c.keepaliveInterval = defaultKeepaliveInterval
+	}
+}
+
+// SFTP returns the connection's SFTP client, starting the subsystem on first use.
+// Connections used only for scp never start it.
+
+func (c *pooledConn) SFTP() (*sftp.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sftpClient == nil {
+		client, err := sftp.NewClient(c.client)
+		if err != nil {
+			return nil, fmt.Errorf("SFTP client creation failed: %w", err)
+		}
+		c.sftpClient = client
+
+		// If the subsystem goes away while the SSH connection stays up, start a
+		// new one next time rather than keep handing out a dead client.
+		go func() {
+			_ = client.Wait()
+			c.mu.Lock()
+			if c.sftpClient == client {
+				c.sftpClient = nil
+			}
+			c.mu.Unlock()
+		}()
+	}
+	return c.sftpClient, nil
+}
+
+// alive checks the connection by sending a keepalive request and waiting
+// (briefly) for the reply.
+
+func (c *pooledConn) alive() bool {
+	if c.isClosed() {
+		return false
+	}
+
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := c.client.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+
+	select {
+	case err := <-reply:
+		return err == nil
+	case <-time.After(keepaliveTimeout):
+		return false
+	case <-c.closed:
+		return false
+	}
+}
+
+func (c *pooledConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *pooledConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.mu.Lock()
+		if c.sftpClient != nil {
+			c.sftpClient.Close()
+		}
+		c.mu.Unlock()
+		c.client.Close()
+	})
+}
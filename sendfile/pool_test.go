@@ -0,0 +1,190 @@
+package sendfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// pooled reports whether the default pool holds an open connection for srv.
+func pooled(srv *testSSHServer) bool {
+	_, port := srv.hostPort()
+	defaultPool.mu.Lock()
+	defer defaultPool.mu.Unlock()
+	for key, c := range defaultPool.conns {
+		if key.port == port && !c.isClosed() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestUploadSFTP_ReusesPooledConnection(t *testing.T) {
+	tmp := t.TempDir()
+	remote := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	tf := srv.transfer(keyPath, remote)
+
+	for i := range 5 {
+		local := mustWriteFile(t, tmp, fmt.Sprintf("f%d.csv", i), "data")
+		if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+			t.Fatalf("upload %d: %v", i, err)
+		}
+	}
+
+	if got := srv.connCount(); got != 1 {
+		t.Fatalf("expected 1 connection for 5 files, got %d", got)
+	}
+	entries, _ := os.ReadDir(remote)
+	if len(entries) != 5 {
+		t.Fatalf("expected 5 remote files, got %d", len(entries))
+	}
+}
+
+func TestUploadSCP_SharesPoolWithSFTP(t *testing.T) {
+	tmp := t.TempDir()
+	remote := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+
+	local := mustWriteFile(t, tmp, "a.txt", "a")
+	if _, err := UploadSFTP(t.Context(), local, srv.transfer(keyPath, remote)); err != nil {
+		t.Fatalf("UploadSFTP: %v", err)
+	}
+	if _, err := UploadSCP(t.Context(), local, scpTransfer(srv, keyPath, remote)); err != nil {
+		t.Fatalf("UploadSCP: %v", err)
+	}
+	if got := srv.connCount(); got != 1 {
+		t.Fatalf("expected scp to reuse the connection, got %d connections", got)
+	}
+}
+
+func TestPool_SeparatesHostKeySettings(t *testing.T) {
+	tmp := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	local := mustWriteFile(t, tmp, "a.txt", "a")
+
+	if _, err := UploadSFTP(t.Context(), local, srv.transfer(keyPath, t.TempDir())); err != nil {
+		t.Fatalf("UploadSFTP: %v", err)
+	}
+
+	// Same server and user, but a transfer with stricter host key settings
+	// must verify the server itself rather than borrow the open connection.
+	strict := srv.transfer(keyPath, t.TempDir())
+	strict.HostKeyCheck = "known_hosts"
+	strict.KnownHosts = filepath.Join(t.TempDir(), "empty_known_hosts")
+	os.WriteFile(strict.KnownHosts, nil, 0o600)
+
+	if _, err := UploadSFTP(t.Context(), local, strict); err == nil {
+		t.Fatalf("expected host key failure for strict transfer")
+	}
+}
+
+func TestPool_EvictsIdleConnections(t *testing.T) {
+	tmp := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	tf := srv.transfer(keyPath, t.TempDir())
+	tf.IdleTimeout = 200 * time.Millisecond
+
+	local := mustWriteFile(t, tmp, "a.txt", "a")
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("UploadSFTP: %v", err)
+	}
+	if !pooled(srv) {
+		t.Fatalf("expected connection to be pooled after upload")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for pooled(srv) {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle connection was not evicted")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("UploadSFTP after eviction: %v", err)
+	}
+	if got := srv.connCount(); got != 2 {
+		t.Fatalf("expected a new connection after eviction, got %d connections", got)
+	}
+}
+
+func TestPool_RedialsBrokenConnection(t *testing.T) {
+	tmp := t.TempDir()
+	remote := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	tf := srv.transfer(keyPath, remote)
+
+	local := mustWriteFile(t, tmp, "a.txt", "a")
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("UploadSFTP: %v", err)
+	}
+
+	srv.dropConnections()
+
+	start := time.Now()
+	local2 := mustWriteFile(t, tmp, "b.txt", "b")
+	if _, err := UploadSFTP(t.Context(), local2, tf); err != nil {
+		t.Fatalf("UploadSFTP after drop: %v", err)
+	}
+	// The broken session is replaced without using up a retry (and its delay).
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("redial took %v; expected no retry delay", elapsed)
+	}
+	if got := srv.connCount(); got != 2 {
+		t.Fatalf("expected a second connection, got %d", got)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "b.txt")); err != nil {
+		t.Fatalf("expected uploaded file: %v", err)
+	}
+}
+
+func TestPool_RestartsClosedSFTPSubsystem(t *testing.T) {
+	tmp := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	tf := srv.transfer(keyPath, t.TempDir())
+
+	local := mustWriteFile(t, tmp, "a.txt", "a")
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("UploadSFTP: %v", err)
+	}
+
+	// Kill the SFTP subsystem but leave the SSH connection up.
+	sshConfig, _ := sshClientConfig(tf)
+	c, reused, err := defaultPool.get(tf, sshConfig)
+	if err != nil || !reused {
+		t.Fatalf("expected pooled connection, reused=%v err=%v", reused, err)
+	}
+	sftpClient, _ := c.SFTP()
+	sftpClient.Close()
+	defaultPool.release(c)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c.mu.Lock()
+		cleared := c.sftpClient == nil
+		c.mu.Unlock()
+		if cleared {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("closed SFTP client was not cleared")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("UploadSFTP after subsystem closed: %v", err)
+	}
+	if got := srv.connCount(); got != 1 {
+		t.Fatalf("expected the SSH connection to be reused, got %d connections", got)
+	}
+}
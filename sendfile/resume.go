@@ -0,0 +1,81 @@
+package sendfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+
+	"github.com/pkg/sftp"
+)
+
+// resumeCheckSize is how much of the end of a partial upload is compared with
+// the local file before appending to it.
+const resumeCheckSize = 64 * 1024
+
+// uploadState carries what an earlier attempt at a file did over to the next
+// attempt, so a retry writes to the same destination and can carry on from
+// where the last attempt stopped.
+
+type uploadState struct {
+	dstPath string // final destination chosen by the first attempt
+	written bool   // an attempt has started writing the upload file
+}
+
+// resumeOffset works out how much of a partial upload at uploadPath can be kept.
+// The partial file has to be no bigger than the local one, and its last
+// {resumeCheckSize} bytes have to hash the same as the same range of the local
+// file. Anything else means starting again from zero.
+
+func resumeOffset(sftpClient *sftp.Client, uploadPath string, src *os.File, localSize int64) (int64, error) {
+	info, err := sftpClient.Stat(uploadPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat partial upload: %w", err)
+	}
+
+	remoteSize := info.Size()
+	if remoteSize == 0 || remoteSize > localSize {
+		return 0, nil
+	}
+
+	tail := min(remoteSize, resumeCheckSize)
+	start := remoteSize - tail
+
+	localHash, err := hashRange(src, start, tail)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read local file for resume: %w", err)
+	}
+
+	remoteFile, err := sftpClient.Open(uploadPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open partial upload: %w", err)
+	}
+	defer remoteFile.Close()
+
+	remoteHash, err := hashRange(remoteFile, start, tail)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read partial upload: %w", err)
+	}
+
+	if !bytes.Equal(localHash, remoteHash) {
+		slog.Warn("Partial upload doesn't match local file; starting again",
+			"dest", uploadPath, "partial_size", remoteSize)
+		return 0, nil
+	}
+	return remoteSize, nil
+}
+
+func hashRange(r io.ReaderAt, off, n int64) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, off, n)); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,129 @@
+package sendfile
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// resumeFixture sets up a test server, a local file larger than resumeCheckSize
+// and a partial upload holding its first half. The first byte of the partial
+// upload is changed: it is outside the range compared on resume, so it survives
+// only if the upload really was appended to rather than rewritten.
+
+func resumeFixture(t *testing.T, partialName string) (srv *testSSHServer, keyPath, local, remote string, want []byte) {
+	t.Helper()
+	tmp := t.TempDir()
+	remote = t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv = newTestSSHServer(t, pub)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*resumeCheckSize/16)
+	local = mustWriteFile(t, tmp, "image.dcm", string(data))
+
+	partial := bytes.Clone(data[:len(data)/2])
+	partial[0] = 'X'
+	mustWriteFile(t, remote, partialName, string(partial))
+
+	want = bytes.Clone(data)
+	want[0] = 'X'
+	return srv, keyPath, local, remote, want
+}
+
+func TestUploadSFTP_ResumesTempUpload(t *testing.T) {
+	srv, keyPath, local, remote, want := resumeFixture(t, ".image.dcm.part")
+	tf := srv.transfer(keyPath, remote)
+	tf.UploadMode = "temp"
+	tf.Resume = true
+
+	if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+		t.Fatalf("UploadSFTP: %v", err)
+	}
+
+	got, _ := os.ReadFile(filepath.Join(remote, "image.dcm"))
+	if !bytes.Equal(got, want) {
+		t.Fatalf("expected the partial upload to be appended to, got %d bytes", len(got))
+	}
+	if _, err := os.Stat(filepath.Join(remote, ".image.dcm.part")); !os.IsNotExist(err) {
+		t.Fatalf("expected temp file to be renamed away, stat err: %v", err)
+	}
+}
+
+func TestUploadSFTP_ResumeRestartsOnMismatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(t *testing.T, partialPath string)
+	}{
+		{
+			name: "tail differs",
+			modify: func(t *testing.T, partialPath string) {
+				f, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_APPEND, 0)
+				if err != nil {
+					t.Fatalf("open: %v", err)
+				}
+				defer f.Close()
+				f.WriteString("garbage")
+			},
+		},
+		{
+			name: "larger than local file",
+			modify: func(t *testing.T, partialPath string) {
+				if err := os.WriteFile(partialPath, bytes.Repeat([]byte("z"), 4*resumeCheckSize), 0o644); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, keyPath, local, remote, _ := resumeFixture(t, ".image.dcm.part")
+			tt.modify(t, filepath.Join(remote, ".image.dcm.part"))
+			tf := srv.transfer(keyPath, remote)
+			tf.UploadMode = "temp"
+			tf.Resume = true
+			tf.Verify = "checksum"
+
+			if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+				t.Fatalf("UploadSFTP: %v", err)
+			}
+
+			want, _ := os.ReadFile(local)
+			if got, _ := os.ReadFile(filepath.Join(remote, "image.dcm")); !bytes.Equal(got, want) {
+				t.Fatalf("expected a fresh upload (%d bytes), got %d bytes", len(want), len(got))
+			}
+		})
+	}
+}
+
+func TestUploadSFTP_DirectResumeOnlyOnRetry(t *testing.T) {
+	srv, keyPath, local, remote, want := resumeFixture(t, "image.dcm")
+	tf := srv.transfer(keyPath, remote)
+	tf.Resume = true
+	sshConfig := mustClientConfig(t, tf)
+	full, _ := os.ReadFile(local)
+
+	// A file that was already there before the upload started isn't ours, so
+	// the first attempt replaces it.
+	untouched, _ := os.ReadFile(filepath.Join(remote, "image.dcm"))
+	if _, err := uploadOnce(local, tf, sshConfig, &uploadState{}); err != nil {
+		t.Fatalf("uploadOnce: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(remote, "image.dcm")); !bytes.Equal(got, full) {
+		t.Fatal("expected the first attempt to rewrite the existing file")
+	}
+
+	// A retry carries on from what the failed attempt left behind.
+	if err := os.WriteFile(filepath.Join(remote, "image.dcm"), untouched, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	state := &uploadState{dstPath: path.Join(tf.RemotePath, "image.dcm"), written: true}
+	if _, err := uploadOnce(local, tf, sshConfig, state); err != nil {
+		t.Fatalf("uploadOnce: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(remote, "image.dcm")); !bytes.Equal(got, want) {
+		t.Fatal("expected the retry to append to the partial upload")
+	}
+}
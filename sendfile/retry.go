@@ -0,0 +1,126 @@
+package sendfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+)
+
+// sleep is sleepContext, swapped out by tests.
+var sleep = sleepContext
+
+// sleepContext waits for d, or until ctx is cancelled, when it returns ctx's
+// error.
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// permanentError marks a failure that retrying can't fix.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// localFileError reports a local source file that can't be opened - most often
+// because it has gone. Nothing at the server end will change that.
+
+func localFileError(err error) error {
+	return &permanentError{fmt.Errorf("failed to open local file: %w", err)}
+}
+
+// IsPermanent reports whether an upload error is one that retrying won't fix:
+// the server failing host key verification, being refused authentication, the
+// destination already existing with on_conflict: fail, the server being unable
+// to work out a checksum for verify, or the local file being unreadable.
+// Anything else, eg. a dial timeout or a dropped connection, is treated as
+// transient.
+
+func IsPermanent(err error) bool {
+	if err == nil {
+		return false
+	}
+	var perm *permanentError
+	switch {
+	case errors.As(err, &perm):
+		return true
+	case errors.Is(err, ErrHostKeyMismatch), errors.Is(err, ErrDestinationExists):
+		return true
+	}
+
+	// x/crypto/ssh doesn't have a typed error for a failed login.
+	return strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
+// withRetries runs a single upload attempt until it succeeds, fails with a
+// permanent error or has been tried retry.attempts times, backing off between
+// attempts. It is shared by all of the SSH based uploaders.
+//
+// Once ctx is cancelled (the agent is stopping) no further attempt is started
+// and the backoff wait is cut short. The error then wraps ctx's error, so the
+// upload counts as interrupted rather than failed.
+
+func withRetries(ctx context.Context, protocol string, filePath string, retry config.RetryConfig, attemptFn func() (string, error)) (string, error) {
+	retry = retry.WithDefaults()
+	var lastErr error
+
+	for attempt := 1; attempt <= retry.Attempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			slog.Info("Upload interrupted; agent is stopping", "file", filePath, "attempt", attempt)
+			return "", fmt.Errorf("upload interrupted: %w", err)
+		}
+		slog.Info("Attempting "+protocol+" upload", "file", filePath, "attempt", attempt)
+
+		result, err := attemptFn()
+		if err == nil {
+			return result, nil // successful transfer
+		}
+
+		lastErr = err
+		slog.Warn("Upload attempt failed", "file", filePath, "attempt", attempt, "error", err)
+
+		if IsPermanent(err) {
+			slog.Error("Upload failed with a permanent error; not retrying", "file", filePath, "error", err)
+			return "", err
+		}
+
+		if attempt < retry.Attempts {
+			delay := retryDelay(retry, attempt, rand.Float64)
+			slog.Info("Retrying after delay", "file", filePath, "delay", delay)
+			if err := sleep(ctx, delay); err != nil {
+				slog.Info("Upload interrupted while waiting to retry; agent is stopping", "file", filePath, "attempt", attempt)
+				return "", fmt.Errorf("upload interrupted: %w (last error: %w)", err, lastErr)
+			}
+		}
+	}
+
+	slog.Error("Upload failed after all retries", "file", filePath, "attempts", retry.Attempts, "error", lastErr)
+	return "", lastErr
+}
+
+// retryDelay is how long to wait after failed attempt n (1 based): initial_delay
+// grown by multiplier for each earlier failure, capped at max_delay, then spread
+// by jitter. random returns a number in [0, 1).
+
+func retryDelay(retry config.RetryConfig, n int, random func() float64) time.Duration {
+	delay := float64(retry.InitialDelay) * math.Pow(retry.Multiplier, float64(n-1))
+	delay = min(delay, float64(retry.MaxDelay))
+	if retry.Jitter != nil && *retry.Jitter > 0 {
+		delay *= 1 + *retry.Jitter*(2*random()-1)
+	}
+	return time.Duration(delay)
+}
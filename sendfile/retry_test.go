@@ -0,0 +1,149 @@
+package sendfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+)
+
+func TestRetryDelay(t *testing.T) {
+	retry := config.RetryConfig{
+		InitialDelay: time.Second,
+		MaxDelay:     5 * time.Second,
+		Multiplier:   2,
+	}
+	mid := func() float64 { return 0.5 }
+
+	for n, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		if got := retryDelay(retry, n, mid); got != want {
+			t.Errorf("attempt %d: got %v, want %v", n, got, want)
+		}
+	}
+
+	jitter := 0.5
+	retry.Jitter = &jitter
+	if got := retryDelay(retry, 1, func() float64 { return 0 }); got != 500*time.Millisecond {
+		t.Errorf("low jitter: got %v", got)
+	}
+	if got := retryDelay(retry, 1, func() float64 { return 0.999999 }); got < 1499*time.Millisecond || got > 1500*time.Millisecond {
+		t.Errorf("high jitter: got %v", got)
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{io.ErrUnexpectedEOF, false},
+		{fmt.Errorf("SSH dial failed: %w", errors.New("dial tcp: i/o timeout")), false},
+		{fmt.Errorf("%w: x", ErrVerificationFailed), false},
+		{fmt.Errorf("%w: x", ErrHostKeyMismatch), true},
+		{fmt.Errorf("%w: x", ErrDestinationExists), true},
+		{localFileError(os.ErrNotExist), true},
+		{fmt.Errorf("SSH dial failed: %w", errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey], no supported methods remain")), true},
+	}
+	for _, tt := range tests {
+		if got := IsPermanent(tt.err); got != tt.want {
+			t.Errorf("IsPermanent(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// countSleeps replaces sleep for the duration of a test and records the delays.
+func countSleeps(t *testing.T) *[]time.Duration {
+	var delays []time.Duration
+	sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	t.Cleanup(func() { sleep = sleepContext })
+	return &delays
+}
+
+func TestWithRetries_BacksOffUntilAttemptsUsed(t *testing.T) {
+	delays := countSleeps(t)
+	noJitter := 0.0
+	retry := config.RetryConfig{Attempts: 4, InitialDelay: time.Second, MaxDelay: 3 * time.Second, Multiplier: 2, Jitter: &noJitter}
+
+	calls := 0
+	_, err := withRetries(t.Context(), "TEST", "f", retry, func() (string, error) {
+		calls++
+		return "failed", io.ErrUnexpectedEOF
+	})
+	if !errors.Is(err, io.ErrUnexpectedEOF) || calls != 4 {
+		t.Fatalf("expected 4 failed calls, got %d (err %v)", calls, err)
+	}
+
+	// Jitter 0 turns it off, so the delays are exact.
+	want := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	if !slices.Equal(*delays, want) {
+		t.Fatalf("expected delays %v, got %v", want, *delays)
+	}
+}
+
+func TestWithRetries_CancelStopsBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	retry := config.RetryConfig{Attempts: 3, InitialDelay: time.Minute}
+
+	calls := 0
+	start := time.Now()
+	_, err := withRetries(ctx, "TEST", "f", retry, func() (string, error) {
+		calls++
+		time.AfterFunc(50*time.Millisecond, cancel) // stopped during the backoff
+		return "failed", io.ErrUnexpectedEOF
+	})
+	if !errors.Is(err, context.Canceled) || IsPermanent(err) {
+		t.Fatalf("expected an interrupted, non-permanent error, got %v", err)
+	}
+	if calls != 1 || time.Since(start) > 5*time.Second {
+		t.Fatalf("expected the backoff cut short after one attempt, got %d calls in %v", calls, time.Since(start))
+	}
+
+	// Nothing more is tried once cancelled.
+	if _, err := withRetries(ctx, "TEST", "f", retry, func() (string, error) {
+		t.Fatal("attempt started after cancel")
+		return "", nil
+	}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected an interrupted error, got %v", err)
+	}
+}
+
+func TestWithRetries_PermanentErrorStops(t *testing.T) {
+	delays := countSleeps(t)
+
+	calls := 0
+	_, err := withRetries(t.Context(), "TEST", "f", config.RetryConfig{Attempts: 5}, func() (string, error) {
+		calls++
+		return "failed", localFileError(os.ErrNotExist)
+	})
+	if !errors.Is(err, os.ErrNotExist) || calls != 1 || len(*delays) != 0 {
+		t.Fatalf("expected one attempt and no sleeps, got %d calls, %d sleeps (err %v)", calls, len(*delays), err)
+	}
+}
+
+func TestUploadSFTP_AuthFailureNotRetried(t *testing.T) {
+	delays := countSleeps(t)
+	tmp := t.TempDir()
+	keyPath, _ := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	_, otherPub := mustWriteEd25519Key(t, tmp, "other")
+	srv := newTestSSHServer(t, otherPub) // doesn't accept keyPath
+
+	local := mustWriteFile(t, tmp, "a.txt", "a")
+	_, err := UploadSFTP(t.Context(), local, srv.transfer(keyPath, filepath.Join(tmp, "remote")))
+	if !IsPermanent(err) {
+		t.Fatalf("expected a permanent auth error, got %v", err)
+	}
+	if len(*delays) != 0 {
+		t.Fatalf("expected no retries, slept %v", *delays)
+	}
+}
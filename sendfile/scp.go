@@ -0,0 +1,202 @@
+package sendfile
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/justin-molloy/tfagent/config"
+	"golang.org/x/crypto/ssh"
+)
+
+// UploadSCP sends a file using the SCP sink protocol ("scp -t") for servers that
+// only allow scp and not the SFTP subsystem. Key loading, retries and the SSH
+// connection settings are shared with UploadSFTP.
+
+func UploadSCP(ctx context.Context, filePath string, transfer config.ConfigEntry) (string, error) {
+	sshConfig, err := sshClientConfig(transfer)
+	if err != nil {
+		return "", err
+	}
+
+	return withRetries(ctx, "SCP", filePath, transfer.Retry, func() (string, error) {
+		return uploadSCPOnce(filePath, transfer, sshConfig)
+	})
+}
+
+func uploadSCPOnce(filePath string, transfer config.ConfigEntry, sshConfig *ssh.ClientConfig) (string, error) {
+	srcFile, err := os.Open(filePath)
+	if err != nil {
+		return "failed", localFileError(err)
+	}
+	defer srcFile.Close()
+
+	info, err := srcFile.Stat()
+	if err != nil {
+		return "failed", fmt.Errorf("failed to stat local file: %w", err)
+	}
+
+	mode, err := scpFileMode(transfer, info)
+	if err != nil {
+		return "failed", err
+	}
+
+	return defaultPool.withConn(transfer, sshConfig, func(c *pooledConn) (string, error) {
+		return scpUpload(c.client, srcFile, info, mode, transfer.RelativeDir(filePath), transfer)
+	})
+}
+
+// scpUpload sends the file into remotepath, or into subDir below it (a slash
+// separated path, created if needed) for recursive transfers.
+
+func scpUpload(conn *ssh.Client, srcFile io.ReadSeeker, info os.FileInfo, mode os.FileMode, subDir string, transfer config.ConfigEntry) (string, error) {
+	// A retry on a fresh connection must start from the beginning of the file.
+	if _, err := srcFile.Seek(0, io.SeekStart); err != nil {
+		return "failed", fmt.Errorf("failed to rewind local file: %w", err)
+	}
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return "failed", fmt.Errorf("SSH session creation failed: %w", err)
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return "failed", fmt.Errorf("SCP stdin pipe failed: %w", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return "failed", fmt.Errorf("SCP stdout pipe failed: %w", err)
+	}
+
+	// -p asks the remote end to apply the mode (and times, if sent) exactly as
+	// given, rather than leaving an existing file's mode alone. -r lets us send
+	// the subdirectories of a recursive transfer.
+
+	flags := "-t "
+	if subDir != "" {
+		flags = "-r " + flags
+	}
+	if transfer.PreserveMtime || strings.TrimSpace(transfer.FileMode) != "" {
+		flags = "-p " + flags
+	}
+	cmd := "scp " + flags + shellQuote(transfer.RemotePath)
+	if err := session.Start(cmd); err != nil {
+		return "failed", fmt.Errorf("failed to start remote scp: %w", err)
+	}
+
+	acks := bufio.NewReader(stdout)
+	if err := scpSend(stdin, acks, srcFile, info, mode, transfer.PreserveMtime, subDir); err != nil {
+		return "failed", err
+	}
+
+	// Closing stdin tells the remote scp that there are no more files.
+	stdin.Close()
+	if err := session.Wait(); err != nil {
+		return "failed", fmt.Errorf("remote scp exited with error: %w", err)
+	}
+
+	return "success", nil
+}
+
+// scpSend writes a single file to a remote "scp -t" sink, waiting for the sink to
+// acknowledge each protocol message. If subDir is set the file is wrapped in a
+// directory message for each part of it, which the sink creates as needed.
+
+func scpSend(w io.Writer, acks *bufio.Reader, src io.Reader, info os.FileInfo, mode os.FileMode, preserveMtime bool, subDir string) error {
+	if err := scpAck(acks); err != nil {
+		return fmt.Errorf("remote scp not ready: %w", err)
+	}
+
+	var dirs []string
+	if subDir != "" {
+		dirs = strings.Split(subDir, "/")
+	}
+	for _, dir := range dirs {
+		if _, err := fmt.Fprintf(w, "D0755 0 %s\n", dir); err != nil {
+			return fmt.Errorf("failed to send directory: %w", err)
+		}
+		if err := scpAck(acks); err != nil {
+			return fmt.Errorf("remote scp rejected directory %s: %w", dir, err)
+		}
+	}
+
+	if preserveMtime {
+		mtime := info.ModTime().Unix()
+		if _, err := fmt.Fprintf(w, "T%d 0 %d 0\n", mtime, mtime); err != nil {
+			return fmt.Errorf("failed to send file times: %w", err)
+		}
+		if err := scpAck(acks); err != nil {
+			return fmt.Errorf("remote scp rejected file times: %w", err)
+		}
+	}
+
+	if _, err := fmt.Fprintf(w, "C%04o %d %s\n", mode.Perm(), info.Size(), filepath.Base(info.Name())); err != nil {
+		return fmt.Errorf("failed to send file header: %w", err)
+	}
+	if err := scpAck(acks); err != nil {
+		return fmt.Errorf("remote scp rejected file: %w", err)
+	}
+
+	if _, err := io.CopyN(w, src, info.Size()); err != nil {
+		return fmt.Errorf("file copy failed: %w", err)
+	}
+	if _, err := w.Write([]byte{0}); err != nil {
+		return fmt.Errorf("file copy failed: %w", err)
+	}
+	if err := scpAck(acks); err != nil {
+		return fmt.Errorf("remote scp failed to write file: %w", err)
+	}
+
+	for range dirs {
+		if _, err := io.WriteString(w, "E\n"); err != nil {
+			return fmt.Errorf("failed to end directory: %w", err)
+		}
+		if err := scpAck(acks); err != nil {
+			return fmt.Errorf("remote scp failed to end directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// scpAck reads a response from the remote sink. A zero byte is success, 1 is a
+// warning and 2 is a fatal error; both of the latter are followed by a message.
+
+func scpAck(r *bufio.Reader) error {
+	code, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("reading scp response: %w", err)
+	}
+	if code == 0 {
+		return nil
+	}
+
+	msg, _ := r.ReadString('\n')
+	msg = strings.TrimSpace(msg)
+	if msg == "" {
+		msg = fmt.Sprintf("scp response code %d", code)
+	}
+	return errors.New(msg)
+}
+
+// scpFileMode returns the mode to create the remote file with - file_mode from the
+// config if set, or the local file's permissions.
+
+func scpFileMode(transfer config.ConfigEntry, info os.FileInfo) (os.FileMode, error) {
+	if strings.TrimSpace(transfer.FileMode) == "" {
+		return info.Mode().Perm(), nil
+	}
+	return config.ParseFileMode(transfer.FileMode)
+}
+
+// shellQuote quotes s for use as a single argument in a POSIX shell command.
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
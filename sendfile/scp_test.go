@@ -0,0 +1,161 @@
+package sendfile
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+)
+
+func scpTransfer(srv *testSSHServer, keyPath, remotePath string) config.ConfigEntry {
+	tf := srv.transfer(keyPath, remotePath)
+	tf.TransferType = "scp"
+	tf.RemotePath = remotePath
+	return tf
+}
+
+func TestUploadSCP_SendsFile(t *testing.T) {
+	tmp := t.TempDir()
+	remote := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+
+	local := mustWriteFile(t, tmp, "orders.csv", "id,qty\n1,2\n")
+
+	result, err := UploadSCP(t.Context(), local, scpTransfer(srv, keyPath, remote))
+	if err != nil {
+		t.Fatalf("UploadSCP: %v", err)
+	}
+	if result != "success" {
+		t.Fatalf("expected result 'success', got %q", result)
+	}
+
+	got, err := os.ReadFile(filepath.Join(remote, "orders.csv"))
+	if err != nil {
+		t.Fatalf("read remote: %v", err)
+	}
+	if string(got) != "id,qty\n1,2\n" {
+		t.Fatalf("unexpected remote contents %q", got)
+	}
+
+	// Without file_mode or preserve_mtime the plain sink is used.
+	cmds := srv.execCommands()
+	if len(cmds) != 1 || strings.Contains(cmds[0], "-p") {
+		t.Fatalf("expected a single 'scp -t' command, got %v", cmds)
+	}
+}
+
+func TestUploadSCP_RecursiveCreatesSubdirectories(t *testing.T) {
+	tmp := t.TempDir()
+	remote := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	source := filepath.Join(tmp, "source")
+	tf := scpTransfer(srv, keyPath, remote)
+	tf.SourceDirectory = source
+	tf.Recursive = true
+
+	local := mustWriteFile(t, filepath.Join(source, "a", "b"), "orders.csv", "id,qty\n")
+	if _, err := UploadSCP(t.Context(), local, tf); err != nil {
+		t.Fatalf("UploadSCP: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(remote, "a", "b", "orders.csv"))
+	if err != nil || string(got) != "id,qty\n" {
+		t.Fatalf("expected file under the same subdirectory, got %q (err %v)", got, err)
+	}
+	if cmds := srv.execCommands(); len(cmds) != 1 || !strings.Contains(cmds[0], "-r") {
+		t.Fatalf("expected a single 'scp -r -t' command, got %v", cmds)
+	}
+}
+
+func TestUploadSCP_SetsModeAndMtime(t *testing.T) {
+	tmp := t.TempDir()
+	remote := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+
+	local := mustWriteFile(t, tmp, "image.dat", "binary")
+	mtime := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(local, mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	tf := scpTransfer(srv, keyPath, remote)
+	tf.FileMode = "0640"
+	tf.PreserveMtime = true
+
+	if _, err := UploadSCP(t.Context(), local, tf); err != nil {
+		t.Fatalf("UploadSCP: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(remote, "image.dat"))
+	if err != nil {
+		t.Fatalf("stat remote: %v", err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Fatalf("expected mtime %v, got %v", mtime, info.ModTime())
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0o640 {
+		t.Fatalf("expected mode 0640, got %o", info.Mode().Perm())
+	}
+}
+
+func TestUploadSCP_RemoteErrorFails(t *testing.T) {
+	tmp := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+
+	local := mustWriteFile(t, tmp, "x.txt", "x")
+
+	// The sink can't create a file under a directory that doesn't exist.
+	tf := scpTransfer(srv, keyPath, filepath.Join(tmp, "missing", "deeper"))
+	if _, err := UploadSCP(t.Context(), local, tf); err == nil {
+		t.Fatalf("expected error from remote scp")
+	}
+}
+
+func TestUploadSCP_InvalidFileMode(t *testing.T) {
+	tmp := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+
+	local := mustWriteFile(t, tmp, "x.txt", "x")
+	tf := scpTransfer(srv, keyPath, tmp)
+	tf.FileMode = "rw-r--r--"
+
+	_, err := UploadSCP(t.Context(), local, tf)
+	if err == nil || !strings.Contains(err.Error(), "invalid file mode") {
+		t.Fatalf("expected invalid file mode error, got %v", err)
+	}
+}
+
+func TestScpAck(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr string
+	}{
+		{in: "\x00"},
+		{in: "\x01scp: warning message\n", wantErr: "scp: warning message"},
+		{in: "\x02scp: /nope: No such file or directory\n", wantErr: "No such file or directory"},
+		{in: "", wantErr: "reading scp response"},
+	}
+
+	for _, tt := range tests {
+		err := scpAck(bufio.NewReader(strings.NewReader(tt.in)))
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("scpAck(%q): unexpected error %v", tt.in, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("scpAck(%q): expected error containing %q, got %v", tt.in, tt.wantErr, err)
+		}
+	}
+}
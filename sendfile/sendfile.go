@@ -1,105 +1,236 @@
 package sendfile
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path"
-	"path/filepath"
+	"strings"
 	"time"
 
 	"log/slog"
 
 	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/sshkey"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
-func UploadSFTP(filePath string, transfer config.ConfigEntry) (string, error) {
-	const maxRetries = 3
-	const retryDelay = 2 * time.Second
-	var lastErr error
+// UploadSFTP sends a file to the transfer's SFTP server, retrying transient
+// failures. Retries stop if ctx is cancelled.
 
-	// read and validate private key
+func UploadSFTP(ctx context.Context, filePath string, transfer config.ConfigEntry) (string, error) {
+	sshConfig, err := sshClientConfig(transfer)
+	if err != nil {
+		return "", err
+	}
+
+	state := &uploadState{}
+	return withRetries(ctx, "SFTP", filePath, transfer.Retry, func() (string, error) {
+		return uploadOnce(filePath, transfer, sshConfig, state)
+	})
+}
 
-	key, err := os.ReadFile(transfer.PrivateKey)
+// sshClientConfig builds the SSH client settings for a transfer - credentials
+// and host key verification. It's done once per file, not once per attempt.
+
+func sshClientConfig(transfer config.ConfigEntry) (*ssh.ClientConfig, error) {
+	auth, err := authMethods(transfer)
 	if err != nil {
-		return "", fmt.Errorf("unable to read private key: %w", err)
+		return nil, err
 	}
 
-	signer, err := ssh.ParsePrivateKey(key)
+	hostKeyCallback, err := HostKeyCallback(transfer)
 	if err != nil {
-		return "", fmt.Errorf("unable to parse private key: %w", err)
+		return nil, err
 	}
 
-	// attempt file transfer {maxRetries} times
+	return &ssh.ClientConfig{
+		User:            transfer.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         10 * time.Second,
+	}, nil
+}
 
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		slog.Info("Attempting SFTP upload", "file", filePath, "attempt", attempt)
+// authMethods builds the SSH auth methods from whatever credentials the transfer
+// has. The client tries them in order, so the private key is offered first and
+// the password (plain, then keyboard-interactive) is the fallback.
 
-		result, err := uploadOnce(filePath, transfer, signer)
-		if err == nil {
-			return result, nil // successful transfer
+func authMethods(transfer config.ConfigEntry) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+
+	if strings.TrimSpace(transfer.PrivateKey) != "" {
+		signer, err := loadSigner(transfer)
+		if err != nil {
+			return nil, err
 		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
 
-		lastErr = err
-		slog.Warn("Upload attempt failed", "file", filePath, "error", err)
+	if transfer.Password != "" {
+		methods = append(methods,
+			ssh.Password(transfer.Password),
+			ssh.KeyboardInteractive(passwordChallenge(transfer.Password)),
+		)
+	}
 
-		if attempt < maxRetries {
-			slog.Info("Retrying after delay", "delay", retryDelay)
-			time.Sleep(retryDelay)
-		}
+	if len(methods) == 0 {
+		return nil, errors.New("no credentials configured (privatekey or password)")
 	}
+	return methods, nil
+}
 
-	slog.Error("Upload failed after all retries", "file", filePath, "error", lastErr)
-	return "", lastErr
+// passwordChallenge answers every keyboard-interactive prompt with the password.
+// Servers that only offer keyboard-interactive normally ask a single
+// "Password:" question.
+
+func passwordChallenge(password string) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range questions {
+			answers[i] = password
+		}
+		return answers, nil
+	}
 }
 
-func uploadOnce(filePath string, transfer config.ConfigEntry, signer ssh.Signer) (string, error) {
+// loadSigner reads and validates the private key (and certificate) for a transfer.
 
-	sshConfig := &ssh.ClientConfig{
-		User: transfer.Username,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // NOTE: Not safe for production
-		Timeout:         10 * time.Second,
+func loadSigner(transfer config.ConfigEntry) (ssh.Signer, error) {
+	passphrase, err := transfer.KeyPassphrase()
+	if err != nil {
+		return nil, err
 	}
+	return sshkey.LoadSigner(transfer.PrivateKey, passphrase, transfer.Certificate)
+}
+
+// dialSSH opens an SSH connection to the transfer's server.
 
-	addr := fmt.Sprintf("%s:%s", transfer.Server, transfer.Port)
+func dialSSH(transfer config.ConfigEntry, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	addr := net.JoinHostPort(transfer.Server, transfer.Port)
 	conn, err := ssh.Dial("tcp", addr, sshConfig)
 	if err != nil {
-		return "failed", fmt.Errorf("SSH dial failed: %w", err)
+		return nil, fmt.Errorf("SSH dial failed: %w", err)
 	}
-	defer conn.Close()
+	return conn, nil
+}
+
+func uploadOnce(filePath string, transfer config.ConfigEntry, sshConfig *ssh.ClientConfig, state *uploadState) (string, error) {
+	return defaultPool.withConn(transfer, sshConfig, func(c *pooledConn) (string, error) {
+		return sftpUpload(c, filePath, transfer, state)
+	})
+}
 
-	sftpClient, err := sftp.NewClient(conn)
+func sftpUpload(c *pooledConn, filePath string, transfer config.ConfigEntry, state *uploadState) (string, error) {
+	sftpClient, err := c.SFTP()
 	if err != nil {
-		return "failed", fmt.Errorf("SFTP client creation failed: %w", err)
+		return "failed", err
 	}
-	defer sftpClient.Close()
 
 	srcFile, err := os.Open(filePath)
 	if err != nil {
-		return "failed", fmt.Errorf("failed to open local file: %w", err)
+		return "failed", localFileError(err)
 	}
 	defer srcFile.Close()
 
+	info, err := srcFile.Stat()
+	if err != nil {
+		return "failed", fmt.Errorf("failed to stat local file: %w", err)
+	}
+
 	// filepath uses the local OS file type, but path always assumes linux.
 	// It's a good guess that a remote sftp target is unlikely to be Windows.
+	// A retry keeps the destination the first attempt chose - by then any file
+	// there may be our own partial upload.
+
+	dstPath := state.dstPath
+	if dstPath == "" {
+		remoteDir := transfer.RemotePath
+		if sub := transfer.RelativeDir(filePath); sub != "" {
+			remoteDir = path.Join(remoteDir, sub)
+			if err := sftpClient.MkdirAll(remoteDir); err != nil {
+				return "failed", fmt.Errorf("failed to create remote directory %s: %w", remoteDir, err)
+			}
+		}
 
-	remoteFileName := filepath.Base(filePath)
-	dstPath := path.Join(transfer.RemotePath, remoteFileName)
+		var skip bool
+		dstPath, skip, err = resolveConflict(transfer, filePath, remoteDir, path.Join, sftpClient.Stat)
+		if err != nil {
+			return "failed", err
+		}
+		if skip {
+			return "skipped", nil
+		}
+		state.dstPath = dstPath
+	}
+
+	// In temp mode the data goes to a temporary name and is renamed to the real
+	// name once it is complete, so nothing on the remote side sees a partial file.
+
+	uploadPath := dstPath
+	if transfer.TempUpload() {
+		uploadPath = tempUploadPath(transfer, dstPath)
+	}
 
-	dstFile, err := sftpClient.Create(dstPath)
+	// A temp file can only be left over from an earlier upload of this file, so
+	// it is always safe to resume. With direct uploads only resume what an
+	// earlier attempt of this upload wrote, not whatever was already there.
+
+	var offset int64
+	if transfer.Resume && (transfer.TempUpload() || state.written) {
+		offset, err = resumeOffset(sftpClient, uploadPath, srcFile, info.Size())
+		if err != nil {
+			return "failed", err
+		}
+	}
+
+	var dstFile *sftp.File
+	if offset > 0 {
+		slog.Info("Resuming upload", "file", filePath, "dest", uploadPath, "offset", offset, "size", info.Size())
+		dstFile, err = sftpClient.OpenFile(uploadPath, os.O_WRONLY)
+		if err == nil {
+			_, err = dstFile.Seek(offset, io.SeekStart)
+		}
+	} else {
+		dstFile, err = sftpClient.Create(uploadPath)
+	}
 	if err != nil {
 		return "failed", fmt.Errorf("failed to create remote file: %w", err)
 	}
 	defer dstFile.Close()
+	state.written = true
 
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
+	src, localSum, err := hashingReader(transfer, srcFile, offset)
+	if err != nil {
+		return "failed", err
+	}
+	if _, err := io.Copy(dstFile, src); err != nil {
 		return "failed", fmt.Errorf("file copy failed: %w", err)
 	}
 
+	if uploadPath != dstPath {
+		if err := syncRemote(sftpClient, dstFile); err != nil {
+			return "failed", err
+		}
+	}
+	if err := dstFile.Close(); err != nil {
+		return "failed", fmt.Errorf("failed to close remote file: %w", err)
+	}
+
+	// Verify before the rename, so a bad temp upload never gets the real name.
+	if err := verifyRemote(c, sftpClient, filePath, uploadPath, transfer, info.Size(), localSum()); err != nil {
+		return "failed", err
+	}
+
+	if uploadPath != dstPath {
+		if err := remoteRename(sftpClient, uploadPath, dstPath); err != nil {
+			return "failed", err
+		}
+	}
+
 	return "success", nil
 }
@@ -7,6 +7,7 @@ import (
 	"encoding/pem"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -57,6 +58,9 @@ func minimalTransfer(pkPath string) config.ConfigEntry {
 		Port:       "1",         // intentionally unreachable
 		RemotePath: "/tmp",
 		PrivateKey: pkPath,
+
+		HostKeyCheck: "tofu",
+		KnownHosts:   filepath.Join(filepath.Dir(pkPath), "known_hosts"),
 	}
 }
 
@@ -69,7 +73,7 @@ func TestUploadSFTP_ReadKeyError(t *testing.T) {
 	tf := minimalTransfer(missingKey)
 	local := mustWriteFile(t, tmp, "local.txt", "data")
 
-	_, err := UploadSFTP(local, tf)
+	_, err := UploadSFTP(t.Context(), local, tf)
 	if err == nil {
 		t.Fatalf("expected error reading missing private key")
 	}
@@ -84,7 +88,7 @@ func TestUploadSFTP_ParseKeyError(t *testing.T) {
 	tf := minimalTransfer(badKey)
 	local := mustWriteFile(t, tmp, "local.txt", "data")
 
-	_, err := UploadSFTP(local, tf)
+	_, err := UploadSFTP(t.Context(), local, tf)
 	if err == nil {
 		t.Fatalf("expected parse error for invalid key")
 	}
@@ -94,28 +98,21 @@ func TestUploadSFTP_ParseKeyError(t *testing.T) {
 }
 
 func TestUploadSFTP_DialFailure_RetriesAndReturnsError(t *testing.T) {
-	// This exercises the real retry loop (3 attempts, 2s delay between).
-	// Expect total wall time ≈ 4s due to two sleeps.
+	// The default policy: 3 attempts, waiting 2s and then 4s in between.
+	delays := countSleeps(t)
 	tmp := t.TempDir()
 	keyPath := mustWriteRSAPrivateKey(t, tmp, "id_rsa")
 	tf := minimalTransfer(keyPath)
+	noJitter := 0.0
+	tf.Retry = config.RetryConfig{Jitter: &noJitter}
 	local := mustWriteFile(t, tmp, "local.txt", "data")
 
-	start := time.Now()
-	_, err := UploadSFTP(local, tf)
-	elapsed := time.Since(start)
-
-	if err == nil {
+	if _, err := UploadSFTP(t.Context(), local, tf); err == nil {
 		t.Fatalf("expected dial failure error (unreachable addr)")
 	}
 
-	// We can't inspect internal attempt count without stubs,
-	// but elapsed time should reflect two retries (~4s).
-	if elapsed < 3900*time.Millisecond {
-		t.Fatalf("expected ~4s elapsed due to retries; got %v", elapsed)
-	}
-	// Upper bound sanity (to catch accidental hangs): allow some headroom.
-	if elapsed > 8*time.Second {
-		t.Fatalf("upload took unexpectedly long: %v", elapsed)
+	want := []time.Duration{2 * time.Second, 4 * time.Second}
+	if !slices.Equal(*delays, want) {
+		t.Fatalf("expected retry delays %v, got %v", want, *delays)
 	}
 }
@@ -0,0 +1,452 @@
+package sendfile
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHServer is a minimal in-process SSH server for exercising the uploaders.
+// It accepts the configured client key, serves the SFTP subsystem from the local
+// filesystem and implements enough of "scp -t" to receive single files.
+
+type testSSHServer struct {
+	t       *testing.T
+	ln      net.Listener
+	hostKey ssh.Signer
+
+	cfgMu  sync.RWMutex // guards config changes made after the server starts
+	config *ssh.ServerConfig
+
+	mu       sync.Mutex
+	conns    int
+	netConns []net.Conn
+	commands []string
+	authLog  []string
+
+	corruptChecksums bool // sha256sum reports a wrong digest
+	refuseExec       bool // exec requests are refused, as on an SFTP-only account
+	noSha256sum      bool // sha256sum isn't installed
+}
+
+func newTestSSHServer(t *testing.T, clientKey ssh.PublicKey) *testSSHServer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate host key: %v", err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("host signer: %v", err)
+	}
+
+	srv := &testSSHServer{t: t, hostKey: hostKey}
+	srv.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if clientKey != nil && string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key")
+		},
+	}
+	srv.config.AuthLogCallback = func(_ ssh.ConnMetadata, method string, err error) {
+		if err == nil {
+			srv.mu.Lock()
+			srv.authLog = append(srv.authLog, method)
+			srv.mu.Unlock()
+		}
+	}
+	srv.config.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv.ln = ln
+	t.Cleanup(func() { ln.Close() })
+
+	go srv.serve()
+	return srv
+}
+
+func (s *testSSHServer) hostPort() (string, string) {
+	host, port, _ := net.SplitHostPort(s.ln.Addr().String())
+	return host, port
+}
+
+// transfer returns an sftp transfer pointed at the test server. The host key is
+// trusted on first use via a known_hosts file next to the client key.
+
+func (s *testSSHServer) transfer(keyPath, remotePath string) config.ConfigEntry {
+	host, port := s.hostPort()
+	return config.ConfigEntry{
+		Name:         "ssh-test",
+		TransferType: "sftp",
+		Username:     "user",
+		Server:       host,
+		Port:         port,
+		PrivateKey:   keyPath,
+		RemotePath:   filepath.ToSlash(remotePath),
+		HostKeyCheck: "tofu",
+		KnownHosts:   filepath.Join(filepath.Dir(keyPath), "known_hosts"),
+	}
+}
+
+// allowPassword lets clients log in with the password auth method.
+
+func (s *testSSHServer) allowPassword(password string) {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+
+	s.config.PasswordCallback = func(_ ssh.ConnMetadata, given []byte) (*ssh.Permissions, error) {
+		if string(given) == password {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("wrong password")
+	}
+}
+
+// allowKeyboardInteractive lets clients log in by answering a password prompt.
+
+func (s *testSSHServer) allowKeyboardInteractive(password string) {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+
+	s.config.KeyboardInteractiveCallback = func(_ ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		answers, err := client("", "", []string{"Password: "}, []bool{false})
+		if err != nil {
+			return nil, err
+		}
+		if len(answers) == 1 && answers[0] == password {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("wrong password")
+	}
+}
+
+// trustUserCA accepts user certificates signed by ca, instead of plain keys.
+
+func (s *testSSHServer) trustUserCA(ca ssh.PublicKey) {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return string(auth.Marshal()) == string(ca.Marshal())
+		},
+	}
+	s.config.PublicKeyCallback = checker.Authenticate
+}
+
+// successfulAuths returns the auth methods that clients logged in with.
+
+func (s *testSSHServer) successfulAuths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.authLog...)
+}
+
+// dropConnections closes every client connection from the server side.
+
+func (s *testSSHServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, nc := range s.netConns {
+		nc.Close()
+	}
+	s.netConns = nil
+}
+
+func (s *testSSHServer) connCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+func (s *testSSHServer) execCommands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *testSSHServer) serve() {
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(nc)
+	}
+}
+
+func (s *testSSHServer) handleConn(nc net.Conn) {
+	s.cfgMu.RLock()
+	_, chans, reqs, err := ssh.NewServerConn(nc, s.config)
+	s.cfgMu.RUnlock()
+	if err != nil {
+		nc.Close()
+		return
+	}
+	s.mu.Lock()
+	s.conns++
+	s.netConns = append(s.netConns, nc)
+	s.mu.Unlock()
+
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSession(ch, chReqs)
+	}
+}
+
+func (s *testSSHServer) handleSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	for req := range reqs {
+		switch req.Type {
+		case "subsystem":
+			if payloadString(req.Payload) != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			server, err := sftp.NewServer(ch)
+			if err != nil {
+				return
+			}
+			_ = server.Serve()
+			return
+
+		case "exec":
+			cmd := payloadString(req.Payload)
+			s.mu.Lock()
+			s.commands = append(s.commands, cmd)
+			refuse := s.refuseExec
+			s.mu.Unlock()
+			if refuse {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			status := s.runCommand(ch, cmd)
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// runCommand executes the handful of remote commands the uploaders use.
+
+func (s *testSSHServer) runCommand(ch ssh.Channel, cmd string) uint32 {
+	args := strings.Fields(cmd)
+	if len(args) >= 2 && args[0] == "scp" {
+		preserve := false
+		for _, a := range args[1 : len(args)-1] {
+			if a == "-p" {
+				preserve = true
+			}
+		}
+		target := unquote(strings.TrimSpace(cmd[strings.Index(cmd, "-t ")+3:]))
+		if err := scpSink(ch, target, preserve); err != nil {
+			fmt.Fprintf(ch.Stderr(), "scp: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	s.mu.Lock()
+	noSha256sum := s.noSha256sum
+	s.mu.Unlock()
+	if len(args) >= 2 && args[0] == "sha256sum" && !noSha256sum {
+		target := unquote(strings.TrimSpace(strings.TrimPrefix(cmd, "sha256sum")))
+		data, err := os.ReadFile(target)
+		if err != nil {
+			fmt.Fprintf(ch.Stderr(), "sha256sum: %v\n", err)
+			return 1
+		}
+		sum := sha256.Sum256(data)
+		s.mu.Lock()
+		if s.corruptChecksums {
+			sum[0] ^= 0xff
+		}
+		s.mu.Unlock()
+		fmt.Fprintf(ch, "%x  %s\n", sum, target)
+		return 0
+	}
+
+	fmt.Fprintf(ch.Stderr(), "%s: command not found\n", args[0])
+	return 127
+}
+
+// scpSink receives files in the scp sink protocol into the target directory.
+
+func scpSink(ch ssh.Channel, target string, preserve bool) error {
+	r := bufio.NewReader(ch)
+	ack := func() { ch.Write([]byte{0}) }
+	nack := func(msg string) error {
+		fmt.Fprintf(ch, "\x02%s\n", msg)
+		return fmt.Errorf("%s", msg)
+	}
+
+	ack()
+	var mtime time.Time
+	var dirs []string // directories entered with D messages
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch line[0] {
+		case 'T':
+			var m, a int64
+			var mu, au int
+			if _, err := fmt.Sscanf(line, "T%d %d %d %d", &m, &mu, &a, &au); err != nil {
+				return nack("bad T message")
+			}
+			mtime = time.Unix(m, 0)
+			ack()
+
+		case 'C':
+			parts := strings.SplitN(line[1:], " ", 3)
+			if len(parts) != 3 {
+				return nack("bad C message")
+			}
+			mode, err := strconv.ParseUint(parts[0], 8, 32)
+			if err != nil {
+				return nack("bad mode")
+			}
+			size, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return nack("bad size")
+			}
+			dst := target
+			if len(dirs) > 0 {
+				dst = filepath.Join(dirs[len(dirs)-1], parts[2])
+			} else if info, err := os.Stat(target); err == nil && info.IsDir() {
+				dst = filepath.Join(target, parts[2])
+			}
+			f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(mode))
+			if err != nil {
+				return nack(err.Error())
+			}
+			ack()
+
+			_, err = io.CopyN(f, r, size)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			if b, err := r.ReadByte(); err != nil || b != 0 {
+				return fmt.Errorf("missing end of file marker")
+			}
+			if preserve {
+				os.Chmod(dst, os.FileMode(mode))
+				if !mtime.IsZero() {
+					os.Chtimes(dst, mtime, mtime)
+				}
+			}
+			mtime = time.Time{}
+			ack()
+
+		case 'D':
+			parts := strings.SplitN(line[1:], " ", 3)
+			if len(parts) != 3 {
+				return nack("bad D message")
+			}
+			parent := target
+			if len(dirs) > 0 {
+				parent = dirs[len(dirs)-1]
+			}
+			dir := filepath.Join(parent, parts[2])
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return nack(err.Error())
+			}
+			dirs = append(dirs, dir)
+			ack()
+
+		case 'E':
+			if len(dirs) == 0 {
+				return nack("unexpected E message")
+			}
+			dirs = dirs[:len(dirs)-1]
+			ack()
+
+		default:
+			return nack("unsupported scp message")
+		}
+	}
+}
+
+func payloadString(payload []byte) string {
+	var msg struct{ Value string }
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return ""
+	}
+	return msg.Value
+}
+
+// unquote reverses shellQuote for a single argument.
+
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return strings.ReplaceAll(s[1:len(s)-1], `'\''`, `'`)
+	}
+	return s
+}
+
+// mustWriteEd25519Key writes an OpenSSH format ed25519 private key and returns
+// its path along with the matching public key.
+
+func mustWriteEd25519Key(t *testing.T, dir, name string) (string, ssh.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	blk, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	fp := filepath.Join(dir, name)
+	if err := os.WriteFile(fp, pem.EncodeToMemory(blk), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("public key: %v", err)
+	}
+	return fp, sshPub
+}
@@ -0,0 +1,156 @@
+package sendfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrVerificationFailed is returned when the file at the destination doesn't
+// match what was sent. It counts as a failed attempt, so the upload is retried.
+var ErrVerificationFailed = errors.New("verification failed")
+
+// ErrChecksumUnavailable is returned when verify: checksum can't run sha256sum
+// on the server, eg. an SFTP-only account. Sending the file again won't change
+// that, so it is a permanent error rather than a failed verification.
+var ErrChecksumUnavailable = errors.New("remote checksum unavailable")
+
+// hashingReader positions the source file at offset for sending. With verify:
+// checksum it also wraps it so the local SHA-256 is worked out as the data is
+// sent rather than in a second pass; anything before offset (already at the
+// destination from a resumed upload) is hashed first.
+
+func hashingReader(transfer config.ConfigEntry, src *os.File, offset int64) (io.Reader, func() string, error) {
+	noSum := func() string { return "" }
+	if transfer.VerifyMode() != "checksum" {
+		if _, err := src.Seek(offset, io.SeekStart); err != nil {
+			return nil, noSum, fmt.Errorf("failed to seek local file: %w", err)
+		}
+		return src, noSum, nil
+	}
+
+	h := sha256.New()
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, noSum, fmt.Errorf("failed to seek local file: %w", err)
+	}
+	if _, err := io.CopyN(h, src, offset); err != nil {
+		return nil, noSum, fmt.Errorf("failed to read local file: %w", err)
+	}
+	return io.TeeReader(src, h), func() string { return hex.EncodeToString(h.Sum(nil)) }, nil
+}
+
+// verifyRemote checks an uploaded file against the local one, using the
+// transfer's verify mode. size compares the remote file's length; checksum runs
+// sha256sum on the server (pkg/sftp can't send check-file requests) and compares
+// it with localSum.
+
+func verifyRemote(c *pooledConn, sftpClient *sftp.Client, file, remotePath string, transfer config.ConfigEntry, size int64, localSum string) error {
+	switch transfer.VerifyMode() {
+	case "size":
+		info, err := sftpClient.Stat(remotePath)
+		if err != nil {
+			return fmt.Errorf("failed to stat remote file for verification: %w", err)
+		}
+		if info.Size() != size {
+			return fmt.Errorf("%w: %s is %d bytes, expected %d", ErrVerificationFailed, remotePath, info.Size(), size)
+		}
+
+	case "checksum":
+		remoteSum, err := remoteSHA256(c, remotePath)
+		if err != nil {
+			return err
+		}
+		if remoteSum != localSum {
+			return fmt.Errorf("%w: %s has sha256 %s, expected %s", ErrVerificationFailed, remotePath, remoteSum, localSum)
+		}
+
+	default:
+		return nil
+	}
+
+	slog.Debug("Upload verified", "file", file, "dest", remotePath, "verify", transfer.VerifyMode())
+	return nil
+}
+
+// remoteSHA256 runs sha256sum on the server and returns the hex digest. A
+// server that refuses to run it, doesn't have it, or runs something else in
+// its place (ForceCommand internal-sftp) gives ErrChecksumUnavailable.
+
+func remoteSHA256(c *pooledConn, remotePath string) (string, error) {
+	session, err := c.client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("failed to open session for checksum: %w", err)
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	out, err := session.Output("sha256sum " + shellQuote(remotePath))
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr) && (exitErr.ExitStatus() == 126 || exitErr.ExitStatus() == 127),
+		// x/crypto/ssh doesn't have a typed error for a refused exec request.
+		strings.HasPrefix(err.Error(), "ssh: command "):
+		return "", checksumUnavailable(fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String())))
+	default:
+		return "", fmt.Errorf("remote sha256sum failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", checksumUnavailable(fmt.Errorf("unexpected sha256sum output %q", strings.TrimSpace(string(out))))
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+func checksumUnavailable(err error) error {
+	return &permanentError{fmt.Errorf("%w (the account needs shell access to run sha256sum; use verify: size instead): %w", ErrChecksumUnavailable, err)}
+}
+
+// verifyLocal is verifyRemote for local copies. The checksum is worked out by
+// reading the copy back from disk.
+
+func verifyLocal(file, dstPath string, transfer config.ConfigEntry, size int64, localSum string) error {
+	switch transfer.VerifyMode() {
+	case "size":
+		info, err := os.Stat(dstPath)
+		if err != nil {
+			return fmt.Errorf("failed to stat copy for verification: %w", err)
+		}
+		if info.Size() != size {
+			return fmt.Errorf("%w: %s is %d bytes, expected %d", ErrVerificationFailed, dstPath, info.Size(), size)
+		}
+
+	case "checksum":
+		f, err := os.Open(dstPath)
+		if err != nil {
+			return fmt.Errorf("failed to open copy for verification: %w", err)
+		}
+		defer f.Close()
+
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return fmt.Errorf("failed to read copy for verification: %w", err)
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != localSum {
+			return fmt.Errorf("%w: %s has sha256 %s, expected %s", ErrVerificationFailed, dstPath, sum, localSum)
+		}
+
+	default:
+		return nil
+	}
+
+	slog.Debug("Copy verified", "file", file, "dest", dstPath, "verify", transfer.VerifyMode())
+	return nil
+}
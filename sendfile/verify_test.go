@@ -0,0 +1,107 @@
+package sendfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/justin-molloy/tfagent/config"
+)
+
+func TestUploadSFTP_Verify(t *testing.T) {
+	for _, mode := range []string{"size", "checksum"} {
+		t.Run(mode, func(t *testing.T) {
+			tmp := t.TempDir()
+			remote := t.TempDir()
+			keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+			srv := newTestSSHServer(t, pub)
+			tf := srv.transfer(keyPath, filepath.Join(remote, "with space"))
+			tf.Verify = mode
+			if err := os.Mkdir(filepath.Join(remote, "with space"), 0o755); err != nil {
+				t.Fatalf("mkdir: %v", err)
+			}
+
+			local := mustWriteFile(t, tmp, "it's.csv", "some data")
+			if _, err := UploadSFTP(t.Context(), local, tf); err != nil {
+				t.Fatalf("UploadSFTP: %v", err)
+			}
+		})
+	}
+}
+
+func TestUploadSFTP_ChecksumMismatch(t *testing.T) {
+	tmp := t.TempDir()
+	remote := t.TempDir()
+	keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+	srv := newTestSSHServer(t, pub)
+	srv.mu.Lock()
+	srv.corruptChecksums = true
+	srv.mu.Unlock()
+	tf := srv.transfer(keyPath, remote)
+	tf.Verify = "checksum"
+	tf.UploadMode = "temp"
+
+	local := mustWriteFile(t, tmp, "data.csv", "some data")
+	_, err := uploadOnce(local, tf, mustClientConfig(t, tf), &uploadState{})
+	if !errors.Is(err, ErrVerificationFailed) {
+		t.Fatalf("expected ErrVerificationFailed, got %v", err)
+	}
+
+	// The bad upload must not have been renamed to the real name.
+	if _, err := os.Stat(filepath.Join(remote, "data.csv")); !os.IsNotExist(err) {
+		t.Fatalf("expected no file under the final name, stat err: %v", err)
+	}
+	if got := srv.execCommands(); len(got) != 1 || got[0] != "sha256sum '"+filepath.ToSlash(filepath.Join(remote, ".data.csv.part"))+"'" {
+		t.Fatalf("unexpected commands: %q", got)
+	}
+}
+
+func TestUploadSFTP_ChecksumUnavailable(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*testSSHServer)
+	}{
+		{name: "exec refused", setup: func(s *testSSHServer) { s.refuseExec = true }},
+		{name: "no sha256sum", setup: func(s *testSSHServer) { s.noSha256sum = true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			keyPath, pub := mustWriteEd25519Key(t, tmp, "id_ed25519")
+			srv := newTestSSHServer(t, pub)
+			srv.mu.Lock()
+			tt.setup(srv)
+			srv.mu.Unlock()
+			tf := srv.transfer(keyPath, t.TempDir())
+			tf.Verify = "checksum"
+
+			local := mustWriteFile(t, tmp, "data.csv", "some data")
+			_, err := uploadOnce(local, tf, mustClientConfig(t, tf), &uploadState{})
+			if !errors.Is(err, ErrChecksumUnavailable) || errors.Is(err, ErrVerificationFailed) {
+				t.Fatalf("expected ErrChecksumUnavailable, got %v", err)
+			}
+			if !IsPermanent(err) {
+				t.Fatalf("expected a permanent error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCopyLocal_Verify(t *testing.T) {
+	for _, mode := range []string{"size", "checksum"} {
+		t.Run(mode, func(t *testing.T) {
+			src := t.TempDir()
+			dest := t.TempDir()
+			local := mustWriteFile(t, src, "data.csv", "some data")
+
+			tf := config.ConfigEntry{TransferType: "local", RemotePath: dest, Verify: mode}
+			if _, err := CopyLocal(t.Context(), local, tf); err != nil {
+				t.Fatalf("CopyLocal: %v", err)
+			}
+			if got, _ := os.ReadFile(filepath.Join(dest, "data.csv")); string(got) != "some data" {
+				t.Fatalf("unexpected copy contents %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+//go:build unix
+
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+	"github.com/justin-molloy/tfagent/journal"
+	"github.com/justin-molloy/tfagent/selector"
+	"github.com/justin-molloy/tfagent/tracker"
+)
+
+// heartbeatInterval is how often the heartbeat is logged when service_heartbeat
+// is set.
+var heartbeatInterval = 30 * time.Second
+
+// Daemon runs the agent in the foreground on Linux and other POSIX systems,
+// under systemd or any other process supervisor. It's the counterpart of
+// TFAgentService on Windows and runs the same pipeline.
+
+type Daemon struct {
+	Name       string
+	Config     *config.ConfigData
+	Tracker    *tracker.EventTracker
+	FileQueue  chan job.Job
+	Processing *selector.FileSelector
+	Journal    *journal.Journal
+
+	// ReopenLog is called on SIGHUP so the log file can be rotated.
+	ReopenLog func() error
+}
+
+// Run starts the pipeline and handles signals until it's told to stop:
+// SIGINT or SIGTERM stop the agent and SIGHUP reopens the log file. If systemd
+// started the agent it's told when the agent is ready and when it's stopping,
+// and kept informed if the watchdog is enabled. Stopping waits for uploads in
+// progress, up to the shutdown grace period, with systemd's stop timeout
+// extended meanwhile. It returns the exit code: 0 once the agent has stopped,
+// or 1 if uploads were still in progress when the grace period ran out.
+
+func (d *Daemon) Run(signals <-chan os.Signal) int {
+	p := Start(d.Config, d.Tracker, d.FileQueue, d.Processing, d.Journal)
+
+	if ok, err := Notify("READY=1\nSTATUS=Running"); err != nil {
+		slog.Warn("Unable to notify systemd", "error", err)
+	} else if ok {
+		slog.Info("Notified systemd that the agent is ready")
+	}
+
+	var watchdog <-chan time.Time
+	if interval := WatchdogInterval(); interval > 0 {
+		// Twice as often as required, so one late message doesn't get the
+		// agent restarted.
+		t := time.NewTicker(interval / 2)
+		defer t.Stop()
+		watchdog = t.C
+		slog.Info("systemd watchdog enabled", "interval", interval)
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	slog.Info("Agent started", "name", d.Name, "pid", os.Getpid())
+
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				d.reopenLog()
+				continue
+			}
+			slog.Info("Program terminated by signal; stopping", "signal", sig.String())
+			Notify(fmt.Sprintf("STOPPING=1\nSTATUS=Stopping; waiting for uploads in progress\nEXTEND_TIMEOUT_USEC=%d", p.Limit().Microseconds()))
+			stopped := p.Stop(func(remaining time.Duration) {
+				// Keep the watchdog and the stop timeout from ending the wait early.
+				Notify(fmt.Sprintf("WATCHDOG=1\nEXTEND_TIMEOUT_USEC=%d", (remaining + stopProgressInterval).Microseconds()))
+			})
+			if !stopped {
+				return 1
+			}
+			return 0
+
+		case <-watchdog:
+			if _, err := Notify("WATCHDOG=1"); err != nil {
+				slog.Warn("Unable to notify systemd watchdog", "error", err)
+			}
+
+		case <-heartbeat.C:
+			degraded := tracker.Degraded()
+			if d.Config.Heartbeat {
+				slog.Info("Agent heartbeat", "name", d.Name, "degraded", len(degraded))
+				for dir, reason := range degraded {
+					slog.Warn("Source directory degraded", "source", dir, "reason", reason)
+				}
+			}
+			status := "STATUS=Running"
+			if len(degraded) > 0 {
+				status = fmt.Sprintf("STATUS=Running; %d source directories degraded", len(degraded))
+			}
+			Notify(status)
+		}
+	}
+}
+
+func (d *Daemon) reopenLog() {
+	if d.ReopenLog == nil {
+		return
+	}
+	if err := d.ReopenLog(); err != nil {
+		slog.Error("Unable to reopen log file", "error", err)
+	}
+}
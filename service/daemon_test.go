@@ -0,0 +1,138 @@
+//go:build unix
+
+package service
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+	"github.com/justin-molloy/tfagent/selector"
+	"github.com/justin-molloy/tfagent/tracker"
+)
+
+// notifySocket listens where systemd would, and returns the messages sent to it.
+func notifySocket(t *testing.T) <-chan string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	msgs := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			msgs <- string(buf[:n])
+		}
+	}()
+	return msgs
+}
+
+// waitForMessage waits for a message starting with want.
+func waitForMessage(t *testing.T, msgs <-chan string, want string) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case got := <-msgs:
+			if strings.HasPrefix(got, want) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if ok, err := Notify("READY=1"); ok || err != nil {
+		t.Fatalf("expected nothing sent without NOTIFY_SOCKET, got %v, %v", ok, err)
+	}
+
+	msgs := notifySocket(t)
+	if ok, err := Notify("READY=1"); !ok || err != nil {
+		t.Fatalf("Notify: %v, %v", ok, err)
+	}
+	waitForMessage(t, msgs, "READY=1")
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{usec: "", want: 0},
+		{usec: "nonsense", want: 0},
+		{usec: "30000000", want: 30 * time.Second},
+		{usec: "30000000", pid: strconv.Itoa(os.Getpid()), want: 30 * time.Second},
+		{usec: "30000000", pid: "1", want: 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("WATCHDOG_USEC", tt.usec)
+		t.Setenv("WATCHDOG_PID", tt.pid)
+		if got := WatchdogInterval(); got != tt.want {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: expected %v, got %v", tt.usec, tt.pid, tt.want, got)
+		}
+	}
+}
+
+func TestDaemon_Run(t *testing.T) {
+	msgs := notifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "100000") // 100ms
+	t.Setenv("WATCHDOG_PID", "")
+
+	reopened := make(chan struct{}, 1)
+	d := &Daemon{
+		Name:       "tfagent-test",
+		Config:     &config.ConfigData{},
+		Tracker:    tracker.NewEventTracker(),
+		FileQueue:  make(chan job.Job),
+		Processing: selector.NewFileSelector(),
+		ReopenLog: func() error {
+			reopened <- struct{}{}
+			return nil
+		},
+	}
+	close(d.FileQueue)
+
+	signals := make(chan os.Signal, 1)
+	code := make(chan int, 1)
+	go func() { code <- d.Run(signals) }()
+
+	waitForMessage(t, msgs, "READY=1\nSTATUS=Running")
+	waitForMessage(t, msgs, "WATCHDOG=1")
+
+	signals <- syscall.SIGHUP
+	select {
+	case <-reopened:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected SIGHUP to reopen the log file")
+	}
+
+	signals <- syscall.SIGTERM
+	select {
+	case c := <-code:
+		if c != 0 {
+			t.Fatalf("expected exit code 0, got %d", c)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after SIGTERM")
+	}
+	waitForMessage(t, msgs, "STOPPING=1")
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+	"github.com/justin-molloy/tfagent/journal"
+	"github.com/justin-molloy/tfagent/processor"
+	"github.com/justin-molloy/tfagent/selector"
+	"github.com/justin-molloy/tfagent/sendfile"
+	"github.com/justin-molloy/tfagent/tracker"
+)
+
+var (
+	// stopProgressInterval is how often the service manager is told the agent
+	// is still stopping.
+	stopProgressInterval = time.Second
+
+	// stopMargin is how much longer than the grace period the routines get to
+	// stop, for the tracker and selector to finish up after the processor.
+	stopMargin = 5 * time.Second
+)
+
+// Pipeline is the agent's routines - the tracker, selector and processor -
+// running until they're stopped.
+
+type Pipeline struct {
+	cancel    context.CancelFunc
+	processed chan struct{} // closed when the processor has returned
+	done      chan struct{} // closed when all of the routines have returned
+	limit     time.Duration
+}
+
+// Start runs the tracker, selector and processor. They're the same however the
+// agent is run; only what starts and stops them differs.
+
+func Start(
+	cfg *config.ConfigData,
+	trackerMap *tracker.EventTracker,
+	fileQueue chan job.Job,
+	processingSet *selector.FileSelector,
+	jrnl *journal.Journal,
+) *Pipeline {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pipeline{
+		cancel:    cancel,
+		processed: make(chan struct{}),
+		done:      make(chan struct{}),
+		limit:     cfg.GracePeriod() + stopMargin,
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	// entry point to the file system tracker
+	go func() {
+		defer wg.Done()
+		tracker.StartTracker(ctx, cfg, trackerMap, jrnl)
+	}()
+	go func() {
+		defer wg.Done()
+		selector.StartSelector(ctx, cfg, trackerMap, fileQueue, processingSet, jrnl)
+	}()
+	go func() {
+		defer wg.Done()
+		defer close(p.processed)
+		processor.StartProcessor(ctx, cfg, fileQueue, processingSet, jrnl)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(p.done)
+	}()
+	return p
+}
+
+// Stop stops the agent taking on new files and waits for the uploads in
+// progress to finish, up to the shutdown grace period. Anything not sent is
+// left in the journal for the next start, and the pooled SSH connections are
+// closed once the processor has finished with them. progress, if not nil, is
+// called every stopProgressInterval while it waits with how much longer it
+// will wait, so the service manager can be told the agent is still stopping.
+// It returns false if the routines hadn't all stopped in time.
+
+func (p *Pipeline) Stop(progress func(remaining time.Duration)) bool {
+	p.cancel()
+
+	deadline := time.Now().Add(p.limit)
+	timeout := time.NewTimer(p.limit)
+	defer timeout.Stop()
+	tick := time.NewTicker(stopProgressInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			sendfile.ClosePool()
+			slog.Info("Agent stopped")
+			return true
+		case <-timeout.C:
+			select {
+			case <-p.processed:
+				sendfile.ClosePool()
+			default:
+			}
+			slog.Warn("Agent did not stop in time; exiting anyway")
+			return false
+		case <-tick.C:
+			if progress != nil {
+				progress(time.Until(deadline))
+			}
+		}
+	}
+}
+
+// Limit is the longest Stop waits.
+
+func (p *Pipeline) Limit() time.Duration {
+	return p.limit
+}
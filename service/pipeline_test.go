@@ -0,0 +1,104 @@
+package service
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+	"github.com/justin-molloy/tfagent/journal"
+	"github.com/justin-molloy/tfagent/selector"
+	"github.com/justin-molloy/tfagent/tracker"
+)
+
+func TestPipeline_StopReportsProgressWhileUploading(t *testing.T) {
+	old := stopProgressInterval
+	stopProgressInterval = 50 * time.Millisecond
+	t.Cleanup(func() { stopProgressInterval = old })
+
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	if err := os.MkdirAll(src, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	file := filepath.Join(src, "slow.txt")
+	if err := os.WriteFile(file, []byte("x"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// A server that accepts the connection and says nothing for a while, so
+	// the upload is still in progress when the agent is stopped.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			time.AfterFunc(500*time.Millisecond, func() { conn.Close() })
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	cfg := &config.ConfigData{
+		ShutdownGracePeriod: 10 * time.Second,
+		Transfers: []config.ConfigEntry{{
+			Name:            "stalling-server",
+			SourceDirectory: src,
+			TransferType:    "sftp",
+			Username:        "user",
+			Password:        "secret",
+			Server:          "127.0.0.1",
+			Port:            port,
+			HostKeyCheck:    "tofu",
+			KnownHosts:      filepath.Join(tmp, "known_hosts"),
+			Retry:           config.RetryConfig{Attempts: 1},
+		}},
+	}
+
+	jrnl, err := journal.Open(filepath.Join(tmp, "journal.jsonl"))
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	defer jrnl.Close()
+
+	fileQueue := make(chan job.Job, 1)
+	p := Start(cfg, tracker.NewEventTracker(), fileQueue, selector.NewFileSelector(), jrnl)
+	if want := cfg.ShutdownGracePeriod + stopMargin; p.Limit() != want {
+		t.Errorf("expected stop limit %v, got %v", want, p.Limit())
+	}
+
+	jrnl.Record(file, journal.Queued, nil)
+	fileQueue <- job.New(file)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if s, _ := jrnl.State(file); s == journal.Sending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the upload to start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var reports []time.Duration
+	if !p.Stop(func(remaining time.Duration) { reports = append(reports, remaining) }) {
+		t.Fatal("expected the pipeline to stop within the grace period")
+	}
+	if len(reports) == 0 {
+		t.Fatal("expected progress to be reported while the upload finished")
+	}
+	if reports[0] <= 0 || reports[0] > p.Limit() {
+		t.Errorf("expected remaining time within the stop limit, got %v", reports[0])
+	}
+	if _, ok := jrnl.State(file); ok {
+		t.Error("expected the upload in progress to have finished before Stop returned")
+	}
+}
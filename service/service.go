@@ -3,12 +3,14 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"time"
 
 	"github.com/justin-molloy/tfagent/config"
-	"github.com/justin-molloy/tfagent/processor"
+	"github.com/justin-molloy/tfagent/job"
+	"github.com/justin-molloy/tfagent/journal"
 	"github.com/justin-molloy/tfagent/selector"
 	"github.com/justin-molloy/tfagent/tracker"
 
@@ -20,20 +22,30 @@ type TFAgentService struct {
 	Name       string
 	Config     *config.ConfigData
 	Tracker    *tracker.EventTracker
-	FileQueue  chan string
+	FileQueue  chan job.Job
 	Processing *selector.FileSelector // or whatever type NewFileSelector returns
+	Journal    *journal.Journal
 }
 
+// Execute runs the agent under the Service Control Manager. On Stop or
+// Shutdown the agent stops taking on new files and waits for the uploads in
+// progress, up to the shutdown grace period, reporting StopPending progress to
+// the SCM meanwhile. If they haven't finished by then the service stops with
+// service-specific exit code 1.
+
 func (m *TFAgentService) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
 
 	s <- svc.Status{State: svc.StartPending}
 
-	// entry point to the file system tracker
-	go tracker.StartTracker(m.Config, m.Tracker)
-	go selector.StartSelector(m.Tracker, m.FileQueue, m.Processing)
-	go processor.StartProcessor(m.Config, m.FileQueue, m.Processing)
+	p := Start(m.Config, m.Tracker, m.FileQueue, m.Processing, m.Journal)
 
-	go runHeartbeat(s, m.Name, m.Config.Heartbeat)
+	ctx, stopHeartbeat := context.WithCancel(context.Background())
+	defer stopHeartbeat()
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		runHeartbeat(ctx, s, m.Name, m.Config.Heartbeat)
+	}()
 
 	s <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
 
@@ -48,7 +60,20 @@ func (m *TFAgentService) Execute(args []string, r <-chan svc.ChangeRequest, s ch
 
 		case svc.Stop, svc.Shutdown:
 			slog.Info("Service stop requested", "command", int(req.Cmd), "servicename", m.Name)
-			s <- svc.Status{State: svc.StopPending}
+			// Wait for the heartbeat to finish, so it can't report Running
+			// after StopPending.
+			stopHeartbeat()
+			<-heartbeatDone
+
+			checkpoint := uint32(1)
+			s <- svc.Status{State: svc.StopPending, CheckPoint: checkpoint, WaitHint: waitHint(p.Limit())}
+			stopped := p.Stop(func(remaining time.Duration) {
+				checkpoint++
+				s <- svc.Status{State: svc.StopPending, CheckPoint: checkpoint, WaitHint: waitHint(remaining)}
+			})
+			if !stopped {
+				return true, 1
+			}
 			return false, 0
 
 		default:
@@ -57,12 +82,26 @@ func (m *TFAgentService) Execute(args []string, r <-chan svc.ChangeRequest, s ch
 	}
 }
 
-func runHeartbeat(statusChan chan<- svc.Status, serviceName string, heartbeat bool) {
+// waitHint is how long the SCM should wait for the next StopPending checkpoint,
+// in milliseconds.
+
+func waitHint(remaining time.Duration) uint32 {
+	return uint32(max(remaining, stopProgressInterval).Milliseconds())
+}
+
+// runHeartbeat logs a heartbeat and tells the SCM the service is running, until
+// ctx is cancelled when the service starts stopping.
+
+func runHeartbeat(ctx context.Context, statusChan chan<- svc.Status, serviceName string, heartbeat bool) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
 	for {
-		<-ticker.C
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 
 		state, err := queryServiceStatus(serviceName)
 		if err != nil {
@@ -70,9 +109,17 @@ func runHeartbeat(statusChan chan<- svc.Status, serviceName string, heartbeat bo
 		}
 
 		if heartbeat {
-			slog.Info("Service heartbeat", "servicename", serviceName, "state", state)
-			// heartbeat update to SCM
-			statusChan <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+			degraded := tracker.Degraded()
+			slog.Info("Service heartbeat", "servicename", serviceName, "state", state, "degraded", len(degraded))
+			for dir, reason := range degraded {
+				slog.Warn("Source directory degraded", "source", dir, "reason", reason)
+			}
+			// heartbeat update to SCM, unless the service has started stopping
+			select {
+			case statusChan <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}
 }
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
 	"github.com/justin-molloy/tfagent/selector"
 	"github.com/justin-molloy/tfagent/tracker"
 	"golang.org/x/sys/windows/svc"
@@ -47,7 +48,7 @@ func TestExecute_StartThenStop_SendsExpectedStatusesAndReturns(t *testing.T) {
 		Name:       "tfagent-test",
 		Config:     minimalConfig(),
 		Tracker:    &tracker.EventTracker{},  // minimal, non-nil
-		FileQueue:  make(chan string),        // close so processor/selectors exit if they read
+		FileQueue:  make(chan job.Job),       // close so processor/selectors exit if they read
 		Processing: &selector.FileSelector{}, // minimal, non-nil
 	}
 	close(s.FileQueue)
@@ -89,6 +90,9 @@ func TestExecute_StartThenStop_SendsExpectedStatusesAndReturns(t *testing.T) {
 		if st.State != svc.StopPending {
 			t.Fatalf("expected StopPending after Stop, got %v", st.State)
 		}
+		if st.CheckPoint == 0 || st.WaitHint == 0 {
+			t.Fatalf("expected StopPending to report progress, got %+v", st)
+		}
 	case <-time.After(2 * time.Second):
 		t.Fatal("timeout waiting for StopPending")
 	}
@@ -109,7 +113,7 @@ func TestExecute_Interrogate_EchoesCurrentStatus(t *testing.T) {
 		Name:       "tfagent-test",
 		Config:     minimalConfig(),
 		Tracker:    &tracker.EventTracker{},
-		FileQueue:  make(chan string),
+		FileQueue:  make(chan job.Job),
 		Processing: &selector.FileSelector{},
 	}
 	close(s.FileQueue)
@@ -0,0 +1,91 @@
+// Package sshkey loads SSH private keys, optionally encrypted and optionally
+// paired with an OpenSSH user certificate. It's shared by config validation
+// (so bad keys are caught at load time) and the uploaders.
+package sshkey
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// LoadSigner reads the private key in keyFile, decrypting it with passphrase if
+// it is encrypted. If certFile is set, the certificate is checked against the key
+// and the returned signer authenticates with the certificate.
+
+func LoadSigner(keyFile, passphrase, certFile string) (ssh.Signer, error) {
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read private key: %w", err)
+	}
+
+	signer, err := parseKey(key, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(certFile) == "" {
+		return signer, nil
+	}
+
+	return certSigner(certFile, signer)
+}
+
+func parseKey(key []byte, passphrase string) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(key)
+
+	var missing *ssh.PassphraseMissingError
+	switch {
+	case err == nil:
+		return signer, nil
+	case !errors.As(err, &missing):
+		return nil, fmt.Errorf("unable to parse private key: %w", err)
+	case passphrase == "":
+		return nil, errors.New("private key is encrypted but no passphrase is configured")
+	}
+
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt private key: %w", err)
+	}
+	return signer, nil
+}
+
+// certSigner loads an OpenSSH user certificate and pairs it with the key it was
+// issued for.
+
+func certSigner(certFile string, signer ssh.Signer) (ssh.Signer, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read certificate: %w", err)
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse certificate: %w", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is a public key, not a certificate", certFile)
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%s is not a user certificate", certFile)
+	}
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return nil, errors.New("certificate does not match private key")
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && time.Now().Unix() >= int64(cert.ValidBefore) {
+		return nil, fmt.Errorf("certificate expired at %s", time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339))
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use certificate: %w", err)
+	}
+	return certSigner, nil
+}
@@ -0,0 +1,183 @@
+package sshkey
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// writeKey writes an ed25519 private key, encrypted if passphrase is set.
+func writeKey(t *testing.T, dir, passphrase string) (string, ssh.Signer) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	var blk *pem.Block
+	if passphrase == "" {
+		blk, err = ssh.MarshalPrivateKey(priv, "")
+	} else {
+		blk, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	fp := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(fp, pem.EncodeToMemory(blk), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("signer: %v", err)
+	}
+	return fp, signer
+}
+
+// writeCert signs pub with a fresh CA and writes the certificate.
+func writeCert(t *testing.T, dir string, pub ssh.PublicKey, certType uint32, validBefore uint64) string {
+	t.Helper()
+	_, caPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate CA: %v", err)
+	}
+	ca, err := ssh.NewSignerFromKey(caPriv)
+	if err != nil {
+		t.Fatalf("CA signer: %v", err)
+	}
+
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        certType,
+		KeyId:           "test",
+		ValidPrincipals: []string{"user"},
+		ValidBefore:     validBefore,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("sign cert: %v", err)
+	}
+
+	fp := filepath.Join(dir, "id_ed25519-cert.pub")
+	if err := os.WriteFile(fp, ssh.MarshalAuthorizedKey(cert), 0o644); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	return fp
+}
+
+func TestLoadSigner_Plain(t *testing.T) {
+	keyPath, want := writeKey(t, t.TempDir(), "")
+
+	signer, err := LoadSigner(keyPath, "", "")
+	if err != nil {
+		t.Fatalf("LoadSigner: %v", err)
+	}
+	if string(signer.PublicKey().Marshal()) != string(want.PublicKey().Marshal()) {
+		t.Fatalf("loaded a different key")
+	}
+}
+
+func TestLoadSigner_Encrypted(t *testing.T) {
+	keyPath, _ := writeKey(t, t.TempDir(), "correct horse")
+
+	tests := []struct {
+		name       string
+		passphrase string
+		wantErr    string
+	}{
+		{name: "correct passphrase", passphrase: "correct horse"},
+		{name: "no passphrase", wantErr: "no passphrase is configured"},
+		{name: "wrong passphrase", passphrase: "battery staple", wantErr: "unable to decrypt private key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadSigner(keyPath, tt.passphrase, "")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadSigner_Errors(t *testing.T) {
+	tmp := t.TempDir()
+
+	if _, err := LoadSigner(filepath.Join(tmp, "missing"), "", ""); err == nil ||
+		!strings.Contains(err.Error(), "unable to read private key") {
+		t.Fatalf("expected read error, got %v", err)
+	}
+
+	bad := filepath.Join(tmp, "bad")
+	os.WriteFile(bad, []byte("not a key"), 0o600)
+	if _, err := LoadSigner(bad, "", ""); err == nil ||
+		!strings.Contains(err.Error(), "unable to parse private key") {
+		t.Fatalf("expected parse error, got %v", err)
+	}
+}
+
+func TestLoadSigner_Certificate(t *testing.T) {
+	tmp := t.TempDir()
+	keyPath, signer := writeKey(t, tmp, "")
+	_, other := writeKey(t, t.TempDir(), "")
+	expired := uint64(time.Now().Add(-time.Hour).Unix())
+
+	tests := []struct {
+		name    string
+		cert    string
+		wantErr string
+	}{
+		{name: "matching", cert: writeCert(t, t.TempDir(), signer.PublicKey(), ssh.UserCert, ssh.CertTimeInfinity)},
+		{
+			name:    "other key",
+			cert:    writeCert(t, t.TempDir(), other.PublicKey(), ssh.UserCert, ssh.CertTimeInfinity),
+			wantErr: "certificate does not match private key",
+		},
+		{
+			name:    "host certificate",
+			cert:    writeCert(t, t.TempDir(), signer.PublicKey(), ssh.HostCert, ssh.CertTimeInfinity),
+			wantErr: "not a user certificate",
+		},
+		{
+			name:    "expired",
+			cert:    writeCert(t, t.TempDir(), signer.PublicKey(), ssh.UserCert, expired),
+			wantErr: "certificate expired",
+		},
+		{
+			name:    "missing file",
+			cert:    filepath.Join(tmp, "nope-cert.pub"),
+			wantErr: "unable to read certificate",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadSigner(keyPath, "", tt.cert)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, ok := got.PublicKey().(*ssh.Certificate); !ok {
+				t.Fatalf("expected a certificate signer, got %T", got.PublicKey())
+			}
+		})
+	}
+}
@@ -4,19 +4,24 @@ import (
 	"log"
 	"log/slog"
 	"os"
-
-	// "os/signal"
-
-	"golang.org/x/sys/windows/svc"
+	"path/filepath"
 
 	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+	"github.com/justin-molloy/tfagent/journal"
 	"github.com/justin-molloy/tfagent/processor"
 	"github.com/justin-molloy/tfagent/selector"
-	"github.com/justin-molloy/tfagent/service"
 	"github.com/justin-molloy/tfagent/tracker"
 )
 
+// main exits with the code the agent returns, once everything it opened has
+// been closed.
+
 func main() {
+	os.Exit(tfagent())
+}
+
+func tfagent() int {
 
 	// Application name used for Windows service call, and for defining
 	// where the config file should be(if installed using installer).
@@ -30,25 +35,25 @@ func main() {
 	configFile, err := config.GetConfigFile(AppName)
 	if err != nil {
 		log.Fatalf("Can't find where the config file lives: %v", err)
-		os.Exit(1)
+		return 1
 	}
 
 	cfg, err := config.LoadConfig(configFile)
 	if err != nil {
 		log.Fatalf("Error loading config: %v", err)
-		os.Exit(1)
+		return 1
 	}
 
 	if err := config.ValidateConfig(cfg); err != nil {
 		slog.Error("Invalid configuration", "error", err)
-		os.Exit(1)
+		return 1
 	}
 
 	// print config and exit if required before wasting further cycles
 
 	if flags.PrtConf {
 		config.PrintConfig(*cfg)
-		os.Exit(0)
+		return 0
 	}
 
 	// set up logging once we've determined where we should log to and
@@ -59,60 +64,81 @@ func main() {
 	logFile, err := config.SetupLogger(cfg, flags)
 	if err != nil {
 		log.Fatalf("Failed to set up logger: %v", err)
-		os.Exit(1)
+		return 1
 	}
 	if logFile != nil {
-		defer logFile.Close()
+		// reopenLog replaces logFile, so close whichever one is open at exit.
+		defer func() { logFile.Close() }()
 	}
 
+	// The journal records where every file has got to, so files that were in
+	// progress when the agent last stopped can be picked up again.
+
+	jrnl, err := journal.Open(filepath.Join(cfg.DataDir, "journal.jsonl"))
+	if err != nil {
+		slog.Error("Failed to open journal", "error", err)
+		return 1
+	}
+	defer jrnl.Close()
+
 	// trackerMap holds files that are eligible to be processed by the selector routine
 
+	// Files every transfer had finished with are settled first, so neither the
+	// replay nor the startup scan sends them again.
+
+	processor.SettleJournal(cfg, jrnl)
+
 	trackerMap := tracker.NewEventTracker()
+	tracker.ReplayJournal(cfg, jrnl, trackerMap)
 
-	// queue for files to be processed
+	// queue for files to be processed, each as the job the tracker started for it
 
-	fileQueue := make(chan string, 100) // buffered to avoid blocking
+	fileQueue := make(chan job.Job, 100) // buffered to avoid blocking
 
 	// Selector views events that have been added to the tracker map, and
 	// moves them to the fileQueue when eligible.
 
 	processingMap := selector.NewFileSelector()
 
-	isService, err := svc.IsWindowsService()
-	if err != nil {
-		slog.Error("failed to determine session type", "error", err)
-		os.Exit(1)
+	// Reopening the log file lets it be rotated while the agent runs (SIGHUP
+	// on Linux).
+
+	reopenLog := func() error {
+		f, err := config.ReopenLogFile(cfg)
+		if err != nil || f == nil {
+			return err
+		}
+		logFile.Close()
+		logFile = f
+		return nil
 	}
 
-	// Run the service if called from Windows Service, or run standalone if not.
-	// Both options use the same routines once started. The tracker watches the
-	// filesystem for events, and queues eligible files (determined by the
-	// filter in config for each transfer entry)
-
-	if isService {
-		slog.Info("Running as Windows Service", "isService", isService)
-		svc.Run(AppName, &service.TFAgentService{
-			Name:       AppName,
-			Config:     cfg,
-			Tracker:    trackerMap,
-			FileQueue:  fileQueue,
-			Processing: processingMap})
-		return
-	} else {
-		slog.Info("Running as standalone app outside of Windows Service Control Manager")
-		go tracker.StartTracker(cfg, trackerMap)
-		go selector.StartSelector(trackerMap, fileQueue, processingMap)
-		go processor.StartProcessor(cfg, fileQueue, processingMap)
-	}
-
-	// keep main alive (may replace this with sync.WaitGroup later)
-	select {}
+	// Run the agent the way the platform expects: as a Windows service or a
+	// standalone app on Windows, or in the foreground under systemd (or any
+	// other supervisor) elsewhere. All of them use the same routines once
+	// started. The tracker watches the filesystem for events, and queues
+	// eligible files (determined by the filter in config for each transfer
+	// entry)
+
+	return run(&agent{
+		name:       AppName,
+		cfg:        cfg,
+		tracker:    trackerMap,
+		fileQueue:  fileQueue,
+		processing: processingMap,
+		journal:    jrnl,
+		reopenLog:  reopenLog,
+	})
+}
 
-	// Block and create a channel to receive OS signals for interrupts
-	//	sigs := make(chan os.Signal, 1)
-	//	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	//	sig := <-sigs
-	//	slog.Info("Program terminated by user", "signal", sig.String())
-	//	os.Exit(0)
+// agent is what the platform's runner needs to start the agent's routines.
 
+type agent struct {
+	name       string
+	cfg        *config.ConfigData
+	tracker    *tracker.EventTracker
+	fileQueue  chan job.Job
+	processing *selector.FileSelector
+	journal    *journal.Journal
+	reopenLog  func() error
 }
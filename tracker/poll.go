@@ -0,0 +1,105 @@
+package tracker
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+)
+
+// fileState is what polling compares between listings to spot a changed file.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// same reports whether a file is unchanged between listings. Times are compared
+// with Equal, as == would also compare the location and monotonic reading.
+func (s fileState) same(other fileState) bool {
+	return s.size == other.size && s.modTime.Equal(other.modTime)
+}
+
+// pollSourceDirectory watches a transfer's source directory by listing it every
+// poll_interval, for network shares where fsnotify misses changes or doesn't
+// work at all. New and changed files go through the same path as fsnotify
+// events. Files already there at the first listing are left to scan_on_start.
+// It stops when ctx is cancelled.
+
+func pollSourceDirectory(ctx context.Context, cfg *config.ConfigData, entry config.ConfigEntry, trackerMap *EventTracker) {
+	interval := entry.PollingInterval()
+	slog.Info("Polling source directory", "source", entry.SourceDirectory, "name", entry.Name,
+		"interval", interval, "watch_mode", entry.WatchMode)
+
+	// If the directory can't be listed yet, everything in it counts as new once
+	// it can be.
+	previous, _ := listSourceDirectory(entry)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, err := listSourceDirectory(entry)
+		if err != nil {
+			// Keep the last good listing, so a share that drops out for a while
+			// doesn't make everything on it look new when it comes back.
+			slog.Warn("Unable to poll source directory", "source", entry.SourceDirectory, "name", entry.Name, "error", err)
+			if !entry.UsesFsnotify() {
+				setDegraded(entry.SourceDirectory, "unable to poll: "+err.Error())
+			}
+			continue
+		}
+		if !entry.UsesFsnotify() {
+			clearDegraded(entry.SourceDirectory)
+		}
+		pollChanges(cfg, trackerMap, previous, current)
+		previous = current
+	}
+}
+
+// pollChanges feeds the differences between two listings into the tracker.
+
+func pollChanges(cfg *config.ConfigData, trackerMap *EventTracker, previous, current map[string]fileState) {
+	for name, state := range current {
+		if old, seen := previous[name]; seen && old.same(state) {
+			continue
+		}
+		slog.Debug("Poll found new or changed file", "file", name, "size", state.size, "modified", state.modTime)
+		recordIfMatched(cfg, trackerMap, name)
+	}
+
+	for name := range previous {
+		if _, ok := current[name]; !ok && trackerMap.AlreadyExists(name) {
+			slog.Debug("Cleared tracker after file disappeared from poll", "file", name)
+			trackerMap.Forget(name)
+		}
+	}
+}
+
+// listSourceDirectory returns the size and modification time of every regular
+// file in a transfer's source directory (and below it, if recursive).
+
+func listSourceDirectory(entry config.ConfigEntry) (map[string]fileState, error) {
+	listing := make(map[string]fileState)
+	err := walkSourceFiles(entry, func(file string, de fs.DirEntry) {
+		info, err := de.Info()
+		if err != nil {
+			return // removed since it was listed
+		}
+		listing[file] = fileState{
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return listing, nil
+}
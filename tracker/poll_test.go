@@ -0,0 +1,79 @@
+package tracker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+)
+
+func TestPollChanges(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.ConfigData{Transfers: []config.ConfigEntry{{Name: "poll", SourceDirectory: dir}}}
+	now := time.Now()
+
+	same := filepath.Join(dir, "same.txt")
+	grown := filepath.Join(dir, "grown.txt")
+	added := filepath.Join(dir, "added.txt")
+	removed := filepath.Join(dir, "removed.txt")
+
+	previous := map[string]fileState{
+		same:    {size: 1, modTime: now},
+		grown:   {size: 1, modTime: now},
+		removed: {size: 1, modTime: now},
+	}
+	current := map[string]fileState{
+		// The same time without the monotonic reading, in another location.
+		same:  {size: 1, modTime: now.Round(0).UTC()},
+		grown: {size: 2, modTime: now},
+		added: {size: 1, modTime: now},
+	}
+
+	et := NewEventTracker()
+	et.RecordEvent(removed)
+	pollChanges(cfg, et, previous, current)
+
+	snapshot := et.GetSnapshot()
+	if len(snapshot) != 2 {
+		t.Fatalf("expected the grown and added files only, got %v", snapshot)
+	}
+	for _, f := range []string{grown, added} {
+		if _, ok := snapshot[f]; !ok {
+			t.Errorf("expected %s recorded", f)
+		}
+	}
+}
+
+func TestStartTracker_PollMode(t *testing.T) {
+	dir := t.TempDir()
+	before := filepath.Join(dir, "before.txt")
+	if err := os.WriteFile(before, []byte("x"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	tracker := NewEventTracker()
+	cfg := &config.ConfigData{
+		Transfers: []config.ConfigEntry{
+			{Name: "poll", SourceDirectory: dir, WatchMode: "poll", PollInterval: 50 * time.Millisecond},
+		},
+	}
+
+	go StartTracker(t.Context(), cfg, tracker, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	testFile := filepath.Join(dir, "polled.txt")
+	if err := os.WriteFile(testFile, []byte("x"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	snapshot := tracker.GetSnapshot()
+	if _, ok := snapshot[testFile]; !ok {
+		t.Fatalf("expected polled file recorded, got %v", snapshot)
+	}
+	if _, ok := snapshot[before]; ok {
+		t.Fatalf("files there before the first poll are for scan_on_start, got %v", snapshot)
+	}
+}
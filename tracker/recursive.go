@@ -0,0 +1,149 @@
+package tracker
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/justin-molloy/tfagent/config"
+)
+
+// walkSourceFiles calls fn for every regular file a transfer is interested in:
+// the files directly in its source directory, or with recursive set every file
+// below it apart from those in the agent's own archive and fail directories.
+
+func walkSourceFiles(entry config.ConfigEntry, fn func(file string, de fs.DirEntry)) error {
+	return walkFiles(entry, entry.SourceDirectory, fn)
+}
+
+// walkFiles is walkSourceFiles for a directory somewhere under the source
+// directory, eg. one that has just been created.
+
+func walkFiles(entry config.ConfigEntry, root string, fn func(file string, de fs.DirEntry)) error {
+	if !entry.Recursive {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			return err
+		}
+		for _, de := range entries {
+			if de.Type().IsRegular() {
+				fn(filepath.Join(root, de.Name()), de)
+			}
+		}
+		return nil
+	}
+
+	return filepath.WalkDir(root, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			slog.Warn("Unable to read directory", "path", p, "name", entry.Name, "error", err)
+			return nil
+		}
+		if de.IsDir() {
+			if isExcludedDir(entry, p) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if de.Type().IsRegular() {
+			fn(p, de)
+		}
+		return nil
+	})
+}
+
+// watchSourceDirectory adds fsnotify watches for a transfer - just the source
+// directory, or with recursive set every directory below it as well, as fsnotify
+// doesn't watch subdirectories by itself.
+
+func watchSourceDirectory(w *fsnotify.Watcher, entry config.ConfigEntry) error {
+	if !entry.Recursive {
+		return w.Add(entry.SourceDirectory)
+	}
+	return watchTree(w, entry, entry.SourceDirectory)
+}
+
+func watchTree(w *fsnotify.Watcher, entry config.ConfigEntry, root string) error {
+	return filepath.WalkDir(root, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			slog.Warn("Unable to read directory", "path", p, "name", entry.Name, "error", err)
+			return nil
+		}
+		if !de.IsDir() {
+			return nil
+		}
+		if isExcludedDir(entry, p) {
+			return filepath.SkipDir
+		}
+		if err := w.Add(p); err != nil {
+			if p == root {
+				return err
+			}
+			slog.Warn("Unable to watch directory", "path", p, "name", entry.Name, "error", err)
+		}
+		return nil
+	})
+}
+
+// watchNewDirectory starts watching a directory created under a recursive
+// transfer's source directory. Files can land in it before the watch is in
+// place, so anything already there is recorded as well.
+
+func watchNewDirectory(w *fsnotify.Watcher, cfg *config.ConfigData, trackerMap *EventTracker, dir string) {
+	for _, entry := range cfg.Transfers {
+		if !entry.Recursive || !entry.UsesFsnotify() || !underSourceDirectory(entry, dir) || isExcludedDir(entry, dir) {
+			continue
+		}
+
+		if err := watchTree(w, entry, dir); err != nil {
+			slog.Warn("Unable to watch new directory", "path", dir, "name", entry.Name, "error", err)
+			continue
+		}
+		slog.Debug("Tracking new directory", "path", dir, "name", entry.Name)
+
+		_ = walkFiles(entry, dir, func(file string, _ fs.DirEntry) {
+			recordIfMatched(cfg, trackerMap, file)
+		})
+	}
+}
+
+// isExcludedDir reports whether dir is an archive or fail directory - the
+// transfer's own or any other transfer's. Files moved there after a transfer
+// must not be picked up and sent again.
+
+func isExcludedDir(entry config.ConfigEntry, dir string) bool {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return slices.Contains(entry.ExcludedDirs(), filepath.Clean(dir))
+}
+
+// inExcludedDir reports whether file is anywhere inside an archive or fail
+// directory.
+
+func inExcludedDir(entry config.ConfigEntry, file string) bool {
+	source := filepath.Clean(entry.SourceDirectory)
+	for dir := filepath.Dir(file); dir != source && underSourceDirectory(entry, dir); dir = filepath.Dir(dir) {
+		if isExcludedDir(entry, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// underSourceDirectory reports whether path is the transfer's source directory
+// or somewhere below it.
+
+func underSourceDirectory(entry config.ConfigEntry, path string) bool {
+	rel, err := filepath.Rel(entry.SourceDirectory, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,148 @@
+package tracker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+)
+
+func TestFilterMatcher_Subdirectories(t *testing.T) {
+	dir := t.TempDir()
+	nested := filepath.Join(dir, "2024", "03", "data.csv")
+	archived := filepath.Join(dir, "archive", "2024", "data.csv")
+	failed := filepath.Join(dir, "failed", "data.csv")
+
+	tests := []struct {
+		name  string
+		entry config.ConfigEntry
+		file  string
+		want  bool
+	}{
+		{"nested, not recursive", config.ConfigEntry{SourceDirectory: dir}, nested, false},
+		{"nested, recursive", config.ConfigEntry{SourceDirectory: dir, Recursive: true}, nested, true},
+		{"default archive dir", config.ConfigEntry{SourceDirectory: dir, Recursive: true}, archived, false},
+		{"configured fail dir", config.ConfigEntry{SourceDirectory: dir, Recursive: true, FailDest: filepath.Join(dir, "failed")}, failed, false},
+		{"top level, recursive", config.ConfigEntry{SourceDirectory: dir, Recursive: true}, filepath.Join(dir, "data.csv"), true},
+		{"include on relative path", config.ConfigEntry{SourceDirectory: dir, Recursive: true, Include: []string{"2024/**/*.csv"}}, nested, true},
+		{"include elsewhere", config.ConfigEntry{SourceDirectory: dir, Recursive: true, Include: []string{"2025/**"}}, nested, false},
+		{"partial file", config.ConfigEntry{SourceDirectory: dir, Recursive: true}, filepath.Join(dir, "2024", ".data.csv.part"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FilterMatcher(tt.file, tt.entry)
+			if err != nil {
+				t.Fatalf("FilterMatcher: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected match=%v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestScanSourceDirectory_Recursive(t *testing.T) {
+	dir := t.TempDir()
+	top := writeFile(t, dir, "top.csv")
+	nested := writeFile(t, filepath.Join(dir, "a", "b"), "nested.csv")
+	writeFile(t, filepath.Join(dir, "archive"), "sent.csv")
+
+	entry := config.ConfigEntry{Name: "scan", SourceDirectory: dir, Recursive: true}
+	tr := NewEventTracker()
+	found := ScanSourceDirectory(&config.ConfigData{Transfers: []config.ConfigEntry{entry}}, entry, tr, nil)
+	if found != 2 {
+		t.Fatalf("expected 2 files, got %d (%v)", found, tr.GetSnapshot())
+	}
+	for _, f := range []string{top, nested} {
+		if !tr.AlreadyExists(f) {
+			t.Errorf("expected %s recorded", f)
+		}
+	}
+
+	// Without recursive only the top level is scanned.
+	entry.Recursive = false
+	tr = NewEventTracker()
+	if found := ScanSourceDirectory(&config.ConfigData{Transfers: []config.ConfigEntry{entry}}, entry, tr, nil); found != 1 {
+		t.Fatalf("expected 1 file, got %d", found)
+	}
+}
+
+func TestScanSourceDirectory_SkipsOtherTransfersArchive(t *testing.T) {
+	dir := t.TempDir()
+	reports := filepath.Join(dir, "reports")
+	top := writeFile(t, dir, "top.csv")
+	report := writeFile(t, reports, "report.csv")
+	writeFile(t, filepath.Join(reports, "sent"), "sent.csv")
+
+	cfgFile := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := "transfers:\n" +
+		"  - name: all\n    source_directory: " + dir + "\n    recursive: true\n" +
+		"  - name: reports\n    source_directory: " + reports + "\n    archive_dest: sent\n"
+	if err := os.WriteFile(cfgFile, []byte(yaml), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	cfg, err := config.LoadConfig(cfgFile)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	tr := NewEventTracker()
+	if found := ScanSourceDirectory(cfg, cfg.Transfers[0], tr, nil); found != 2 {
+		t.Fatalf("expected 2 files, got %d (%v)", found, tr.GetSnapshot())
+	}
+	for _, f := range []string{top, report} {
+		if !tr.AlreadyExists(f) {
+			t.Errorf("expected %s recorded", f)
+		}
+	}
+}
+
+func TestStartTracker_RecursiveWatchesNewDirectories(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "existing"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	tr := NewEventTracker()
+	cfg := &config.ConfigData{
+		Transfers: []config.ConfigEntry{{Name: "recursive", SourceDirectory: dir, Recursive: true}},
+	}
+
+	go StartTracker(t.Context(), cfg, tr, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	inExisting := writeFile(t, filepath.Join(dir, "existing"), "one.csv")
+	inNew := writeFile(t, filepath.Join(dir, "2024", "03"), "two.csv")
+	inArchive := writeFile(t, filepath.Join(dir, "archive"), "three.csv")
+	time.Sleep(300 * time.Millisecond)
+
+	snapshot := tr.GetSnapshot()
+	for _, f := range []string{inExisting, inNew} {
+		if _, ok := snapshot[f]; !ok {
+			t.Errorf("expected %s recorded, got %v", f, snapshot)
+		}
+	}
+	if _, ok := snapshot[inArchive]; ok {
+		t.Errorf("expected archive directory to be ignored, got %v", snapshot)
+	}
+	for f := range snapshot {
+		if info, err := os.Stat(f); err == nil && info.IsDir() {
+			t.Errorf("directory %s should not be recorded", f)
+		}
+	}
+}
+
+func writeFile(t *testing.T, dir, name string) string {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	fp := filepath.Join(dir, name)
+	if err := os.WriteFile(fp, []byte("x"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return fp
+}
@@ -0,0 +1,71 @@
+package tracker
+
+import (
+	"io/fs"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/journal"
+)
+
+// ScanSourceDirectory records the files already in a transfer's source directory,
+// so anything that arrived while the agent was stopped is sent too - fsnotify
+// only reports changes. Files older than scan_max_age (if set) are left alone.
+// Each file is recorded with every transfer in cfg that claims it. Files the
+// journal has as queued, being sent or waiting for a deferred retry are left
+// to the journal replay and the retry queue, so they aren't sent twice. It
+// returns the number of files recorded.
+
+func ScanSourceDirectory(cfg *config.ConfigData, entry config.ConfigEntry, trackerMap *EventTracker, jrnl *journal.Journal) int {
+	if a := strings.ToLower(strings.TrimSpace(entry.ActionOnSuccess)); a == "" || a == "none" {
+		slog.Warn("scan_on_start with no action_on_success will send every file in the source directory again at each start",
+			"source", entry.SourceDirectory, "name", entry.Name)
+	}
+
+	cutoff := time.Time{}
+	if entry.ScanMaxAge > 0 {
+		cutoff = time.Now().Add(-entry.ScanMaxAge)
+	}
+
+	found := 0
+	err := walkSourceFiles(entry, func(file string, de fs.DirEntry) {
+		match, err := FilterMatcher(file, entry)
+		if err != nil || !match {
+			return
+		}
+
+		if !cutoff.IsZero() {
+			info, err := de.Info()
+			if err != nil {
+				return
+			}
+			if info.ModTime().Before(cutoff) {
+				slog.Debug("Skipped file older than scan_max_age", "file", file, "modified", info.ModTime())
+				return
+			}
+		}
+
+		if trackerMap.AlreadyExists(file) {
+			return
+		}
+		if inProgress(jrnl, file) {
+			slog.Debug("Skipped file already in progress", "file", file)
+			return
+		}
+		j, ok := newJob(cfg, file)
+		if !ok {
+			return
+		}
+		trackerMap.RecordJob(j)
+		found++
+	})
+	if err != nil {
+		slog.Error("Unable to scan source directory", "source", entry.SourceDirectory, "name", entry.Name, "error", err)
+		return 0
+	}
+
+	slog.Info("Scanned source directory", "source", entry.SourceDirectory, "name", entry.Name, "files", found)
+	return found
+}
@@ -0,0 +1,111 @@
+package tracker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/journal"
+)
+
+func TestScanSourceDirectory(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, age time.Duration) string {
+		fp := filepath.Join(dir, name)
+		if err := os.WriteFile(fp, []byte("x"), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		mtime := time.Now().Add(-age)
+		if err := os.Chtimes(fp, mtime, mtime); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+		return fp
+	}
+
+	fresh := write("fresh.csv", time.Minute)
+	old := write("old.csv", 48*time.Hour)
+	write("notes.txt", time.Minute) // filtered out
+	if err := os.Mkdir(filepath.Join(dir, "archive.csv"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	entry := config.ConfigEntry{
+		Name:            "scan",
+		SourceDirectory: dir,
+		Filter:          `\.csv$`,
+		ScanOnStart:     true,
+		ActionOnSuccess: "delete",
+	}
+	cfg := &config.ConfigData{Transfers: []config.ConfigEntry{entry}}
+
+	t.Run("all matching files", func(t *testing.T) {
+		et := NewEventTracker()
+		if n := ScanSourceDirectory(cfg, entry, et, nil); n != 2 {
+			t.Fatalf("expected 2 files, got %d: %v", n, et.GetSnapshot())
+		}
+		snapshot := et.GetSnapshot()
+		for _, f := range []string{fresh, old} {
+			if _, ok := snapshot[f]; !ok {
+				t.Errorf("expected %s recorded", f)
+			}
+		}
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		et := NewEventTracker()
+		aged := entry
+		aged.ScanMaxAge = 24 * time.Hour
+		ScanSourceDirectory(cfg, aged, et, nil)
+		snapshot := et.GetSnapshot()
+		if _, ok := snapshot[fresh]; !ok || len(snapshot) != 1 {
+			t.Fatalf("expected only %s, got %v", fresh, snapshot)
+		}
+	})
+
+	t.Run("already tracked", func(t *testing.T) {
+		et := NewEventTracker()
+		et.RecordEvent(fresh)
+		if n := ScanSourceDirectory(cfg, entry, et, nil); n != 1 {
+			t.Fatalf("expected only the untracked file, got %d", n)
+		}
+	})
+
+	t.Run("in progress", func(t *testing.T) {
+		jrnl, err := journal.Open(filepath.Join(t.TempDir(), "journal.jsonl"))
+		if err != nil {
+			t.Fatalf("open journal: %v", err)
+		}
+		defer jrnl.Close()
+		// Waiting for a deferred retry: not in the tracker, but not new either.
+		jrnl.Record(fresh, journal.Deferred, nil)
+
+		et := NewEventTracker()
+		if n := ScanSourceDirectory(cfg, entry, et, jrnl); n != 1 || et.AlreadyExists(fresh) {
+			t.Fatalf("expected the deferred file left to the retry queue, got %v", et.GetSnapshot())
+		}
+	})
+}
+
+func TestStartTracker_ScanOnStart(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.txt")
+	if err := os.WriteFile(existing, []byte("x"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	tracker := NewEventTracker()
+	cfg := &config.ConfigData{
+		Transfers: []config.ConfigEntry{
+			{Name: "test", SourceDirectory: dir, ScanOnStart: true, ActionOnSuccess: "archive"},
+		},
+	}
+
+	go StartTracker(t.Context(), cfg, tracker, nil)
+	time.Sleep(300 * time.Millisecond)
+
+	if _, ok := tracker.GetSnapshot()[existing]; !ok {
+		t.Fatalf("expected pre-existing file to be recorded, got %v", tracker.GetSnapshot())
+	}
+}
@@ -0,0 +1,323 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/journal"
+)
+
+// How the watcher supervisor checks on and recovers source directories. They
+// are variables so tests can speed them up.
+var (
+	watchCheckInterval  = 30 * time.Second // how often the watched directories are checked
+	rewatchInitialDelay = time.Second      // first wait before re-adding a lost watch
+	rewatchMaxDelay     = time.Minute      // the wait doubles after each try up to this
+)
+
+// status records the source directories that aren't being watched properly,
+// and why, so the problem is reported rather than events just stopping.
+var status = struct {
+	mu       sync.Mutex
+	degraded map[string]string
+}{degraded: make(map[string]string)}
+
+// Degraded returns the source directories that aren't currently being watched
+// or polled successfully, with the reason for each. It's empty when everything
+// is healthy.
+
+func Degraded() map[string]string {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	return maps.Clone(status.degraded)
+}
+
+func setDegraded(dir, reason string) {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	status.degraded[dir] = reason
+}
+
+func clearDegraded(dir string) {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	delete(status.degraded, dir)
+}
+
+// newWatcher creates the fsnotify watcher, trying again with backoff if it
+// can't - eg. the process is out of file handles or inotify instances. The
+// source directories that depend on it are reported as degraded meanwhile.
+// It returns nil if ctx is cancelled first.
+
+func newWatcher(ctx context.Context, cfg *config.ConfigData) *fsnotify.Watcher {
+	delay := rewatchInitialDelay
+	for {
+		w, err := fsnotify.NewWatcher()
+		if err == nil {
+			for _, entry := range cfg.Transfers {
+				if entry.UsesFsnotify() {
+					clearDegraded(entry.SourceDirectory)
+				}
+			}
+			return w
+		}
+
+		slog.Error("Failed to create watcher; retrying", "error", err, "retry_in", delay)
+		for _, entry := range cfg.Transfers {
+			if entry.UsesFsnotify() {
+				setDegraded(entry.SourceDirectory, "file watcher unavailable: "+err.Error())
+			}
+		}
+		if !sleep(ctx, delay) {
+			return nil
+		}
+		delay = min(delay*2, rewatchMaxDelay)
+	}
+}
+
+// sleep waits for d, or until ctx is cancelled. It returns false if it was
+// cancelled.
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// supervisor keeps the fsnotify watches on the source directories working.
+// fsnotify quietly stops reporting a directory that is deleted and recreated
+// (eg. by a cleanup job) or that drops off a network share, so the directories
+// are checked regularly and a lost one is watched again with backoff once it
+// is back. Anything that arrived while it wasn't watched is then rescanned.
+
+type supervisor struct {
+	ctx        context.Context // rewatching stops when it's cancelled
+	cfg        *config.ConfigData
+	trackerMap *EventTracker
+	journal    *journal.Journal // files already on their way aren't rescanned
+	w          *fsnotify.Watcher
+
+	mu    sync.Mutex
+	roots map[string]*watchRoot // by cleaned source directory
+}
+
+// watchRoot is a source directory watched with fsnotify, and the transfers
+// that use it.
+
+type watchRoot struct {
+	dir          string
+	entries      []config.ConfigEntry
+	info         os.FileInfo // the directory as it was when the watch was added
+	lost         bool        // not watched at the moment; rewatch is running
+	healthySince time.Time   // when the watch was last known to be working
+}
+
+func newSupervisor(ctx context.Context, cfg *config.ConfigData, trackerMap *EventTracker, jrnl *journal.Journal, w *fsnotify.Watcher) *supervisor {
+	s := &supervisor{ctx: ctx, cfg: cfg, trackerMap: trackerMap, journal: jrnl, w: w, roots: make(map[string]*watchRoot)}
+	for _, entry := range cfg.Transfers {
+		if !entry.UsesFsnotify() {
+			continue
+		}
+		dir := filepath.Clean(entry.SourceDirectory)
+		root, ok := s.roots[dir]
+		if !ok {
+			root = &watchRoot{dir: entry.SourceDirectory}
+			s.roots[dir] = root
+		}
+		root.entries = append(root.entries, entry)
+	}
+	return s
+}
+
+// start adds the initial watches. Directories that can't be watched yet are
+// retried in the background.
+
+func (s *supervisor) start() {
+	for _, root := range s.roots {
+		if err := s.addWatch(root); err != nil {
+			slog.Error("Unable to watch source directory", "source", root.dir, "error", err)
+			s.lose(root, err.Error())
+			continue
+		}
+		for _, entry := range root.entries {
+			slog.Info("Tracking source directory", "source", entry.SourceDirectory, "name", entry.Name, "recursive", entry.Recursive)
+		}
+	}
+}
+
+// addWatch watches a source directory for all of its transfers.
+
+func (s *supervisor) addWatch(root *watchRoot) error {
+	info, err := os.Stat(root.dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("not a directory")
+	}
+	for _, entry := range root.entries {
+		if err := watchSourceDirectory(s.w, entry); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	root.info = info
+	root.lost = false
+	root.healthySince = time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+// lose marks a source directory as no longer watched and starts trying to
+// watch it again. It does nothing if that's already under way.
+
+func (s *supervisor) lose(root *watchRoot, reason string) {
+	s.mu.Lock()
+	if root.lost {
+		s.mu.Unlock()
+		return
+	}
+	root.lost = true
+	since := root.healthySince
+	s.mu.Unlock()
+
+	setDegraded(root.dir, reason)
+	slog.Warn("Source directory is no longer watched; will watch it again when it's back",
+		"source", root.dir, "reason", reason)
+	go s.rewatch(root, since)
+}
+
+// rewatch waits for a lost source directory to come back, watches it again
+// and picks up anything that arrived in the meantime. It gives up if the
+// tracker is stopped.
+
+func (s *supervisor) rewatch(root *watchRoot, since time.Time) {
+	delay := rewatchInitialDelay
+	for {
+		if !sleep(s.ctx, delay) {
+			return
+		}
+		err := s.addWatch(root)
+		if err == nil {
+			break
+		}
+		slog.Debug("Source directory still unavailable", "source", root.dir, "error", err, "retry_in", delay)
+		delay = min(delay*2, rewatchMaxDelay)
+	}
+
+	clearDegraded(root.dir)
+	slog.Info("Source directory is being watched again", "source", root.dir)
+	s.rescan(root, since)
+}
+
+// check looks at each watched source directory. One that has gone, or been
+// replaced by a new directory of the same name, has lost its watch.
+
+func (s *supervisor) check() {
+	for _, root := range s.roots {
+		s.mu.Lock()
+		lost, previous := root.lost, root.info
+		s.mu.Unlock()
+		if lost {
+			continue
+		}
+
+		info, err := os.Stat(root.dir)
+		switch {
+		case err != nil:
+			s.lose(root, err.Error())
+		case !info.IsDir():
+			s.lose(root, "not a directory")
+		case previous != nil && !os.SameFile(previous, info):
+			_ = s.w.Remove(root.dir)
+			s.lose(root, "directory was replaced")
+		default:
+			s.mu.Lock()
+			root.healthySince = time.Now()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// removed is called for Remove and Rename events. If it's a source directory
+// itself that has gone, its watch has gone with it.
+
+func (s *supervisor) removed(name string) {
+	if root, ok := s.roots[filepath.Clean(name)]; ok {
+		s.lose(root, "directory was removed")
+	}
+}
+
+// overflow is called when fsnotify drops events because its buffer is full.
+// There's no telling which files were missed, so every source directory is
+// rescanned.
+
+func (s *supervisor) overflow() {
+	slog.Warn("Watcher event buffer overflowed; rescanning source directories")
+	for _, root := range s.roots {
+		s.mu.Lock()
+		lost, since := root.lost, root.healthySince
+		s.mu.Unlock()
+		if !lost {
+			s.rescan(root, since)
+		}
+	}
+}
+
+// rescan records the files in a source directory that may have been missed.
+// Transfers that leave sent files where they are (no archive or delete) only
+// pick up files modified since shortly before the watch was last known to be
+// working, so files sent before the problem aren't sent again. Files the
+// journal has as queued, being sent or waiting for a deferred retry are
+// skipped whatever the transfer does with sent files.
+
+func (s *supervisor) rescan(root *watchRoot, since time.Time) {
+	cutoff := since.Add(-watchCheckInterval)
+	found := 0
+
+	for _, entry := range root.entries {
+		keepsFiles := true
+		switch strings.ToLower(strings.TrimSpace(entry.ActionOnSuccess)) {
+		case "archive", "delete":
+			keepsFiles = false
+		}
+
+		err := walkSourceFiles(entry, func(file string, de fs.DirEntry) {
+			if keepsFiles && !since.IsZero() {
+				if info, err := de.Info(); err != nil || info.ModTime().Before(cutoff) {
+					return
+				}
+			}
+			if inProgress(s.journal, file) {
+				return
+			}
+			if !s.trackerMap.AlreadyExists(file) {
+				recordIfMatched(s.cfg, s.trackerMap, file)
+				if s.trackerMap.AlreadyExists(file) {
+					found++
+				}
+			}
+		})
+		if err != nil {
+			slog.Warn("Unable to rescan source directory", "source", root.dir, "name", entry.Name, "error", err)
+		}
+	}
+
+	slog.Info("Rescanned source directory", "source", root.dir, "files", found)
+}
@@ -0,0 +1,120 @@
+package tracker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/journal"
+)
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStartTracker_RewatchesRecreatedDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "in")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	tr := NewEventTracker()
+	cfg := &config.ConfigData{Transfers: []config.ConfigEntry{{Name: "watched", SourceDirectory: dir}}}
+	go StartTracker(t.Context(), cfg, tr, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	waitUntil(t, "directory to be reported degraded", func() bool {
+		_, ok := Degraded()[dir]
+		return ok
+	})
+
+	// Whatever is written straight after the directory comes back is found by
+	// the rescan, and later files by the new watch.
+	early := writeFile(t, dir, "early.csv")
+	waitUntil(t, "directory to recover", func() bool {
+		_, ok := Degraded()[dir]
+		return !ok
+	})
+	late := writeFile(t, dir, "late.csv")
+
+	waitUntil(t, "files to be recorded", func() bool {
+		return tr.AlreadyExists(early) && tr.AlreadyExists(late)
+	})
+}
+
+func TestStartTracker_MissingDirectoryAtStart(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "later")
+
+	tr := NewEventTracker()
+	cfg := &config.ConfigData{Transfers: []config.ConfigEntry{{Name: "later", SourceDirectory: dir}}}
+	go StartTracker(t.Context(), cfg, tr, nil)
+
+	waitUntil(t, "directory to be reported degraded", func() bool {
+		_, ok := Degraded()[dir]
+		return ok
+	})
+
+	file := writeFile(t, dir, "data.csv")
+	waitUntil(t, "file to be recorded", func() bool { return tr.AlreadyExists(file) })
+	if reason, ok := Degraded()[dir]; ok {
+		t.Fatalf("expected directory to have recovered, still degraded: %s", reason)
+	}
+}
+
+func TestSupervisor_OverflowRescans(t *testing.T) {
+	dir := t.TempDir()
+	recent := writeFile(t, dir, "recent.csv")
+	old := writeFile(t, dir, "old.csv")
+	mtime := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(old, mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatalf("watcher: %v", err)
+	}
+	defer w.Close()
+
+	// Waiting for a deferred retry, so never rescanned.
+	deferred := writeFile(t, dir, "deferred.csv")
+	jrnl, err := journal.Open(filepath.Join(t.TempDir(), "journal.jsonl"))
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	defer jrnl.Close()
+	jrnl.Record(deferred, journal.Deferred, nil)
+
+	for _, action := range []string{"none", "delete"} {
+		tr := NewEventTracker()
+		cfg := &config.ConfigData{Transfers: []config.ConfigEntry{{Name: "overflow", SourceDirectory: dir, ActionOnSuccess: action}}}
+		sup := newSupervisor(t.Context(), cfg, tr, jrnl, w)
+		sup.start()
+		sup.overflow()
+
+		if !tr.AlreadyExists(recent) {
+			t.Errorf("%s: expected recent file recorded", action)
+		}
+		// Files left in place after sending are only rescanned if they changed
+		// around the time of the problem.
+		if got, want := tr.AlreadyExists(old), action == "delete"; got != want {
+			t.Errorf("%s: old file recorded=%v, want %v", action, got, want)
+		}
+		if tr.AlreadyExists(deferred) {
+			t.Errorf("%s: expected the deferred file left to the retry queue", action)
+		}
+	}
+}
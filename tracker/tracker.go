@@ -1,14 +1,17 @@
 package tracker
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
-	"regexp"
-	"strings"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/journal"
 )
 
 // Set up our tracking maps so that events can be safely handled.
@@ -16,49 +19,76 @@ import (
 // from watcher(fsnotify). This map is available to the selector routine.
 // The tracker function does some basic tests to ensure that the event
 // is one we're interested in - eg. create/notify events, and that the file
-// meets the filter criteria specified in the config.
+// meets the filter criteria specified in the config. It runs until ctx is
+// cancelled, when it stops watching and polling so no new files are picked up.
+// The journal tells it which files are already on their way through the agent.
 
-func StartTracker(cfg *config.ConfigData, trackerMap *EventTracker) {
+func StartTracker(ctx context.Context, cfg *config.ConfigData, trackerMap *EventTracker, jrnl *journal.Journal) {
 	slog.Debug("File Tracker starting")
 
-	// Create new filesystem event watcher
+	// Create new filesystem event watcher. If that fails it's retried rather
+	// than taking the whole agent down.
 
-	w, err := fsnotify.NewWatcher()
-	if err != nil {
-		slog.Error("Failed to create watcher", "error", err)
-		os.Exit(1)
+	w := newWatcher(ctx, cfg)
+	if w == nil {
+		return // stopped before a watcher could be created
 	}
 	defer w.Close()
 
-	// source directories from config are added to watcher
+	// source directories from config are added to watcher. The supervisor
+	// keeps them watched if they disappear and come back.
+
+	for _, entry := range cfg.Transfers {
+		if entry.UsesPolling() {
+			go pollSourceDirectory(ctx, cfg, entry, trackerMap)
+		}
+	}
+
+	sup := newSupervisor(ctx, cfg, trackerMap, jrnl, w)
+	sup.start()
+
+	// Pick up files that arrived while we weren't watching. This runs after the
+	// watches are in place so nothing can slip through the gap between the two.
 
 	for _, entry := range cfg.Transfers {
-		err = w.Add(entry.SourceDirectory)
-		if err != nil {
-			slog.Error(err.Error())
-		} else {
-			slog.Info("Tracking source directory", "source", entry.SourceDirectory, "name", entry.Name)
+		if entry.ScanOnStart {
+			ScanSourceDirectory(cfg, entry, trackerMap, jrnl)
 		}
 	}
 
-	// Close ready chan to signal that we’re ready to receive events
+	check := time.NewTicker(watchCheckInterval)
+	defer check.Stop()
 
 	for {
 		select {
+		case <-ctx.Done():
+			slog.Debug("File Tracker stopping")
+			return
+
 		case event, ok := <-w.Events:
 			if !ok {
 				return
 			}
 
-			slog.Debug("Filesystem event", "Op", event.Op, "Name", event.Name)
+			slog.Debug("Filesystem event", "Op", event.Op, "file", event.Name)
 
 			// Just a bit of cleanup. If a remove event is received and we've already
 			// added it to the processing list, ensure it is removed from the list.
 			// this could occur if an incoming file copy is stopped.
+			// A Rename event is for the old name of a file that was renamed or
+			// moved away (the new name, if it's somewhere we watch, arrives as a
+			// Create), so that name is gone too. If it was a directory, nothing
+			// under it is there any more either.
 
-			if event.Op&fsnotify.Remove != 0 && trackerMap.AlreadyExists(event.Name) {
-				trackerMap.Delete(event.Name)
-				slog.Debug("Cleared tracker after Remove event", "Name", event.Name)
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				if trackerMap.AlreadyExists(event.Name) {
+					slog.Debug("Cleared tracker after Remove/Rename event", "Op", event.Op, "file", event.Name)
+					trackerMap.Forget(event.Name)
+				}
+				if n := trackerMap.DeleteUnder(event.Name); n > 0 {
+					slog.Debug("Cleared tracker for files in removed or renamed directory", "file", event.Name, "files", n)
+				}
+				sup.removed(event.Name)
 			}
 
 			// if event is not a write/create event, stop processing(continue)
@@ -66,56 +96,83 @@ func StartTracker(cfg *config.ConfigData, trackerMap *EventTracker) {
 				continue
 			}
 
-			// Match against all configured transfers
-			for _, entry := range cfg.Transfers {
-				tfMatch, err := FilterMatcher(event.Name, entry)
-				if err != nil {
-					slog.Warn("Failed to match transfer", "error", err, "Name", event.Name)
-					continue
-				}
-
-				if trackerMap.AlreadyExists(event.Name) {
-					slog.Debug("File already queued", "Name", event.Name)
+			// A new directory is watched too if it's under a recursive transfer.
+			// Directories are never queued themselves.
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					watchNewDirectory(w, cfg, trackerMap, event.Name)
 					continue
 				}
-
-				if tfMatch {
-					slog.Info("Matched and queued for processing", "Name", event.Name)
-					trackerMap.RecordEvent(event.Name)
-					break // Stop after first match
-				} else {
-					slog.Debug("No match", "Name", entry.Name, "File", event.Name)
-				}
 			}
 
+			recordIfMatched(cfg, trackerMap, event.Name)
+
 		case err, ok := <-w.Errors:
 			if !ok {
 				return
 			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				sup.overflow()
+				continue
+			}
+			// Other errors often mean a watched directory has gone, so check now
+			// rather than waiting for the next tick.
 			slog.Error("Watcher error", "error", err)
+			sup.check()
+
+		case <-check.C:
+			sup.check()
 		}
 	}
 }
 
+// recordIfMatched records a new or changed file in the tracker if it belongs to
+// one of the transfers. It's shared by fsnotify and polling. The file is
+// recorded once, with every transfer that claims it; the processor sends it to
+// each of them.
+
+func recordIfMatched(cfg *config.ConfigData, trackerMap *EventTracker, name string) {
+	if trackerMap.AlreadyExists(name) {
+		// Still being written; its settle delay starts again.
+		slog.Debug("File already queued", "file", name)
+		trackerMap.RecordEvent(name)
+		return
+	}
+
+	j, ok := newJob(cfg, name)
+	if !ok {
+		return
+	}
+	trackerMap.RecordJob(j)
+	slog.Info("Matched and queued for processing", "file", name, "transfers", j.Transfers)
+}
+
+// FilterMatcher reports whether a file is one the transfer should send,
+// according to its filter, include and exclude rules. It's an error for the
+// file not to be under the transfer's source directory.
+
 func FilterMatcher(eventName string, entry config.ConfigEntry) (bool, error) {
 	// Normalise the path to avoid OS-specific path mismatches
 	rel, err := filepath.Rel(entry.SourceDirectory, eventName)
-	if err != nil || strings.HasPrefix(rel, "..") {
-		// eventName is not under SourceDirectory
+	if err != nil {
 		return false, err
 	}
+	if !underSourceDirectory(entry, eventName) {
+		return false, fmt.Errorf("%s is not in source directory %s", eventName, entry.SourceDirectory)
+	}
 
-	// If no filter is set, the path matches
-	if entry.Filter == "" {
-		return true, nil
+	// Files in subdirectories only belong to recursive transfers, and never
+	// those in the transfer's own archive or fail directory.
+	if filepath.Dir(rel) != "." {
+		if !entry.Recursive || inExcludedDir(entry, eventName) {
+			return false, nil
+		}
 	}
 
-	// Compile and evaluate the regex filter
-	re, err := regexp.Compile(entry.Filter)
+	// Rules are compiled when the config is loaded.
+	m, err := entry.Matcher()
 	if err != nil {
-		// If the regex is invalid, treat it as non-match (or log the error)
 		return false, err
 	}
-
-	return re.MatchString(filepath.Base(eventName)), nil
+	return m.Match(rel), nil
 }
@@ -1,29 +1,57 @@
 package tracker
 
 import (
+	"fmt"
 	"log/slog"
 	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+	"github.com/justin-molloy/tfagent/journal"
 )
 
 type EventTracker struct {
 	mu         sync.Mutex
 	lastEvents map[string]time.Time
+	jobs       map[string]job.Job
 }
 
 func NewEventTracker() *EventTracker {
 	slog.Debug("New Event Tracker map created")
 	return &EventTracker{
 		lastEvents: make(map[string]time.Time),
+		jobs:       make(map[string]job.Job),
 	}
 }
 
+// RecordEvent records an event for a file, starting a job for it if it hasn't
+// got one yet.
+
 func (et *EventTracker) RecordEvent(name string) {
+	et.mu.Lock()
+	j, ok := et.jobs[name]
+	et.mu.Unlock()
+	if !ok {
+		j = job.New(name)
+	}
+	et.RecordJob(j)
+}
+
+// RecordJob records an event for a file with the job it belongs to.
+
+func (et *EventTracker) RecordJob(j job.Job) {
+	job.Track(&j)
 	et.mu.Lock()
 	defer et.mu.Unlock()
-	et.lastEvents[name] = time.Now()
-	slog.Debug("RecordEvent", "name", name, "event", et.lastEvents[name])
+	et.lastEvents[j.Path] = time.Now()
+	et.jobs[j.Path] = j
+	slog.Debug("RecordEvent", "file", j.Path, "event", et.lastEvents[j.Path])
 }
 
 func (et *EventTracker) GetSnapshot() map[string]time.Time {
@@ -36,17 +64,161 @@ func (et *EventTracker) GetSnapshot() map[string]time.Time {
 	return snapshot
 }
 
+// Job returns the job for a file in the tracker.
+
+func (et *EventTracker) Job(name string) (job.Job, bool) {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	j, ok := et.jobs[name]
+	return j, ok
+}
+
 func (et *EventTracker) Delete(name string) {
-	slog.Debug("DeleteEvent", "name", name, "event", et.lastEvents[name])
 	et.mu.Lock()
 	defer et.mu.Unlock()
+	slog.Debug("DeleteEvent", "file", name, "event", et.lastEvents[name])
 	delete(et.lastEvents, name)
+	delete(et.jobs, name)
+}
+
+// Forget removes a file that has gone from the tracker, and ends its job.
+
+func (et *EventTracker) Forget(name string) {
+	et.mu.Lock()
+	j, ok := et.jobs[name]
+	et.mu.Unlock()
+	et.Delete(name)
+	if ok {
+		job.Finish(j)
+	}
+}
+
+// DeleteUnder removes every file below dir from the tracker, eg. when the
+// directory is removed or renamed, and ends their jobs. It returns how many
+// were removed.
+
+func (et *EventTracker) DeleteUnder(dir string) int {
+	prefix := filepath.Clean(dir) + string(filepath.Separator)
+	et.mu.Lock()
+	defer et.mu.Unlock()
+
+	n := 0
+	for name := range et.lastEvents {
+		if strings.HasPrefix(name, prefix) {
+			if j, ok := et.jobs[name]; ok {
+				job.Finish(j)
+			}
+			delete(et.lastEvents, name)
+			delete(et.jobs, name)
+			n++
+		}
+	}
+	return n
 }
 
 func (et *EventTracker) AlreadyExists(name string) bool {
 	et.mu.Lock()
 	defer et.mu.Unlock()
 	_, exists := et.lastEvents[name]
-	slog.Debug("AlreadyExistsEvent", "name", name, "event", et.lastEvents[name], "exists", exists)
+	slog.Debug("AlreadyExistsEvent", "file", name, "event", et.lastEvents[name], "exists", exists)
 	return exists
 }
+
+// newJob starts a job for a file, resolving the transfers that claim it so the
+// processor doesn't have to work it out again. It returns false if no transfer
+// claims the file.
+
+func newJob(cfg *config.ConfigData, name string) (job.Job, bool) {
+	j := job.New(name)
+	for _, entry := range cfg.Transfers {
+		if !underSourceDirectory(entry, name) {
+			continue
+		}
+
+		match, err := FilterMatcher(name, entry)
+		if err != nil {
+			slog.Warn("Failed to match transfer", "file", name, "name", entry.Name, "error", err)
+			continue
+		}
+		if !match {
+			slog.Debug("No match", "name", entry.Name, "file", name)
+			continue
+		}
+
+		j.Claim(entry.Name, entry.RelativePath(name))
+	}
+	return j, len(j.Transfers) > 0
+}
+
+// inProgress reports whether the journal has a file as queued, being sent or
+// waiting for a deferred retry - past the tracker, so it mustn't be recorded
+// again.
+
+func inProgress(jrnl *journal.Journal, file string) bool {
+	state, ok := jrnl.State(file)
+	return ok && state != journal.Detected
+}
+
+// ReplayJournal puts the files the journal says were still in progress when the
+// agent last stopped back into the tracker, so they go through the selector and
+// processor again - fsnotify won't report them a second time. They keep the job
+// ID they had before, and only go to the transfers that hadn't finished with
+// them. Files waiting for a deferred retry are left to the retry queue, files
+// every transfer had finished with are left for processor.SettleJournal, and
+// files that have gone since are recorded as failed.
+
+func ReplayJournal(cfg *config.ConfigData, jrnl *journal.Journal, trackerMap *EventTracker) {
+	pending := jrnl.Pending()
+	if len(pending) == 0 {
+		return
+	}
+	slog.Info("Replaying journal", "files", len(pending))
+
+	for _, r := range pending {
+		if r.State == journal.Deferred {
+			continue
+		}
+
+		j, _ := newJob(cfg, r.File)
+		if r.Job != "" {
+			j.ID = r.Job
+		}
+
+		// Transfers that had finished with the file aren't sent it again.
+		var finished []string
+		j.Transfers = slices.DeleteFunc(j.Transfers, func(name string) bool {
+			switch r.Transfers[name] {
+			case journal.Done, journal.Failed, journal.Deferred:
+				finished = append(finished, name)
+				delete(j.RelPath, name)
+				return true
+			}
+			return false
+		})
+		if len(j.Transfers) == 0 && len(finished) > 0 {
+			// The agent stopped between the last transfer finishing and the
+			// file being settled. One still waiting for a deferred retry is
+			// left to the retry queue; the rest are settled by the processor
+			// from the outcomes in the journal.
+			if slices.ContainsFunc(finished, func(name string) bool { return r.Transfers[name] == journal.Deferred }) {
+				jrnl.Record(r.File, journal.Deferred, nil)
+			}
+			continue
+		}
+		job.Track(&j)
+
+		if _, err := os.Stat(r.File); err != nil {
+			slog.Warn("File in journal no longer exists; marking failed", "file", r.File, "state", r.State)
+			jrnl.Record(r.File, journal.Failed, fmt.Errorf("file no longer exists after restart: %w", err))
+			job.Finish(j)
+			continue
+		}
+
+		if r.State == journal.Sending {
+			slog.Warn("File was being sent when the agent stopped; sending again", "file", r.File, "transfers", j.Transfers, "finished", finished)
+		} else {
+			slog.Info("Requeueing file from journal", "file", r.File, "state", r.State)
+		}
+		trackerMap.RecordJob(j)
+	}
+}
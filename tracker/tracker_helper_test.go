@@ -1,8 +1,15 @@
 package tracker
 
 import (
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 	"time"
+
+	"github.com/justin-molloy/tfagent/config"
+	"github.com/justin-molloy/tfagent/job"
+	"github.com/justin-molloy/tfagent/journal"
 )
 
 func TestRecordAndGetSnapshot(t *testing.T) {
@@ -77,3 +84,145 @@ func TestHasDuplicate(t *testing.T) {
 		t.Errorf("Expected no duplicate after delete, but got true")
 	}
 }
+
+func TestNewJob_RelPathPerTransfer(t *testing.T) {
+	src := t.TempDir()
+	reports := filepath.Join(src, "reports")
+	file := filepath.Join(reports, "a.csv")
+
+	cfg := &config.ConfigData{Transfers: []config.ConfigEntry{
+		{Name: "all", SourceDirectory: src, Recursive: true},
+		{Name: "reports", SourceDirectory: reports},
+	}}
+	j, ok := newJob(cfg, file)
+	if !ok || !slices.Equal(j.Transfers, []string{"all", "reports"}) {
+		t.Fatalf("expected both transfers to claim the file, got %+v", j)
+	}
+	if j.RelPath["all"] != "reports/a.csv" || j.RelPath["reports"] != "a.csv" {
+		t.Errorf("expected the path relative to each transfer's source directory, got %v", j.RelPath)
+	}
+}
+
+func TestReplayJournal(t *testing.T) {
+	src := t.TempDir()
+	queued := filepath.Join(src, "queued.txt")
+	sending := filepath.Join(src, "sending.txt")
+	deferred := filepath.Join(src, "deferred.txt")
+	for _, f := range []string{queued, sending, deferred} {
+		if err := os.WriteFile(f, []byte("x"), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	gone := filepath.Join(src, "gone.txt")
+
+	jrnl, err := journal.Open(filepath.Join(t.TempDir(), "journal.jsonl"))
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	defer jrnl.Close()
+
+	// The queued file had a job before the restart, and keeps its ID.
+	before := job.New(queued)
+	job.Track(&before)
+	jrnl.Record(queued, journal.Queued, nil)
+	job.Finish(before)
+	jrnl.Record(sending, journal.Sending, nil)
+	jrnl.Record(deferred, journal.Deferred, nil)
+	jrnl.Record(gone, journal.Queued, nil)
+
+	cfg := &config.ConfigData{Transfers: []config.ConfigEntry{{Name: "in", SourceDirectory: src}}}
+	et := NewEventTracker()
+	ReplayJournal(cfg, jrnl, et)
+
+	snapshot := et.GetSnapshot()
+	if len(snapshot) != 2 {
+		t.Fatalf("expected queued and sending files requeued, got %v", snapshot)
+	}
+	for _, f := range []string{queued, sending} {
+		if _, ok := snapshot[f]; !ok {
+			t.Errorf("expected %s requeued", f)
+		}
+	}
+	if j, _ := et.Job(queued); j.ID != before.ID || !slices.Equal(j.Transfers, []string{"in"}) || j.RelPath["in"] != "queued.txt" {
+		t.Errorf("expected the job to keep ID %s and claim transfer in, got %+v", before.ID, j)
+	}
+	if _, ok := jrnl.State(gone); ok {
+		t.Error("expected the missing file to be closed out as failed")
+	}
+	if state, _ := jrnl.State(deferred); state != journal.Deferred {
+		t.Errorf("expected the deferred file left to the retry queue, got %q", state)
+	}
+}
+
+func TestReplayJournal_OnlyOutstandingTransfers(t *testing.T) {
+	src := t.TempDir()
+	partly := filepath.Join(src, "partly.txt")
+	waiting := filepath.Join(src, "waiting.txt")
+	through := filepath.Join(src, "through.txt")
+	for _, f := range []string{partly, waiting, through} {
+		if err := os.WriteFile(f, []byte("x"), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	jrnl, err := journal.Open(filepath.Join(t.TempDir(), "journal.jsonl"))
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	defer jrnl.Close()
+
+	// partly.txt had been sent to partner when the agent stopped.
+	jrnl.RecordTransfer(partly, "partner", journal.Sending, nil)
+	jrnl.RecordTransfer(partly, "internal", journal.Sending, nil)
+	jrnl.RecordTransfer(partly, "partner", journal.Done, nil)
+	// waiting.txt had failed for partner and was waiting to retry internal,
+	// but the agent stopped before it was recorded as deferred.
+	jrnl.RecordTransfer(waiting, "partner", journal.Failed, nil)
+	jrnl.RecordTransfer(waiting, "internal", journal.Deferred, nil)
+	// through.txt had been sent to both, but not settled.
+	jrnl.RecordTransfer(through, "partner", journal.Done, nil)
+	jrnl.RecordTransfer(through, "internal", journal.Done, nil)
+
+	cfg := &config.ConfigData{Transfers: []config.ConfigEntry{
+		{Name: "partner", SourceDirectory: src},
+		{Name: "internal", SourceDirectory: src},
+	}}
+	et := NewEventTracker()
+	ReplayJournal(cfg, jrnl, et)
+
+	j, ok := et.Job(partly)
+	if !ok || !slices.Equal(j.Transfers, []string{"internal"}) || len(j.RelPath) != 1 {
+		t.Errorf("expected partly.txt requeued for internal only, got %+v", j)
+	}
+	if et.AlreadyExists(waiting) {
+		t.Error("expected waiting.txt left to the retry queue")
+	}
+	if state, _ := jrnl.State(waiting); state != journal.Deferred {
+		t.Errorf("expected waiting.txt recorded as deferred, got %q", state)
+	}
+	if et.AlreadyExists(through) {
+		t.Error("expected through.txt not sent again")
+	}
+	// It was delivered, so it is left for the processor to settle rather
+	// than failed.
+	if state, ok := jrnl.State(through); !ok || state.Terminal() {
+		t.Errorf("expected through.txt left in progress for the processor to settle, got %q", state)
+	}
+}
+
+func TestEventTracker_DeleteUnder(t *testing.T) {
+	dir := filepath.Join("src", "batch")
+	et := NewEventTracker()
+	et.RecordEvent(filepath.Join(dir, "a.csv"))
+	et.RecordEvent(filepath.Join(dir, "sub", "b.csv"))
+	et.RecordEvent(filepath.Join("src", "batch2", "c.csv"))
+	et.RecordEvent(dir)
+
+	if n := et.DeleteUnder(dir); n != 2 {
+		t.Fatalf("expected 2 files removed, got %d", n)
+	}
+	snapshot := et.GetSnapshot()
+	if len(snapshot) != 2 {
+		t.Fatalf("expected the sibling directory and the entry itself to remain, got %v", snapshot)
+	}
+}
@@ -1,6 +1,7 @@
 package tracker
 
 import (
+	"context"
 	"flag"
 	"log/slog"
 	"os"
@@ -28,6 +29,12 @@ func TestMain(m *testing.M) {
 	}))
 	slog.SetDefault(logger)
 
+	// Check on and recover watched directories quickly. This is set once here,
+	// as trackers started by earlier tests are still running.
+	watchCheckInterval = 50 * time.Millisecond
+	rewatchInitialDelay = 20 * time.Millisecond
+	rewatchMaxDelay = 100 * time.Millisecond
+
 	// Run tests
 	code := m.Run()
 	os.Exit(code)
@@ -49,7 +56,7 @@ func TestStartTracker_RecordsCreateEvent(t *testing.T) {
 		},
 	}
 
-	go StartTracker(cfg, tracker)
+	go StartTracker(t.Context(), cfg, tracker, nil)
 
 	// needs a delay to allow for tracker to start (could use a chan to signal ready
 	// from tracker but I'm not sure it's necessary to add it there yet.)
@@ -71,6 +78,40 @@ func TestStartTracker_RecordsCreateEvent(t *testing.T) {
 	}
 }
 
+func TestStartTracker_StopsWhenCancelled(t *testing.T) {
+	dir := t.TempDir()
+	tracker := NewEventTracker()
+	cfg := &config.ConfigData{
+		Transfers: []config.ConfigEntry{
+			{Name: "test", SourceDirectory: dir, WatchMode: "hybrid", PollInterval: 50 * time.Millisecond},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		StartTracker(ctx, cfg, tracker, nil)
+	}()
+	time.Sleep(300 * time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("StartTracker did not return after its context was cancelled")
+	}
+
+	// Neither the watcher nor polling pick up new files once stopped.
+	if err := os.WriteFile(filepath.Join(dir, "late.txt"), []byte("x"), 0644); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if snapshot := tracker.GetSnapshot(); len(snapshot) != 0 {
+		t.Errorf("Expected nothing tracked after stopping, got %v", snapshot)
+	}
+}
+
 func TestStartTracker_RecordsWriteEvent(t *testing.T) {
 	dir := t.TempDir()
 	testFile := filepath.Join(dir, "write.txt")
@@ -87,7 +128,7 @@ func TestStartTracker_RecordsWriteEvent(t *testing.T) {
 		},
 	}
 
-	go StartTracker(cfg, tracker)
+	go StartTracker(t.Context(), cfg, tracker, nil)
 
 	// needs a delay to allow for tracker to start (could use a chan to signal ready
 	// from tracker but I'm not sure it's necessary to add it there yet.)
@@ -122,7 +163,7 @@ func TestStartTracker_SkipsNonMatchingFilter(t *testing.T) {
 		},
 	}
 
-	go StartTracker(cfg, tracker)
+	go StartTracker(t.Context(), cfg, tracker, nil)
 	// needs a delay to allow for tracker to start (could use a chan to signal ready
 	// from tracker but I'm not sure it's necessary to add it there yet.)
 	time.Sleep(300 * time.Millisecond)
@@ -213,3 +254,129 @@ func TestFilterMatcher_Validations(t *testing.T) {
 		})
 	}
 }
+
+func TestStartTracker_WriteTempThenRename(t *testing.T) {
+	dir := t.TempDir()
+	tracker := NewEventTracker()
+	cfg := &config.ConfigData{
+		Transfers: []config.ConfigEntry{{Name: "rename", SourceDirectory: dir, Filter: `\.csv$`}},
+	}
+
+	go StartTracker(t.Context(), cfg, tracker, nil)
+	time.Sleep(300 * time.Millisecond)
+
+	// The producer writes under a name the filter ignores, then renames it.
+	temp := filepath.Join(dir, "orders.csv.writing")
+	final := filepath.Join(dir, "orders.csv")
+	if err := os.WriteFile(temp, []byte("id,qty\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Rename(temp, final); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+
+	waitUntil(t, "renamed file to be recorded", func() bool { return tracker.AlreadyExists(final) })
+	if tracker.AlreadyExists(temp) {
+		t.Fatalf("temporary name should never be recorded")
+	}
+}
+
+func TestStartTracker_RenameAwayFromPendingName(t *testing.T) {
+	dir := t.TempDir()
+	other := t.TempDir()
+	tracker := NewEventTracker()
+	cfg := &config.ConfigData{
+		Transfers: []config.ConfigEntry{{Name: "rename", SourceDirectory: dir}},
+	}
+
+	go StartTracker(t.Context(), cfg, tracker, nil)
+	time.Sleep(300 * time.Millisecond)
+
+	// Both names match, so the first is recorded before the rename.
+	first := filepath.Join(dir, "upload.dat")
+	second := filepath.Join(dir, "final.dat")
+	if err := os.WriteFile(first, []byte("x"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	waitUntil(t, "first name to be recorded", func() bool { return tracker.AlreadyExists(first) })
+
+	if err := os.Rename(first, second); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	waitUntil(t, "tracker to follow the rename", func() bool {
+		return tracker.AlreadyExists(second) && !tracker.AlreadyExists(first)
+	})
+
+	// Moving it out of the watched directory drops it altogether.
+	if err := os.Rename(second, filepath.Join(other, "final.dat")); err != nil {
+		t.Fatalf("move out: %v", err)
+	}
+	waitUntil(t, "moved file to be dropped", func() bool { return !tracker.AlreadyExists(second) })
+}
+
+func TestStartTracker_MoveIntoWatchedDirectory(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	tracker := NewEventTracker()
+	cfg := &config.ConfigData{
+		Transfers: []config.ConfigEntry{{Name: "move", SourceDirectory: dir, Recursive: true}},
+	}
+
+	go StartTracker(t.Context(), cfg, tracker, nil)
+	time.Sleep(300 * time.Millisecond)
+
+	// A single file, and a whole directory of files, moved in from elsewhere.
+	src := writeFile(t, outside, "moved.csv")
+	writeFile(t, filepath.Join(outside, "batch"), "a.csv")
+	writeFile(t, filepath.Join(outside, "batch"), "b.csv")
+
+	if err := os.Rename(src, filepath.Join(dir, "moved.csv")); err != nil {
+		t.Fatalf("move file: %v", err)
+	}
+	if err := os.Rename(filepath.Join(outside, "batch"), filepath.Join(dir, "batch")); err != nil {
+		t.Fatalf("move directory: %v", err)
+	}
+
+	want := []string{
+		filepath.Join(dir, "moved.csv"),
+		filepath.Join(dir, "batch", "a.csv"),
+		filepath.Join(dir, "batch", "b.csv"),
+	}
+	waitUntil(t, "moved files to be recorded", func() bool {
+		for _, f := range want {
+			if !tracker.AlreadyExists(f) {
+				return false
+			}
+		}
+		return true
+	})
+
+	// Renaming the directory drops the old paths and records the new ones.
+	if err := os.Rename(filepath.Join(dir, "batch"), filepath.Join(dir, "batch2")); err != nil {
+		t.Fatalf("rename directory: %v", err)
+	}
+	waitUntil(t, "tracker to follow the directory rename", func() bool {
+		return !tracker.AlreadyExists(want[1]) && tracker.AlreadyExists(filepath.Join(dir, "batch2", "a.csv"))
+	})
+}
+
+func TestRecordIfMatched_RestartsSettleDelay(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "data.csv")
+	cfg := &config.ConfigData{Transfers: []config.ConfigEntry{{Name: "a", SourceDirectory: dir}}}
+	et := NewEventTracker()
+
+	recordIfMatched(cfg, et, file)
+	first, _ := et.Job(file)
+	firstEvent := et.GetSnapshot()[file]
+
+	time.Sleep(10 * time.Millisecond)
+	recordIfMatched(cfg, et, file)
+	again, _ := et.Job(file)
+	if !et.GetSnapshot()[file].After(firstEvent) {
+		t.Fatal("expected a later event to restart the settle delay")
+	}
+	if again.ID != first.ID || !again.Detected.Equal(first.Detected) {
+		t.Fatalf("expected the same job, got %+v then %+v", first, again)
+	}
+}
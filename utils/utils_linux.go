@@ -0,0 +1,172 @@
+//go:build linux
+
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// getLockCmd asks for the lock that would conflict with one we want. Open file
+// description locks see both those and classic per-process ones.
+const getLockCmd = unix.F_OFD_GETLK
+
+// procRoot is where /proc is mounted. It's a variable so tests can use a fake one.
+var procRoot = "/proc"
+
+// CheckReadyForProcessing returns true if the file exists, has non-zero size,
+// and isn't still being written by another process. A file is taken as still
+// being written if another process holds an advisory lock that would stop it
+// being read, or has it open for writing according to /proc. If /proc can't
+// be checked for every process (eg. other users' processes, when not running as
+// root), a file nobody is seen writing must also have kept the same size and
+// modification time for a short while. To check many files at once, use a
+// ReadyChecker.
+
+func CheckReadyForProcessing(path string) bool {
+	return NewReadyChecker().Ready(path)
+}
+
+// ReadyChecker checks whether files are ready for processing, as
+// CheckReadyForProcessing does, sharing one look through /proc between them.
+// /proc is only walked once a file has got past the cheaper checks, and at
+// most once, so a burst of files costs one walk rather than one per file. Make
+// a new one for each pass over the files waiting to be queued.
+
+type ReadyChecker struct {
+	scanned  bool
+	open     map[string][]string // file -> fdinfo of each other process's descriptor for it
+	complete bool                // every process could be checked
+}
+
+// NewReadyChecker returns a checker for one pass over the files waiting to be
+// queued.
+
+func NewReadyChecker() *ReadyChecker {
+	return &ReadyChecker{}
+}
+
+// Ready reports whether a file is ready for processing.
+
+func (c *ReadyChecker) Ready(path string) bool {
+	// 1. Check if file exists and is non-empty
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		forget(path)
+		return false
+	}
+
+	// 2. Check for advisory locks held by writers
+	if writeLocked(path) {
+		return false
+	}
+
+	// 3. Look for processes that have it open for writing
+	writing, complete := c.openForWriting(path)
+	if writing {
+		return false
+	}
+	if complete {
+		forget(path)
+		return true
+	}
+
+	// 4. Fall back to waiting for it to stop changing
+	return stableFor(path, info)
+}
+
+// openForWriting reports whether another process has the file open for
+// writing. complete is false if /proc isn't available or some processes
+// couldn't be checked, in which case writing only covers the rest.
+
+func (c *ReadyChecker) openForWriting(path string) (writing, complete bool) {
+	target, err := filepath.Abs(path)
+	if err != nil {
+		return false, false
+	}
+	if resolved, err := filepath.EvalSymlinks(target); err == nil {
+		target = resolved
+	}
+
+	if !c.scanned {
+		c.open, c.complete = scanOpenFiles()
+		c.scanned = true
+	}
+	for _, fdinfo := range c.open[target] {
+		if openedForWriting(fdinfo) {
+			return true, c.complete
+		}
+	}
+	return false, c.complete
+}
+
+// scanOpenFiles looks through /proc/*/fd for the files other processes have
+// open. Only the links are read; whether a file is open for writing is looked
+// up later, for the files that are asked about. complete is false if /proc
+// isn't available or some processes couldn't be checked.
+
+func scanOpenFiles() (open map[string][]string, complete bool) {
+	procs, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, false
+	}
+	self := strconv.Itoa(os.Getpid())
+
+	open = make(map[string][]string)
+	complete = true
+	for _, p := range procs {
+		pid := p.Name()
+		if _, err := strconv.Atoi(pid); err != nil || pid == self {
+			continue
+		}
+
+		fdDir := filepath.Join(procRoot, pid, "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) { // gone since the listing
+				complete = false
+			}
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !filepath.IsAbs(link) {
+				continue // closed since the listing, or a pipe, socket etc.
+			}
+			open[link] = append(open[link], filepath.Join(procRoot, pid, "fdinfo", fd.Name()))
+		}
+	}
+	return open, complete
+}
+
+// openedForWriting reads the flags of an open file from /proc/<pid>/fdinfo/<fd>.
+// If they can't be read it's assumed to be open for writing.
+
+func openedForWriting(fdinfo string) bool {
+	f, err := os.Open(fdinfo)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "flags:")
+		if !ok {
+			continue
+		}
+		flags, err := strconv.ParseUint(strings.TrimSpace(value), 8, 32)
+		if err != nil {
+			return true
+		}
+		return flags&unix.O_ACCMODE != unix.O_RDONLY
+	}
+	return true
+}
@@ -0,0 +1,232 @@
+//go:build linux
+
+package utils
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// useProc points the check at a fake /proc for the test.
+func useProc(t *testing.T, root string) {
+	t.Helper()
+	old := procRoot
+	procRoot = root
+	t.Cleanup(func() { procRoot = old })
+}
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	filePath := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	return filePath
+}
+
+// fakeFd adds an open file to a fake /proc.
+func fakeFd(t *testing.T, root, pid, fd, target, flags string) {
+	t.Helper()
+	for _, dir := range []string{"fd", "fdinfo"} {
+		if err := os.MkdirAll(filepath.Join(root, pid, dir), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	if err := os.Symlink(target, filepath.Join(root, pid, "fd", fd)); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	info := "pos:\t0\nflags:\t" + flags + "\nmnt_id:\t1\n"
+	if err := os.WriteFile(filepath.Join(root, pid, "fdinfo", fd), []byte(info), 0644); err != nil {
+		t.Fatalf("write fdinfo: %v", err)
+	}
+}
+
+func TestCheckReadyForProcessing(t *testing.T) {
+	useProc(t, t.TempDir()) // no other processes
+	filePath := writeTestFile(t, "testfile.txt", "hello world")
+
+	if !CheckReadyForProcessing(filePath) {
+		t.Errorf("Expected file to be ready for processing, but got false")
+	}
+}
+
+func TestCheckReadyForProcessing_EmptyOrMissing(t *testing.T) {
+	useProc(t, t.TempDir())
+	empty := writeTestFile(t, "empty.txt", "")
+
+	if CheckReadyForProcessing(empty) {
+		t.Errorf("Expected empty file not to be ready")
+	}
+	if CheckReadyForProcessing(filepath.Join(t.TempDir(), "missing.txt")) {
+		t.Errorf("Expected missing file not to be ready")
+	}
+	if CheckReadyForProcessing(t.TempDir()) {
+		t.Errorf("Expected directory not to be ready")
+	}
+}
+
+func TestCheckReadyForProcessing_FileLocked(t *testing.T) {
+	useProc(t, t.TempDir())
+	filePath := writeTestFile(t, "lockedfile.txt", "test content")
+
+	f, err := os.OpenFile(filePath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		t.Fatalf("Failed to lock file: %v", err)
+	}
+
+	if CheckReadyForProcessing(filePath) {
+		t.Errorf("Expected file to be locked and not ready, but got true")
+	}
+
+	// Once the writer lets go it's ready.
+	unix.Flock(int(f.Fd()), unix.LOCK_UN)
+	if !CheckReadyForProcessing(filePath) {
+		t.Errorf("Expected file to be ready once unlocked")
+	}
+}
+
+func TestCheckReadyForProcessing_FcntlLocked(t *testing.T) {
+	useProc(t, t.TempDir())
+	filePath := writeTestFile(t, "lockedfile.txt", "test content")
+
+	f, err := os.OpenFile(filePath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	defer f.Close()
+	lk := unix.Flock_t{Type: unix.F_WRLCK}
+	if err := unix.FcntlFlock(f.Fd(), unix.F_OFD_SETLK, &lk); err != nil {
+		t.Skipf("open file description locks not supported: %v", err)
+	}
+
+	if CheckReadyForProcessing(filePath) {
+		t.Errorf("Expected file with a write lock not to be ready")
+	}
+}
+
+func TestCheckReadyForProcessing_SharedLockIsNotWriting(t *testing.T) {
+	useProc(t, t.TempDir())
+	filePath := writeTestFile(t, "shared.txt", "test content")
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_SH|unix.LOCK_NB); err != nil {
+		t.Fatalf("Failed to lock file: %v", err)
+	}
+
+	if !CheckReadyForProcessing(filePath) {
+		t.Errorf("Expected file only locked by a reader to be ready")
+	}
+}
+
+func TestCheckReadyForProcessing_OpenForWriting(t *testing.T) {
+	filePath := writeTestFile(t, "writing.txt", "test content")
+
+	// Another process holds the file open for writing, as a copy in progress would.
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	cmd := exec.Command("sleep", "30")
+	cmd.ExtraFiles = []*os.File{f}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("unable to start a process: %v", err)
+	}
+	f.Close()
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	if CheckReadyForProcessing(filePath) {
+		t.Errorf("Expected file open for writing by another process not to be ready")
+	}
+}
+
+func TestOpenForWriting_FakeProc(t *testing.T) {
+	root := t.TempDir()
+	useProc(t, root)
+	filePath := writeTestFile(t, "data.csv", "x")
+	other := writeTestFile(t, "other.csv", "x")
+
+	fakeFd(t, root, "100", "3", filePath, "0100000") // reader
+	fakeFd(t, root, "101", "4", other, "0100001")    // writing something else
+	if err := os.MkdirAll(filepath.Join(root, "sys"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	writing, complete := NewReadyChecker().openForWriting(filePath)
+	if writing || !complete {
+		t.Fatalf("expected a complete scan with no writers, got writing=%v complete=%v", writing, complete)
+	}
+
+	for _, flags := range []string{"0100001", "02", "0102002"} { // O_WRONLY, O_RDWR, O_RDWR|O_APPEND
+		root := t.TempDir()
+		useProc(t, root)
+		fakeFd(t, root, "200", "5", filePath, flags)
+		if writing, _ := NewReadyChecker().openForWriting(filePath); !writing {
+			t.Errorf("flags %s: expected the file to be open for writing", flags)
+		}
+	}
+}
+
+func TestReadyChecker_ScansProcOncePerPass(t *testing.T) {
+	root := t.TempDir()
+	useProc(t, root)
+	first := writeTestFile(t, "first.csv", "x")
+	second := writeTestFile(t, "second.csv", "x")
+
+	c := NewReadyChecker()
+	if !c.Ready(first) {
+		t.Fatal("expected first file to be ready")
+	}
+
+	// Opened for writing after the pass started: this pass uses the /proc it
+	// has already read, the next one sees the writer.
+	fakeFd(t, root, "300", "3", second, "0100001")
+	if !c.Ready(second) {
+		t.Error("expected /proc not to be read again in the same pass")
+	}
+	if NewReadyChecker().Ready(second) {
+		t.Error("expected the next pass to see the writer")
+	}
+}
+
+func TestCheckReadyForProcessing_FallsBackToStability(t *testing.T) {
+	useProc(t, filepath.Join(t.TempDir(), "no-proc"))
+	old := stabilityWindow
+	stabilityWindow = 100 * time.Millisecond
+	t.Cleanup(func() { stabilityWindow = old })
+
+	filePath := writeTestFile(t, "slow.txt", "part")
+
+	if CheckReadyForProcessing(filePath) {
+		t.Fatal("Expected first check without /proc not to be ready")
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	// Still being written: the wait starts again.
+	if err := os.WriteFile(filePath, []byte("part two"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if CheckReadyForProcessing(filePath) {
+		t.Fatal("Expected changed file not to be ready")
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	if !CheckReadyForProcessing(filePath) {
+		t.Fatal("Expected file to be ready once it stopped changing")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package utils
+
+// ReadyChecker checks whether files are ready for processing. Only Linux has
+// anything to share between the checks; elsewhere each file is checked on its
+// own.
+
+type ReadyChecker struct{}
+
+// NewReadyChecker returns a checker for one pass over the files waiting to be
+// queued.
+
+func NewReadyChecker() *ReadyChecker {
+	return &ReadyChecker{}
+}
+
+// Ready is CheckReadyForProcessing.
+
+func (c *ReadyChecker) Ready(path string) bool {
+	return CheckReadyForProcessing(path)
+}
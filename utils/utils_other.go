@@ -0,0 +1,35 @@
+//go:build unix && !linux
+
+package utils
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// getLockCmd asks for the lock that would conflict with one we want. Only
+// classic per-process locks can be checked here.
+const getLockCmd = unix.F_GETLK
+
+// CheckReadyForProcessing returns true if the file exists, has non-zero size,
+// isn't locked by a writer, and has kept the same size and modification time
+// for a short while. There's no /proc to see which files other processes have
+// open, so the wait is always needed.
+
+func CheckReadyForProcessing(path string) bool {
+	// 1. Check if file exists and is non-empty
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		forget(path)
+		return false
+	}
+
+	// 2. Check for advisory locks held by writers
+	if writeLocked(path) {
+		return false
+	}
+
+	// 3. Wait for it to stop changing
+	return stableFor(path, info)
+}
@@ -0,0 +1,96 @@
+//go:build unix
+
+package utils
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// stabilityWindow is how long a file's size and modification time must stay
+// the same before it's taken as finished, when there's no way of telling
+// whether another process still has it open.
+var stabilityWindow = 2 * time.Second
+
+// forgetAfter is how long a file that hasn't been checked again is remembered.
+const forgetAfter = time.Hour
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+	since   time.Time // when the file was first seen with this size and mtime
+}
+
+var seen = struct {
+	mu    sync.Mutex
+	files map[string]fileState
+}{files: make(map[string]fileState)}
+
+// stableFor reports whether a file has had the same size and modification
+// time for at least stabilityWindow. The first check only notes them, so it
+// never reports a file as stable.
+
+func stableFor(path string, info os.FileInfo) bool {
+	now := time.Now()
+	seen.mu.Lock()
+	defer seen.mu.Unlock()
+
+	for p, s := range seen.files {
+		if now.Sub(s.since) > forgetAfter {
+			delete(seen.files, p)
+		}
+	}
+
+	s, ok := seen.files[path]
+	if !ok || s.size != info.Size() || !s.modTime.Equal(info.ModTime()) {
+		seen.files[path] = fileState{size: info.Size(), modTime: info.ModTime(), since: now}
+		return false
+	}
+	if now.Sub(s.since) < stabilityWindow {
+		return false
+	}
+	delete(seen.files, path)
+	return true
+}
+
+// forget drops what stableFor knows about a file.
+
+func forget(path string) {
+	seen.mu.Lock()
+	defer seen.mu.Unlock()
+	delete(seen.files, path)
+}
+
+// writeLocked reports whether another process holds a flock or fcntl lock on
+// the file that would stop it being read. Shared locks taken by readers don't
+// count. Filesystems that don't support locks are taken as unlocked.
+
+func writeLocked(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return true // it was there a moment ago; try again later
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+
+	// flock: a shared lock can't be had while someone holds an exclusive one.
+	if err := unix.Flock(fd, unix.LOCK_SH|unix.LOCK_NB); err != nil {
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return true
+		}
+	} else {
+		_ = unix.Flock(fd, unix.LOCK_UN)
+	}
+
+	// fcntl: ask whether a read lock on the whole file would conflict with a
+	// write lock.
+	lk := unix.Flock_t{Type: unix.F_RDLCK}
+	if err := unix.FcntlFlock(uintptr(fd), getLockCmd, &lk); err == nil && lk.Type != unix.F_UNLCK {
+		return true
+	}
+	return false
+}